@@ -4,31 +4,74 @@ import (
 	"errors"
 	"net/http"
 	"vehicledb/auth"
+	"vehicledb/db"
 )
 
 type UserHandlerFunc func(user *auth.ClaimsUser, w http.ResponseWriter, r *http.Request)
 
+// requestToken returns the session token from the bearer header or, failing
+// that, the auth cookie. The bearer token wins when both are present.
+func requestToken(r *http.Request) string {
+	token := bearerToken(r)
+	if token != "" {
+		return token
+	}
+
+	cookie, err := r.Cookie(authCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// RequireAuth authenticates the request with either a bearer token or the
+// auth cookie, preferring the bearer token when both are present. Tokens
+// outlive the accounts they were issued for, so it relies on withUser, which
+// runs on every route, to have checked that the account still exists.
 func RequireAuth(f UserHandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(authCookieName)
-		if err != nil {
-			w.WriteHeader(401)
-			renderJson(w, "must pass cookie")
+		token := requestToken(r)
+		if token == "" {
+			renderError(w, db.NewError(db.ErrUnauthenticated, "must pass cookie or bearer token"))
 			return
 		}
 
-		user, err := auth.ValidateToken(cookie.Value)
-		if err != nil {
-			renderError(w, err)
+		user, err := auth.ValidateToken(token)
+		if err != nil || user == nil {
+			renderError(w, db.NewError(db.ErrUnauthenticated, "invalid or expired token"))
 			return
 		}
 
-		if user == nil {
-			w.WriteHeader(403)
-			renderJson(w, errors.New("invalid jwt"))
+		if auth.FromContext(r.Context()) == nil {
+			renderError(w, db.NewError(db.ErrUnauthenticated, "the account no longer exists"))
 			return
 		}
 
-		f(user, w, r)
+		f(user, w, r.WithContext(auth.NewContext(r.Context(), user)))
 	}
 }
+
+// withUser adds the authenticated user, if there is one, to the request
+// context without rejecting anonymous requests. It runs on every route, so
+// writes record their actor; GraphQL resolvers decide for themselves which
+// fields need a user. A token for an account that has since been deleted or
+// purged is treated as no token at all.
+func (s *server) withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token != "" {
+			if user, err := auth.ValidateToken(token); err == nil && user != nil {
+				_, err = s.store.GetUser(r.Context(), user.UserID)
+				if err != nil && !errors.Is(err, db.ErrNotFound) {
+					renderError(w, err)
+					return
+				}
+				if err == nil {
+					r = r.WithContext(auth.NewContext(r.Context(), user))
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
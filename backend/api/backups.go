@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+var backupSortKeys = []db.SortKey{
+	{Name: "created_at", Column: "created_at"},
+}
+
+func (s *server) listBackups(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	if !s.requireAdmin(user, writer, request) {
+		return
+	}
+
+	backups, err := s.backups.List()
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	// backups are files rather than rows, but no two are taken in the same
+	// instant, so the time alone orders them
+	indexes, next, err := pageOf(request, len(backups), backupSortKeys, "-created_at", func(idx int, key string) (interface{}, db.RowID) {
+		return db.CursorTime(backups[idx].CreatedAt), 0
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	page := make([]*db.BackupInfo, 0, len(indexes))
+	for _, idx := range indexes {
+		page = append(page, backups[idx])
+	}
+	renderList(writer, request, page, next)
+}
+
+// createBackup takes a backup on demand, in addition to the scheduled ones.
+// It counts against the same retention.
+func (s *server) createBackup(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	if !s.requireAdmin(user, writer, request) {
+		return
+	}
+
+	backup, err := s.backups.Create(request.Context())
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	s.recordSecurityEvent(request, db.SecurityEvent{
+		EventType: db.EventAdminAction,
+		ActorID:   &user.UserID,
+		Details:   map[string]string{"action": "create_backup", "backup": backup.Name},
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(201)
+	renderJson(writer, backup)
+}
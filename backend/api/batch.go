@@ -0,0 +1,319 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+const maxBatchSize = 1000
+
+// BatchOperation is one request of a batch: the method and path it would be
+// sent to on its own, its If-Match and Content-Type headers and its body.
+type BatchOperation struct {
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	IfMatch     string          `json:"if_match,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+}
+
+type BatchRequest struct {
+	// Atomic batches are applied in one transaction: all of them or, if
+	// any fails, none. Otherwise each operation stands alone.
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+var batchSchema = fmt.Sprintf(`{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "atomic": {"type": "boolean"},
+    "operations": {
+      "type": "array",
+      "minItems": 1,
+      "maxItems": %d,
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "method": {"type": "string"},
+          "path": {"type": "string"},
+          "if_match": {"type": "string"},
+          "content_type": {"type": "string"},
+          "body": {}
+        },
+        "required": ["method", "path"]
+      }
+    }
+  },
+  "required": ["operations"]
+}`, maxBatchSize)
+
+// BatchResult is the outcome of one operation of a batch: the status and
+// body it would have been answered with on its own, or the problem.
+type BatchResult struct {
+	Status int         `json:"status"`
+	Body   interface{} `json:"body,omitempty"`
+	Error  *Problem    `json:"error,omitempty"`
+}
+
+// BatchResponse has a result for each operation, in order.
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// batchStep applies one operation of a batch within tx.
+type batchStep func(ctx context.Context, tx db.Tx) (interface{}, error)
+
+// batchRoutes are the operations that may be batched, named by operation ID.
+var batchRoutes = func() *mux.Router {
+	router := mux.NewRouter()
+	router.Path("/v1/vehicles/").Methods("POST").Name("createVehicle")
+	router.Path("/v1/vehicles/{vehicleId}").Methods("PATCH").Name("updateVehicle")
+	router.Path("/v1/vehicles/{vehicleId}").Methods("DELETE").Name("deleteVehicle")
+	return router
+}()
+
+// prepareBatchStep validates an operation and works out how to apply it.
+// Nothing is applied until every operation of the batch is prepared.
+func (s *server) prepareBatchStep(user *auth.ClaimsUser, op BatchOperation) (batchStep, error) {
+	request, err := http.NewRequest(op.Method, op.Path, nil)
+	if err != nil {
+		return nil, invalidField("/path", "invalid_value", "%v", err)
+	}
+	var match mux.RouteMatch
+	if !batchRoutes.Match(request, &match) {
+		return nil, invalidField("/path", "unsupported", "%s %s can't be batched", op.Method, op.Path)
+	}
+
+	vehicleId := db.RowID(0)
+	if value, ok := match.Vars["vehicleId"]; ok {
+		vehicleId, err = db.ParseRowID(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch match.Route.GetName() {
+	case "createVehicle":
+		var createVehicleRequest CreateVehicleRequest
+		err := s.schemas.decodeBody(op.Body, "createVehicle", &createVehicleRequest)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, tx db.Tx) (interface{}, error) {
+			return tx.CreateVehicle(ctx, user.UserID, createVehicleRequest.Year, createVehicleRequest.Make, createVehicleRequest.Model)
+		}, nil
+
+	case "updateVehicle":
+		changes, err := s.schemas.readPatch(op.ContentType, op.Body, "updateVehicle")
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, tx db.Tx) (interface{}, error) {
+			return s.updateUserVehicle(ctx, tx, user, vehicleId, op.IfMatch, changes)
+		}, nil
+
+	case "deleteVehicle":
+		return func(ctx context.Context, tx db.Tx) (interface{}, error) {
+			return deleteUserVehicle(ctx, tx, user, vehicleId, op.IfMatch)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no batch step for %s", match.Route.GetName())
+}
+
+// notApplied is the result of an operation of an atomic batch that was
+// rolled back, or never tried, because another failed.
+var notApplied = &statusError{Status: 424, Code: "not_applied", Message: "another operation of the batch failed"}
+
+// runBatch validates every operation, then applies them. In an atomic batch
+// a failure rolls back all of them, and is returned along with the results.
+func (s *server) runBatch(ctx context.Context, user *auth.ClaimsUser, batch BatchRequest, requestID string) ([]BatchResult, error) {
+	results := make([]BatchResult, len(batch.Operations))
+	steps := make([]batchStep, len(batch.Operations))
+
+	var failed error
+	for idx, op := range batch.Operations {
+		step, err := s.prepareBatchStep(user, op)
+		if err != nil {
+			results[idx] = batchFailure(err, requestID)
+			if failed == nil {
+				failed = fmt.Errorf("operation %d is invalid: %w", idx, err)
+			}
+			continue
+		}
+		steps[idx] = step
+	}
+
+	if !batch.Atomic {
+		for idx, step := range steps {
+			if step == nil {
+				continue
+			}
+			var body interface{}
+			err := s.store.InTx(ctx, func(tx db.Tx) error {
+				var err error
+				body, err = step(ctx, tx)
+				return err
+			})
+			if err != nil {
+				results[idx] = batchFailure(err, requestID)
+			} else {
+				results[idx] = BatchResult{Status: 200, Body: body}
+			}
+		}
+		return results, nil
+	}
+
+	if failed == nil {
+		failed = s.store.InTx(ctx, func(tx db.Tx) error {
+			for idx, step := range steps {
+				body, err := step(ctx, tx)
+				if err != nil {
+					results[idx] = batchFailure(err, requestID)
+					return fmt.Errorf("operation %d failed: %w", idx, err)
+				}
+				results[idx] = BatchResult{Status: 200, Body: body}
+			}
+			return nil
+		})
+	}
+	if failed != nil {
+		for idx := range results {
+			if results[idx].Error == nil {
+				results[idx] = batchFailure(notApplied, requestID)
+			}
+		}
+	}
+	return results, failed
+}
+
+func batchFailure(err error, requestID string) BatchResult {
+	problem := problemFor(err, requestID)
+	return BatchResult{Status: problem.Status, Error: problem}
+}
+
+// renderBatch answers a batch. An atomic batch that failed is answered with
+// the problem that failed it, with every operation's result alongside.
+func renderBatch(writer http.ResponseWriter, results []BatchResult, err error) {
+	if err == nil {
+		renderJson(writer, BatchResponse{Results: results})
+		return
+	}
+
+	problem := problemFor(err, writer.Header().Get(requestIDHeader))
+	problem.Details = map[string]interface{}{"results": results}
+	renderProblem(writer, problem)
+}
+
+// batch applies many operations in one request, e.g. to import a fleet.
+func (s *server) batch(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	var batchRequest BatchRequest
+	err := s.schemas.decodeRequest(request, "batch", &batchRequest)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	results, err := s.runBatch(request.Context(), user, batchRequest, writer.Header().Get(requestIDHeader))
+	renderBatch(writer, results, err)
+}
+
+// BulkCreateVehiclesRequest adds many vehicles, each as createVehicle would.
+type BulkCreateVehiclesRequest struct {
+	Atomic   bool              `json:"atomic"`
+	Vehicles []json.RawMessage `json:"vehicles"`
+}
+
+// BulkUpdateVehiclesRequest changes many vehicles, each as updateVehicle
+// would with a merge patch.
+type BulkUpdateVehiclesRequest struct {
+	Atomic   bool `json:"atomic"`
+	Vehicles []struct {
+		VehicleID db.RowID        `json:"vehicle_id"`
+		IfMatch   string          `json:"if_match"`
+		Changes   json.RawMessage `json:"changes"`
+	} `json:"vehicles"`
+}
+
+// the vehicles themselves are validated one at a time, so that one that's
+// invalid only fails itself
+var bulkCreateVehiclesSchema = fmt.Sprintf(`{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "atomic": {"type": "boolean"},
+    "vehicles": {"type": "array", "minItems": 1, "maxItems": %d, "items": {"type": "object"}}
+  },
+  "required": ["vehicles"]
+}`, maxBatchSize)
+
+var bulkUpdateVehiclesSchema = fmt.Sprintf(`{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "atomic": {"type": "boolean"},
+    "vehicles": {
+      "type": "array",
+      "minItems": 1,
+      "maxItems": %d,
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "vehicle_id": {"type": "integer"},
+          "if_match": {"type": "string"},
+          "changes": {"type": "object"}
+        },
+        "required": ["vehicle_id", "changes"]
+      }
+    }
+  },
+  "required": ["vehicles"]
+}`, maxBatchSize)
+
+func (s *server) bulkCreateVehicles(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	var bulkRequest BulkCreateVehiclesRequest
+	err := s.schemas.decodeRequest(request, "bulkCreateVehicles", &bulkRequest)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	batch := BatchRequest{Atomic: bulkRequest.Atomic}
+	for _, vehicle := range bulkRequest.Vehicles {
+		batch.Operations = append(batch.Operations, BatchOperation{Method: "POST", Path: "/v1/vehicles/", Body: vehicle})
+	}
+
+	results, err := s.runBatch(request.Context(), user, batch, writer.Header().Get(requestIDHeader))
+	renderBatch(writer, results, err)
+}
+
+func (s *server) bulkUpdateVehicles(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	var bulkRequest BulkUpdateVehiclesRequest
+	err := s.schemas.decodeRequest(request, "bulkUpdateVehicles", &bulkRequest)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	batch := BatchRequest{Atomic: bulkRequest.Atomic}
+	for _, vehicle := range bulkRequest.Vehicles {
+		batch.Operations = append(batch.Operations, BatchOperation{
+			Method:  "PATCH",
+			Path:    "/v1/vehicles/" + vehicle.VehicleID.String(),
+			IfMatch: vehicle.IfMatch,
+			Body:    vehicle.Changes,
+		})
+	}
+
+	results, err := s.runBatch(request.Context(), user, batch, writer.Header().Get(requestIDHeader))
+	renderBatch(writer, results, err)
+}
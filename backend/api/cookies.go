@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+var (
+	authCookieName = "auth"
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// CookieOptions controls the attributes of the cookies set on login. The auth
+// cookie is always HttpOnly; the CSRF cookie is readable by scripts so that
+// the frontend can echo it back in the X-CSRF-Token header.
+type CookieOptions struct {
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+var DefaultCookieOptions = CookieOptions{
+	Secure:   false,
+	SameSite: http.SameSiteLaxMode,
+}
+
+func (s *server) setAuthCookie(w http.ResponseWriter, user *db.User) error {
+	token, err := auth.CreateToken(user)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(auth.TokenLifetime)
+	csrfToken := auth.CreateCSRFToken(token)
+
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     authCookieName,
+		Value:    token,
+		Domain:   s.cookies.Domain,
+		Expires:  expires,
+		MaxAge:   int(auth.TokenLifetime.Seconds()),
+		Secure:   s.cookies.Secure,
+		HttpOnly: true,
+		SameSite: s.cookies.SameSite,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Domain:   s.cookies.Domain,
+		Expires:  expires,
+		MaxAge:   int(auth.TokenLifetime.Seconds()),
+		Secure:   s.cookies.Secure,
+		SameSite: s.cookies.SameSite,
+	})
+	w.Header().Set(csrfHeaderName, csrfToken)
+
+	return nil
+}
+
+func (s *server) removeAuthCookie(w http.ResponseWriter) {
+	for _, name := range []string{authCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Path:     "/",
+			Name:     name,
+			Value:    "",
+			Domain:   s.cookies.Domain,
+			Expires:  time.Unix(0, 0),
+			MaxAge:   -1,
+			Secure:   s.cookies.Secure,
+			HttpOnly: name == authCookieName,
+			SameSite: s.cookies.SameSite,
+		})
+	}
+}
+
+// ParseSameSite converts a flag value (lax, strict, none) into an http.SameSite.
+func ParseSameSite(value string) (http.SameSite, error) {
+	switch value {
+	case "lax", "Lax", "":
+		return http.SameSiteLaxMode, nil
+	case "strict", "Strict":
+		return http.SameSiteStrictMode, nil
+	case "none", "None":
+		return http.SameSiteNoneMode, nil
+	}
+
+	return http.SameSiteDefaultMode, fmt.Errorf("unknown SameSite mode '%s'", value)
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"vehicledb/auth"
+)
+
+// csrfExempt lists the routes that establish a session rather than act on
+// one, so they must work even when a stale auth cookie is still around.
+var csrfExempt = map[string]map[string]bool{
+	"/v1/session": {"POST": true},
+	"/v1/users/":  {"POST": true},
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// bearerToken returns the token from an "Authorization: Bearer ..." header,
+// or an empty string when the request isn't using bearer auth.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(header[7:])
+}
+
+// CSRFProtect rejects state-changing requests that are authenticated by the
+// auth cookie but don't echo the matching CSRF token in the X-CSRF-Token
+// header. Requests using a bearer token aren't sent automatically by the
+// browser, so they are exempt.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) || bearerToken(r) != "" || csrfExempt[r.URL.Path][r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(authCookieName)
+		if err != nil || cookie.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !auth.ValidateCSRFToken(cookie.Value, r.Header.Get(csrfHeaderName)) {
+			renderError(w, &statusError{Status: 403, Code: "csrf_token_invalid", Message: "echo the csrf token in the " + csrfHeaderName + " header"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
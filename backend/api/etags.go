@@ -0,0 +1,84 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"vehicledb/db"
+)
+
+// etag is the strong entity tag for a version of a record.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func setETag(writer http.ResponseWriter, version int64) {
+	writer.Header().Set("ETag", etag(version))
+}
+
+// parseETags splits an If-Match or If-None-Match header into its tags.
+func parseETags(header string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// notModified reports whether the client's If-None-Match already names this
+// version, in which case it gets a 304 instead of the record. As RFC 7232
+// asks, the comparison is weak, so W/"3" matches "3".
+func notModified(request *http.Request, version int64) bool {
+	header := request.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	current := etag(version)
+	for _, tag := range parseETags(header) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+// renderNotModified answers a conditional GET whose copy is still current.
+func renderNotModified(writer http.ResponseWriter, version int64) {
+	setETag(writer, version)
+	writer.WriteHeader(http.StatusNotModified)
+}
+
+// expectedVersion is the version a PATCH or DELETE may be applied to, from
+// its If-Match header. Without one, or with *, any version will do and it's
+// 0. A header that doesn't name current is a VersionMismatchError. Weak tags
+// never match, since the comparison for If-Match is strong.
+func expectedVersion(request *http.Request, current int64) (int64, error) {
+	return matchVersion(request.Header.Get("If-Match"), current)
+}
+
+// matchVersion is expectedVersion for the value of an If-Match header.
+func matchVersion(header string, current int64) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+
+	tags := parseETags(header)
+	for _, tag := range tags {
+		if tag == "*" {
+			return 0, nil
+		}
+		if tag == etag(current) {
+			return current, nil
+		}
+	}
+
+	mismatch := &db.VersionMismatchError{Current: current}
+	if len(tags) == 1 {
+		mismatch.Expected, _ = strconv.ParseInt(strings.Trim(tags[0], `"`), 10, 64)
+	}
+	return 0, mismatch
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+const (
+	lastEventIDHeader = "Last-Event-ID"
+	// eventWriteTimeout bounds each write to an event stream, in place of
+	// the server's WriteTimeout, which a stream outlasts.
+	eventWriteTimeout = 15 * time.Second
+	eventBatchSize    = 100
+)
+
+type connContextKey struct{}
+
+// ConnContext keeps each request's connection in its context, so that event
+// streams can stay open past the server's ReadTimeout and WriteTimeout. It's
+// meant for http.Server.ConnContext; without it, streams are cut off when
+// those run out, and EventSource reconnects.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// eventStream writes Server-Sent Events, flushing each write out to the
+// client.
+type eventStream struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	// conn, when known, has its write deadline pushed back before each
+	// write.
+	conn net.Conn
+}
+
+func (stream *eventStream) send(format string, args ...interface{}) error {
+	if stream.conn != nil {
+		err := stream.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(stream.writer, format, args...)
+	if err != nil {
+		return err
+	}
+	stream.flusher.Flush()
+	return nil
+}
+
+func (stream *eventStream) sendEvent(event *db.ChangeEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stream.send("id: %s\nevent: %s\ndata: %s\n\n", event.EventID, event.Type, data)
+}
+
+// streamEvents streams the user's change events as Server-Sent Events, named
+// for their type and with their id, for EventSource. The stream starts with
+// the events after the one in the Last-Event-ID header, which EventSource
+// sends when it reconnects, or else with the next one. Events are only kept
+// for so long; when the ones after Last-Event-ID are gone, the stream starts
+// with a reset event instead, after which whatever the client has is out of
+// date. Comments are sent while there are no events, to keep the connection
+// from looking idle.
+func (s *server) streamEvents(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		renderError(writer, fmt.Errorf("event streams aren't supported by %T", writer))
+		return
+	}
+
+	var after db.RowID
+	resume := request.Header.Get(lastEventIDHeader)
+	if resume != "" {
+		var err error
+		after, err = db.ParseRowID(resume)
+		if err != nil {
+			renderError(writer, &statusError{Status: 400, Code: "invalid_request", Message: lastEventIDHeader + " must be the id of an event"})
+			return
+		}
+	}
+
+	oldest, newest, err := s.store.ChangeEventRange(ctx)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	stream := &eventStream{writer: writer, flusher: flusher}
+	if conn, ok := ctx.Value(connContextKey{}).(net.Conn); ok && request.ProtoMajor == 1 {
+		// the server would otherwise cancel the request once its
+		// ReadTimeout runs out
+		err = conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			renderError(writer, err)
+			return
+		}
+		stream.conn = conn
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(200)
+
+	switch {
+	case resume != "" && (after > newest || after+1 < oldest):
+		after = newest
+		err = stream.send("id: %s\nevent: reset\ndata: {}\n\n", after)
+	case resume == "":
+		// an id alone sets EventSource's Last-Event-ID without an event,
+		// so that it resumes from here if it reconnects before one
+		after = newest
+		err = stream.send("id: %s\n\n", after)
+	}
+	if err != nil {
+		return
+	}
+
+	poll := time.NewTicker(s.options.EventPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(s.options.EventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		events, err := s.store.ListChangeEvents(ctx, user.UserID, after, eventBatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("%s %s: %v", request.Method, request.URL.Path, err)
+			}
+			return
+		}
+		for _, event := range events {
+			err = stream.sendEvent(event)
+			if err != nil {
+				return
+			}
+			after = event.EventID
+		}
+		if len(events) == eventBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			err = stream.send(": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		case <-poll.C:
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"net/http"
+)
+
+// queriesOnlyOnGet refuses GraphQL documents sent in a GET's query string
+// that could change anything. The handler runs whatever it's sent however
+// it's sent, but GETs aren't CSRF protected, so a link would otherwise be
+// enough to make a mutation with a visitor's cookie. Documents that don't
+// parse are let through for the handler to report.
+func queriesOnlyOnGet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if !isSafeMethod(r.Method) || query == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		document, err := parser.Parse(parser.ParseParams{Source: query})
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, definition := range document.Definitions {
+			operation, ok := definition.(*ast.OperationDefinition)
+			if ok && operation.Operation != ast.OperationTypeQuery {
+				w.Header().Set("Allow", "POST")
+				renderError(w, &statusError{Status: 405, Code: "method_not_allowed", Message: operation.Operation + "s must be sent with POST"})
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
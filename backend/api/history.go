@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+// ownedVehicle loads one of the user's vehicles, in or out of the trash.
+func ownedVehicle(ctx context.Context, tx db.Tx, user *auth.ClaimsUser, vehicleId db.RowID) (*db.Vehicle, error) {
+	vehicle, err := tx.GetVehicle(ctx, vehicleId)
+	if errors.Is(err, db.ErrNotFound) {
+		vehicle, err = tx.GetDeletedVehicle(ctx, vehicleId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if vehicle.UserID != user.UserID {
+		return nil, &db.VehicleNotFoundError{VehicleID: vehicleId}
+	}
+
+	return vehicle, nil
+}
+
+// revisionSortKeys are the orders a vehicle's history can be listed in.
+// Revisions are numbered as they're made, so they're in time order by id.
+var revisionSortKeys = []db.SortKey{
+	{Name: "created_at"},
+}
+
+func (s *server) listVehicleHistory(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	vehicleId, err := db.ParseRowID(mux.Vars(request)["vehicleId"])
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	_, err = ownedVehicle(request.Context(), s.store, user, vehicleId)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	revisions, err := s.store.ListVehicleRevisions(request.Context(), vehicleId)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	indexes, next, err := pageOf(request, len(revisions), revisionSortKeys, "-created_at", func(idx int, key string) (interface{}, db.RowID) {
+		return nil, revisions[idx].RevisionID
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	page := make([]*db.VehicleRevision, 0, len(indexes))
+	for _, idx := range indexes {
+		page = append(page, revisions[idx])
+	}
+	renderList(writer, request, page, next)
+}
+
+// revertVehicleRevision undoes a single update, leaving later changes to
+// other fields alone. Reverting a field that has changed again since is a
+// conflict, as is reverting a vehicle that isn't the version If-Match names.
+func (s *server) revertVehicleRevision(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	vars := mux.Vars(request)
+	vehicleId, err := db.ParseRowID(vars["vehicleId"])
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+	revisionId, err := db.ParseRowID(vars["revisionId"])
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	var vehicle *db.Vehicle
+	err = s.store.InTx(ctx, func(tx db.Tx) error {
+		previous, err := ownedVehicle(ctx, tx, user, vehicleId)
+		if err != nil {
+			return err
+		}
+
+		version, err := matchVersion(request.Header.Get("If-Match"), previous.Version)
+		if err != nil {
+			return err
+		}
+
+		revision, err := tx.GetVehicleRevision(ctx, revisionId)
+		if err != nil {
+			return err
+		}
+		if revision.VehicleID != vehicleId {
+			return &db.RevisionNotFoundError{RevisionID: revisionId}
+		}
+
+		vehicle, err = tx.RevertVehicleRevision(ctx, revisionId, version)
+		return err
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	setETag(writer, vehicle.Version)
+	renderJson(writer, vehicle)
+}
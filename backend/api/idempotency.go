@@ -0,0 +1,197 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencyStoreTimeout  = 5 * time.Second
+
+	// idempotencyLease is how long a request holds its key before it's
+	// taken to have died with its server and a retry may go ahead: longer
+	// than the server's 15 second write timeout plus keeping the response,
+	// which any request that is still going would have outlived.
+	idempotencyLease = time.Minute
+)
+
+// replayedHeaders are the response headers kept with an idempotent response.
+// Cookies aren't: a retry is answered with what the request created, not
+// with another session.
+var replayedHeaders = []string{"Content-Type", "ETag", "Location", "Link"}
+
+// idempotent answers a retry of a create request that has an Idempotency-Key
+// header with the response to the first try, rather than creating the
+// record again, for window after the first try. A key may only be used for
+// one request: reusing it with a different body is a mistake, answered with
+// 422. Keys belong to the user who sent them, so only requests made with a
+// session are answered this way. Creating an account isn't one: the body is
+// a password, and the answer logs in, which a replay can't.
+//
+// Responses to requests that failed on the server's end, or weren't let
+// through at all, aren't kept, so that those can be retried for real. A
+// retry while the first try is still running is answered with 409, until
+// idempotencyLease has passed; a server that died mid-request doesn't tie
+// the key up for the whole window.
+func (s *server) idempotent(window time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			op, ok := currentOperation(r)
+			user := auth.FromContext(r.Context())
+			if key == "" || !ok || !op.Idempotent || window <= 0 || user == nil {
+				// without a session, the request is refused; nothing to keep
+				next.ServeHTTP(w, r)
+				return
+			}
+			userID := user.UserID
+
+			if !validIdempotencyKey(key) {
+				renderError(w, &statusError{
+					Status:  400,
+					Code:    "invalid_request",
+					Message: fmt.Sprintf("%s must be 1 to %d printable ASCII characters", idempotencyKeyHeader, maxIdempotencyKeyLength),
+				})
+				return
+			}
+
+			body, err := readBody(r)
+			if err != nil {
+				renderError(w, err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			fingerprint := requestFingerprint(r, body)
+			existing, err := s.store.ReserveIdempotencyKey(r.Context(), userID, key, fingerprint, time.Now().Add(-window), time.Now().Add(-idempotencyLease))
+			if err != nil {
+				renderError(w, err)
+				return
+			}
+			if existing != nil {
+				replayIdempotentResponse(w, existing, fingerprint)
+				return
+			}
+
+			saved := false
+			defer func() {
+				if !saved {
+					ctx, cancel := idempotencyContext()
+					defer cancel()
+					err := s.store.ReleaseIdempotencyKey(ctx, userID, key)
+					if err != nil {
+						log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+					}
+				}
+			}()
+
+			recorder := &responseRecorder{ResponseWriter: w, status: 200}
+			next.ServeHTTP(recorder, r)
+
+			if keepIdempotentResponse(recorder.status) {
+				response := &db.IdempotentResponse{
+					Status: recorder.status,
+					Header: make(map[string]string),
+					Body:   recorder.body.Bytes(),
+				}
+				for _, name := range replayedHeaders {
+					if value := w.Header().Get(name); value != "" {
+						response.Header[name] = value
+					}
+				}
+				if recorder.contentType != "" {
+					response.Header["Content-Type"] = recorder.contentType
+				}
+
+				ctx, cancel := idempotencyContext()
+				err := s.store.SaveIdempotentResponse(ctx, userID, key, response)
+				cancel()
+				if err != nil {
+					log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+				} else {
+					saved = true
+				}
+			}
+
+			w.WriteHeader(recorder.status)
+			_, _ = w.Write(recorder.body.Bytes())
+		})
+	}
+}
+
+// idempotencyContext is for keeping a response or releasing its key, which
+// has to happen even if the client has gone away by then.
+func idempotencyContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for _, c := range []byte(key) {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFingerprint identifies a request by what it asks for, so that a
+// key can't be reused for something else.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// keepIdempotentResponse reports whether a response is the outcome of the
+// request, rather than of when or how it was sent.
+func keepIdempotentResponse(status int) bool {
+	switch {
+	case status >= 500:
+		return false
+	case status == http.StatusUnauthorized, status == http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, existing *db.IdempotentResponse, fingerprint string) {
+	if existing.Fingerprint != fingerprint {
+		renderError(w, &statusError{
+			Status:  422,
+			Code:    "idempotency_key_reused",
+			Message: "the " + idempotencyKeyHeader + " was used for a different request",
+		})
+		return
+	}
+	if existing.Status == 0 {
+		renderError(w, &statusError{
+			Status:  409,
+			Code:    "idempotency_key_in_use",
+			Message: "the first request with this " + idempotencyKeyHeader + " hasn't finished yet; retry later",
+		})
+		return
+	}
+
+	for name, value := range existing.Header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(existing.Status)
+	_, _ = w.Write(existing.Body)
+}
@@ -0,0 +1,529 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"vehicledb/db"
+)
+
+// operation documents one method of one route in the OpenAPI description.
+// Request bodies are described by the same schemas the handlers validate
+// them with, and responses by the models they render.
+type operation struct {
+	ID      string
+	Summary string
+	// Public operations don't need a session.
+	Public bool
+	// Request is the JSON schema of the request body, if there is one.
+	Request string
+	// Response is a value of the type rendered on success, or nil when
+	// the response has no body.
+	Response interface{}
+	// List responses are pages of Response in the ListResponse envelope.
+	List bool
+	// Status is the status on success, 200 unless it's set.
+	Status int
+	// Conditional operations take If-Match, or If-None-Match for GET.
+	Conditional bool
+	// Patch operations take a JSON patch as well as a merge patch, which
+	// Request describes.
+	Patch bool
+	// Idempotent operations take an Idempotency-Key, and answer retries
+	// with it with the first response.
+	Idempotent bool
+	Query      []parameter
+}
+
+type parameter struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// listParameters are the query parameters of every list endpoint.
+func listParameters(sortKeys ...string) []parameter {
+	return []parameter{
+		{Name: "sort", Type: "string", Description: "one of " + strings.Join(sortKeys, ", ") + "; prefix with - to sort descending"},
+		{Name: "cursor", Type: "string", Description: "the next_cursor of the previous page"},
+		{Name: "limit", Type: "integer", Description: fmt.Sprintf("at most %d, %d by default", maxPageSize, defaultPageSize)},
+	}
+}
+
+var vehicleListParameters = append(listParameters("id", "year", "make", "model"),
+	parameter{Name: "year_from", Type: "integer", Description: "only vehicles from this year on"},
+	parameter{Name: "year_to", Type: "integer", Description: "only vehicles up to this year"},
+	parameter{Name: "make", Type: "string", Description: "only vehicles of this make, ignoring case"},
+)
+
+// operations are keyed by method and path template, as routes are
+// registered in NewHandler.
+var operations = map[string]operation{
+	"GET /v1/openapi.json": {ID: "getOpenAPI", Summary: "This description of the API", Public: true, Response: map[string]interface{}{}},
+	"GET /v1/docs":         {ID: "getDocs", Summary: "A page for reading this description of the API", Public: true},
+
+	"POST /v1/users/":  {ID: "createUser", Summary: "Create an account and log in to it", Public: true, Request: createUserSchema, Response: db.User{}},
+	"GET /v1/users/me": {ID: "getUser", Summary: "Your account", Response: db.User{}, Conditional: true},
+	"PATCH /v1/users/me": {
+		ID: "updateUser", Summary: "Change your email address", Request: updateUserSchema, Response: db.User{}, Conditional: true, Patch: true,
+	},
+	"DELETE /v1/users/me": {ID: "deleteUser", Summary: "Move your account to the trash", Response: db.User{}, Conditional: true},
+	"GET /v1/users/me/security-events": {
+		ID: "listMySecurityEvents", Summary: "The security log of your account", Response: db.SecurityEvent{}, List: true,
+		Query: listParameters("created_at"),
+	},
+
+	"GET /v1/session":    {ID: "getSession", Summary: "The session of the auth cookie", Public: true, Response: SessionResponse{}},
+	"POST /v1/session":   {ID: "login", Summary: "Log in", Public: true, Request: loginSchema, Response: db.User{}},
+	"DELETE /v1/session": {ID: "logout", Summary: "Log out", Public: true, Status: 204},
+
+	"GET /v1/vehicles/": {
+		ID: "listVehicles", Summary: "Your vehicles", Response: db.Vehicle{}, List: true, Query: vehicleListParameters,
+	},
+	"POST /v1/vehicles/": {ID: "createVehicle", Summary: "Add a vehicle", Request: createVehicleSchema, Response: db.Vehicle{}, Idempotent: true},
+	"POST /v1/vehicles/bulk": {
+		ID: "bulkCreateVehicles", Summary: "Add many vehicles, all at once or each on its own", Request: bulkCreateVehiclesSchema, Response: BatchResponse{},
+		Idempotent: true,
+	},
+	"PATCH /v1/vehicles/bulk": {
+		ID: "bulkUpdateVehicles", Summary: "Change many vehicles, all at once or each on its own", Request: bulkUpdateVehiclesSchema, Response: BatchResponse{},
+	},
+	"GET /v1/vehicles/{vehicleId}": {
+		ID: "getVehicle", Summary: "One of your vehicles", Response: db.Vehicle{}, Conditional: true,
+	},
+	"PATCH /v1/vehicles/{vehicleId}": {
+		ID: "updateVehicle", Summary: "Change a vehicle", Request: updateVehicleSchema, Response: db.Vehicle{}, Conditional: true, Patch: true,
+	},
+	"DELETE /v1/vehicles/{vehicleId}": {
+		ID: "deleteVehicle", Summary: "Move a vehicle to the trash", Response: db.Vehicle{}, Conditional: true,
+	},
+	"GET /v1/vehicles/{vehicleId}/history": {
+		ID: "listVehicleHistory", Summary: "The changes made to a vehicle", Response: db.VehicleRevision{}, List: true,
+		Query: listParameters("created_at"),
+	},
+	"POST /v1/vehicles/{vehicleId}/history/{revisionId}/revert": {
+		ID: "revertVehicleRevision", Summary: "Undo one change to a vehicle", Response: db.Vehicle{}, Conditional: true,
+	},
+
+	"POST /v1/batch": {
+		ID: "batch", Summary: "Create, change and delete vehicles, all at once or each on its own", Request: batchSchema, Response: BatchResponse{},
+		Idempotent: true,
+	},
+
+	"GET /v1/webhooks/": {ID: "listWebhooks", Summary: "Your webhooks", Response: db.Webhook{}, List: true},
+	"POST /v1/webhooks/": {
+		ID: "createWebhook", Summary: "Have events posted to a URL; the response has the secret they're signed with, which isn't shown again",
+		Request: createWebhookSchema, Response: db.Webhook{}, Idempotent: true,
+	},
+	"GET /v1/webhooks/{webhookId}":    {ID: "getWebhook", Summary: "One of your webhooks", Response: db.Webhook{}},
+	"DELETE /v1/webhooks/{webhookId}": {ID: "deleteWebhook", Summary: "Stop posting events to a webhook", Status: 204},
+	"GET /v1/webhooks/{webhookId}/deliveries": {
+		ID: "listWebhookDeliveries", Summary: "The events posted to a webhook, and how that went", Response: db.WebhookDelivery{}, List: true,
+		Query: listParameters("created_at"),
+	},
+	"POST /v1/webhooks/{webhookId}/ping": {
+		ID: "pingWebhook", Summary: "Post a webhook.ping event to a webhook, to try it out", Response: db.WebhookDelivery{},
+	},
+
+	"GET /v1/search": {
+		ID: "search", Summary: "Search your records, best match first", Response: db.SearchResult{}, List: true,
+		Query: []parameter{
+			{Name: "q", Type: "string", Description: "the words to look for; each matches as a prefix"},
+			{Name: "limit", Type: "integer", Description: fmt.Sprintf("at most %d, %d by default", maxSearchLimit, defaultSearchLimit)},
+		},
+	},
+
+	"GET /v1/trash": {
+		ID: "listTrash", Summary: "Your deleted vehicles", Response: db.Vehicle{}, List: true,
+		Query: listParameters("deleted_at", "year", "make", "model"),
+	},
+	"DELETE /v1/trash/vehicles/{vehicleId}": {ID: "purgeVehicle", Summary: "Erase a deleted vehicle for good", Status: 204},
+	"POST /v1/trash/vehicles/{vehicleId}/restore": {
+		ID: "restoreVehicle", Summary: "Take a vehicle out of the trash", Response: db.Vehicle{},
+	},
+
+	"GET /v1/security-events": {
+		ID: "listAllSecurityEvents", Summary: "The whole security log (admins only)", Response: db.SecurityEvent{}, List: true,
+		Query: listParameters("created_at"),
+	},
+	"GET /v1/admin/trash/users": {
+		ID: "listDeletedUsers", Summary: "Deleted accounts (admins only)", Response: db.User{}, List: true,
+		Query: listParameters("deleted_at", "email_address"),
+	},
+	"DELETE /v1/admin/users/{userId}": {ID: "purgeUser", Summary: "Erase an account for good (admins only)", Status: 204},
+	"POST /v1/admin/users/{userId}/restore": {
+		ID: "restoreUser", Summary: "Take an account out of the trash (admins only)", Response: db.User{},
+	},
+	"GET /v1/admin/backups": {
+		ID: "listBackups", Summary: "The database backups (admins only)", Response: db.BackupInfo{}, List: true,
+		Query: listParameters("created_at"),
+	},
+	"POST /v1/admin/backups": {
+		ID: "createBackup", Summary: "Back up the database now (admins only)", Response: db.BackupInfo{}, Status: 201,
+		Idempotent: true,
+	},
+}
+
+// undocumented are the routes left out of the description: GraphQL has
+// its own schema, the event stream isn't JSON and can't be recorded to be
+// validated, Redoc is part of the docs page, and the rest aren't
+// implemented yet.
+var undocumented = map[string]bool{
+	redocScriptPath:                      true,
+	"/v1/graphql":                        true,
+	"/v1/events":                         true,
+	"/v1/tokens/":                        true,
+	"/v1/tokens/{tokenId}":               true,
+	"/v1/vehicles/{vehicleId}/schedule/": true,
+	"/v1/vehicles/{vehicleId}/schedule/{scheduleItemId}": true,
+	"/v1/vehicles/{vehicleId}/schedule.rss":              true,
+}
+
+var pathParameterPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// openAPIDocument describes every route registered on router, as OpenAPI
+// 3.1. It fails if a route isn't documented, so that the description can't
+// fall behind the routes.
+func openAPIDocument(router *mux.Router) (map[string]interface{}, error) {
+	builder := &openAPIBuilder{schemas: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || undocumented[path] {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return fmt.Errorf("route %s has no methods to document", path)
+		}
+
+		for _, method := range methods {
+			op, ok := operations[method+" "+path]
+			if !ok {
+				return fmt.Errorf("%s %s isn't documented", method, path)
+			}
+
+			if paths[path] == nil {
+				paths[path] = make(map[string]interface{})
+			}
+			paths[path][strings.ToLower(method)], err = builder.operation(method, path, op)
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", method, path, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "vehicledb",
+			"version": "1",
+		},
+		"paths": paths,
+		"security": []interface{}{
+			map[string]interface{}{"cookieAuth": []string{}},
+			map[string]interface{}{"bearerAuth": []string{}},
+		},
+		"components": map[string]interface{}{
+			"schemas": builder.schemas,
+			"responses": map[string]interface{}{
+				"Problem": map[string]interface{}{
+					"description": "An error, as RFC 7807 problem details; branch on code",
+					"content": map[string]interface{}{
+						problemContentType: map[string]interface{}{"schema": problemSchema},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"cookieAuth": map[string]interface{}{
+					"type": "apiKey", "in": "cookie", "name": authCookieName,
+					"description": "the session cookie; requests that change anything must echo the CSRF token in " + csrfHeaderName,
+				},
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}, nil
+}
+
+var problemSchema = map[string]interface{}{
+	"type":     "object",
+	"required": []string{"type", "title", "status", "code"},
+	"properties": map[string]interface{}{
+		"type":       map[string]interface{}{"type": "string"},
+		"title":      map[string]interface{}{"type": "string"},
+		"status":     map[string]interface{}{"type": "integer"},
+		"detail":     map[string]interface{}{"type": "string"},
+		"code":       map[string]interface{}{"type": "string", "enum": problemCodes()},
+		"request_id": map[string]interface{}{"type": "string"},
+		"errors": map[string]interface{}{
+			"type": "array",
+			"items": map[string]interface{}{
+				"type":     "object",
+				"required": []string{"pointer", "code", "message"},
+				"properties": map[string]interface{}{
+					"pointer": map[string]interface{}{"type": "string"},
+					"code":    map[string]interface{}{"type": "string"},
+					"message": map[string]interface{}{"type": "string"},
+					"details": map[string]interface{}{"type": "object"},
+				},
+			},
+		},
+	},
+}
+
+func problemCodes() []string {
+	codes := make([]string, 0, len(problemTitles))
+	for code := range problemTitles {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// openAPIBuilder collects the schemas of the models operations refer to.
+type openAPIBuilder struct {
+	schemas map[string]interface{}
+}
+
+func (b *openAPIBuilder) operation(method string, path string, op operation) (map[string]interface{}, error) {
+	doc := map[string]interface{}{
+		"operationId": op.ID,
+		"summary":     op.Summary,
+	}
+	if op.Public {
+		doc["security"] = []interface{}{}
+	}
+
+	parameters := make([]interface{}, 0)
+	for _, match := range pathParameterPattern.FindAllStringSubmatch(path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, param := range op.Query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": param.Name, "in": "query", "description": param.Description, "schema": map[string]interface{}{"type": param.Type},
+		})
+	}
+	if op.Conditional {
+		header := "If-Match"
+		if method == "GET" {
+			header = "If-None-Match"
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name": header, "in": "header", "description": "the ETag of the version you have", "schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if op.Idempotent {
+		parameters = append(parameters, map[string]interface{}{
+			"name": idempotencyKeyHeader, "in": "header",
+			"description": "a key unique to this request, to retry it with safely; retries get the first response, with " + idempotentReplayedHeader + ": true",
+			"schema":      map[string]interface{}{"type": "string", "maxLength": maxIdempotencyKeyLength},
+		})
+	}
+	if len(parameters) > 0 {
+		doc["parameters"] = parameters
+	}
+
+	if op.Request != "" {
+		var schema map[string]interface{}
+		err := json.Unmarshal([]byte(op.Request), &schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request schema: %v", err)
+		}
+		content := map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+		if op.Patch {
+			var patchSchema map[string]interface{}
+			err = json.Unmarshal([]byte(jsonPatchSchema), &patchSchema)
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSON patch schema: %v", err)
+			}
+			content[mergePatchContentType] = map[string]interface{}{"schema": schema}
+			content[jsonPatchContentType] = map[string]interface{}{"schema": patchSchema}
+		}
+		doc["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  content,
+		}
+	}
+
+	status := op.status()
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil {
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": b.responseSchema(op)}}
+	}
+
+	doc["responses"] = map[string]interface{}{
+		fmt.Sprint(status): success,
+		"default":          map[string]interface{}{"$ref": "#/components/responses/Problem"},
+	}
+	return doc, nil
+}
+
+// status is the status of the operation's successful responses.
+func (op operation) status() int {
+	if op.Status == 0 {
+		return 200
+	}
+	return op.Status
+}
+
+// responseSchema describes the body of the operation's successful response.
+func (b *openAPIBuilder) responseSchema(op operation) map[string]interface{} {
+	schema := b.schema(reflect.TypeOf(op.Response))
+	if op.List {
+		schema = map[string]interface{}{
+			"type":     "object",
+			"required": []string{"items"},
+			"properties": map[string]interface{}{
+				"items":       map[string]interface{}{"type": "array", "items": schema},
+				"next_cursor": map[string]interface{}{"type": "string"},
+			},
+		}
+	}
+	return schema
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	problemType    = reflect.TypeOf(Problem{})
+)
+
+// schema describes how a Go type is rendered as JSON. Named structs are
+// added to the components and referred to.
+func (b *openAPIBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == problemType:
+		// problems marshal themselves, with the members of problemSchema
+		b.schemas["Problem"] = problemSchema
+		return map[string]interface{}{"$ref": "#/components/schemas/Problem"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(b.schema(t.Elem()))
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// added before its fields, so that a struct can refer to itself
+			b.schemas[t.Name()] = nil
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+func (b *openAPIBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		tag := field.Tag.Get("json")
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+
+		name := field.Name
+		options := strings.Split(tag, ",")
+		if options[0] != "" {
+			name = options[0]
+		}
+
+		properties[name] = b.schema(field.Type)
+		omitEmpty := false
+		for _, option := range options[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+		}
+		if !omitEmpty {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+// nullable allows null as well as what schema allows.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	if kind, ok := schema["type"].(string); ok {
+		copied := make(map[string]interface{}, len(schema))
+		for k, v := range schema {
+			copied[k] = v
+		}
+		copied["type"] = []string{kind, "null"}
+		return copied
+	}
+	return map[string]interface{}{"oneOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+}
+
+// redocScriptPath is where Options.RedocScript is served. Go 1.14 can't
+// embed files in the binary, and loading Redoc from a CDN would run whatever
+// the CDN serves on our origin, so a copy is served from disk instead.
+const redocScriptPath = "/v1/docs/redoc.standalone.js"
+
+// docsPage shows the description with Redoc, when there's a copy to serve.
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>vehicledb API</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+	<redoc spec-url="/v1/openapi.json"></redoc>
+	<script src="` + redocScriptPath + `"></script>
+</body>
+</html>
+`
+
+// plainDocsPage links to the description, for servers without Redoc.
+const plainDocsPage = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>vehicledb API</title>
+</head>
+<body>
+	<p>The API is described at <a href="/v1/openapi.json">/v1/openapi.json</a>.</p>
+</body>
+</html>
+`
+
+func (s *server) serveDocs(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if s.options.RedocScript == "" {
+		fmt.Fprint(writer, plainDocsPage)
+		return
+	}
+	fmt.Fprint(writer, docsPage)
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"vehicledb/db"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// ListResponse is the envelope every list endpoint answers with. When there
+// are more items, NextCursor fetches them, as does the "next" Link header.
+type ListResponse struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// listOptions reads the ?sort=, ?cursor= and ?limit= of a list request.
+// sort is a sort key, prefixed with "-" to sort descending; defaultSort is
+// used without one. A cursor carries the order it was taken in, so later
+// pages don't need to repeat ?sort=.
+func listOptions(request *http.Request, defaultSort string) (db.ListOptions, error) {
+	query := request.URL.Query()
+	options := db.ListOptions{Limit: defaultPageSize}
+
+	sort := query.Get("sort")
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := db.ParseCursor(value)
+		if err != nil {
+			return options, err
+		}
+		options.After = cursor
+
+		if sort == "" {
+			options.Sort, options.Desc = cursor.Sort, cursor.Desc
+		}
+	}
+	if sort == "" && options.After == nil {
+		sort = defaultSort
+	}
+	if sort != "" {
+		options.Sort = strings.TrimPrefix(sort, "-")
+		options.Desc = strings.HasPrefix(sort, "-")
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return options, invalidField("limit", "out_of_range", "limit must be between 1 and %d", maxPageSize)
+		}
+		options.Limit = limit
+	}
+
+	return options, nil
+}
+
+// renderList renders a page of items in the list envelope, with a Link
+// header to the next page when there is one.
+func renderList(writer http.ResponseWriter, request *http.Request, items interface{}, next *db.Cursor) {
+	response := ListResponse{Items: items}
+	if next != nil {
+		response.NextCursor = next.Encode()
+		writer.Header().Set("Link", `<`+pageURL(request, response.NextCursor)+`>; rel="next"`)
+	}
+
+	renderJson(writer, response)
+}
+
+// pageURL is the request's URL with its cursor replaced. It's relative to
+// the host, so that it works behind a proxy.
+func pageURL(request *http.Request, cursor string) string {
+	query := request.URL.Query()
+	query.Set("cursor", cursor)
+	return request.URL.Path + "?" + query.Encode()
+}
+
+// pageOf cuts a page out of a list the store returns whole. item gives the
+// value for a sort key and the id of each of count items; see db.Page.
+func pageOf(request *http.Request, count int, keys []db.SortKey, defaultSort string, item func(idx int, key string) (interface{}, db.RowID)) ([]int, *db.Cursor, error) {
+	options, err := listOptions(request, defaultSort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.Page(count, keys, options, item)
+}
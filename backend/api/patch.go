@@ -0,0 +1,389 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"vehicledb/db"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// acceptPatch lists the kinds of PATCH body every PATCH endpoint takes, for
+// the Accept-Patch header. Plain JSON is taken as a merge patch.
+var acceptPatch = strings.Join([]string{mergePatchContentType, jsonPatchContentType, "application/json"}, ", ")
+
+// patch changes the JSON document of a resource. A PATCH is applied to the
+// document of the resource as it is, and the result replaces it if it's
+// valid, so that what a field being absent, null or given means is the same
+// for every resource and kind of patch: absent fields are left alone, null
+// removes a field, which a required field can't be, and a value sets it.
+type patch interface {
+	apply(document interface{}) (interface{}, error)
+}
+
+// mergePatch is an RFC 7396 JSON merge patch.
+type mergePatch map[string]interface{}
+
+func (p mergePatch) apply(document interface{}) (interface{}, error) {
+	return mergeValue(document, map[string]interface{}(p)), nil
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergeValue(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// jsonPatch is an RFC 6902 JSON patch.
+type jsonPatch []jsonPatchOperation
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+var jsonPatchSchema = `{
+  "type": "array",
+  "items": {
+    "type": "object",
+    "properties": {
+      "op": {"enum": ["add", "remove", "replace", "move", "copy", "test"]},
+      "path": {"type": "string"},
+      "from": {"type": "string"},
+      "value": {}
+    },
+    "required": ["op", "path"]
+  }
+}`
+
+func (p jsonPatch) apply(document interface{}) (interface{}, error) {
+	for idx, op := range p {
+		var err error
+		document, err = op.apply(document)
+		if invalid, ok := err.(*InvalidRequestError); ok {
+			// point into the patch, at the operation
+			for field := range invalid.Fields {
+				invalid.Fields[field].Pointer = fmt.Sprintf("/%d%s", idx, invalid.Fields[field].Pointer)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", idx, err)
+		}
+	}
+	return document, nil
+}
+
+func (op jsonPatchOperation) apply(document interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path, "path")
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, invalidField("/value", "required", "%s needs a value", op.Op)
+		}
+		err = json.Unmarshal(op.Value, &value)
+		if err != nil {
+			return nil, invalidField("/value", "invalid_json", "%v", err)
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From, "from")
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, invalidField("/from", "invalid_value", "can't move %s into itself", op.From)
+		}
+
+		value, err = getPointer(document, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			document, err = removePointer(document, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = copyValue(value)
+		}
+	}
+
+	switch op.Op {
+	case "test":
+		current, err := getPointer(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, db.NewError(db.ErrConflict, fmt.Sprintf("test failed: %s isn't the given value", op.Path))
+		}
+		return document, nil
+	case "remove":
+		return removePointer(document, path)
+	case "replace":
+		document, err = removePointer(document, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return addPointer(document, path, value)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its reference tokens.
+// field is the member of the operation it came from, for errors.
+func parsePointer(pointer string, field string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, invalidField("/"+field, "invalid_pointer", "%q isn't a JSON pointer", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for idx, token := range tokens {
+		tokens[idx] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func missingPointer(tokens []string) error {
+	return db.NewError(db.ErrConflict, fmt.Sprintf("there's nothing at /%s", strings.Join(tokens, "/")))
+}
+
+// arrayIndex is the index a token names in an array of length n. The end,
+// "-", is only an index to add at.
+func arrayIndex(token string, n int, adding bool) (int, bool) {
+	if adding && token == "-" {
+		return n, true
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, false
+	}
+	if idx > n || (idx == n && !adding) {
+		return 0, false
+	}
+	return idx, true
+}
+
+func getPointer(document interface{}, tokens []string) (interface{}, error) {
+	value := document
+	for idx, token := range tokens {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			child, ok := container[token]
+			if !ok {
+				return nil, missingPointer(tokens[:idx+1])
+			}
+			value = child
+		case []interface{}:
+			at, ok := arrayIndex(token, len(container), false)
+			if !ok {
+				return nil, missingPointer(tokens[:idx+1])
+			}
+			value = container[at]
+		default:
+			return nil, missingPointer(tokens[:idx+1])
+		}
+	}
+	return value, nil
+}
+
+// updatePointer returns document with change made to the container of the
+// last token. Arrays are copied as they're changed, so they're put back into
+// their own containers on the way out.
+func updatePointer(document interface{}, tokens []string, change func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return change(document, tokens[0])
+	}
+
+	child, err := getPointer(document, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := updatePointer(child, tokens[1:], change)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := document.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = updated
+	case []interface{}:
+		at, _ := arrayIndex(tokens[0], len(container), false)
+		container[at] = updated
+	}
+	return document, nil
+}
+
+func addPointer(document interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return updatePointer(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			at, ok := arrayIndex(token, len(container), true)
+			if !ok {
+				return nil, missingPointer(tokens)
+			}
+			added := make([]interface{}, 0, len(container)+1)
+			added = append(added, container[:at]...)
+			added = append(added, value)
+			return append(added, container[at:]...), nil
+		}
+		return nil, missingPointer(tokens)
+	})
+}
+
+func removePointer(document interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	return updatePointer(document, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			if _, ok := container[token]; !ok {
+				return nil, missingPointer(tokens)
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			at, ok := arrayIndex(token, len(container), false)
+			if !ok {
+				return nil, missingPointer(tokens)
+			}
+			removed := make([]interface{}, 0, len(container)-1)
+			removed = append(removed, container[:at]...)
+			return append(removed, container[at+1:]...), nil
+		}
+		return nil, missingPointer(tokens)
+	})
+}
+
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			copied[key] = copyValue(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for idx, child := range value {
+			copied[idx] = copyValue(child)
+		}
+		return copied
+	}
+	return value
+}
+
+// readPatch validates a PATCH body of the given content type: a merge patch
+// against the operation's request schema, or a JSON patch. The patched
+// document is validated when the patch is applied, by applyPatch.
+func (registry *schemaRegistry) readPatch(contentType string, body []byte, operationID string) (patch, error) {
+	mediaType := "application/json"
+	if contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, unsupportedPatch(contentType)
+		}
+	}
+
+	switch mediaType {
+	case "application/json", mergePatchContentType:
+		var p mergePatch
+		err := registry.decodeBody(body, operationID, &p)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+
+	case jsonPatchContentType:
+		var p jsonPatch
+		err := registry.decode(registry.jsonPatch, body, &p)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	return nil, unsupportedPatch(contentType)
+}
+
+func unsupportedPatch(contentType string) error {
+	return &statusError{Status: 415, Code: "unsupported_media_type", Message: fmt.Sprintf("a PATCH body can't be %s; use one of %s", contentType, acceptPatch)}
+}
+
+// readPatchRequest reads the body of a PATCH request as readPatch does.
+func (registry *schemaRegistry) readPatchRequest(writer http.ResponseWriter, request *http.Request, operationID string) (patch, error) {
+	writer.Header().Set("Accept-Patch", acceptPatch)
+
+	body, err := readBody(request)
+	if err != nil {
+		return nil, err
+	}
+	return registry.readPatch(request.Header.Get("Content-Type"), body, operationID)
+}
+
+// applyPatch patches the document of resource, validates the result against
+// the named document schema and decodes it into model.
+func (registry *schemaRegistry) applyPatch(p patch, resource interface{}, documentName string, model interface{}) error {
+	encoded, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	var document interface{}
+	err = json.Unmarshal(encoded, &document)
+	if err != nil {
+		return err
+	}
+
+	patched, err := p.apply(document)
+	if err != nil {
+		return err
+	}
+
+	encoded, err = json.Marshal(patched)
+	if err != nil {
+		return err
+	}
+	schema, ok := registry.documents[documentName]
+	if !ok {
+		return fmt.Errorf("no document schema for %s", documentName)
+	}
+	return registry.decode(schema, encoded, model)
+}
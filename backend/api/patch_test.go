@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"vehicledb/db"
+)
+
+func decodeJSON(t *testing.T, text string) interface{} {
+	var value interface{}
+	err := json.Unmarshal([]byte(text), &value)
+	if err != nil {
+		t.Fatalf("%s: %v", text, err)
+	}
+	return value
+}
+
+func TestMergePatch(t *testing.T) {
+	// from RFC 7396, appendix A
+	cases := []struct{ target, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, c := range cases {
+		var p mergePatch
+		err := json.Unmarshal([]byte(c.patch), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := p.apply(decodeJSON(t, c.target))
+		if err != nil {
+			t.Fatalf("%s + %s: %v", c.target, c.patch, err)
+		}
+		if !reflect.DeepEqual(result, decodeJSON(t, c.result)) {
+			t.Errorf("%s + %s: expected %s, got %v", c.target, c.patch, c.result, result)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	// mostly from RFC 6902, appendix A
+	cases := []struct{ document, patch, result string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{
+			`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"foo":"bar"}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":"bar","baz":"bar"}`},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":null}]`, `{"foo":"bar","baz":null}`},
+	}
+
+	for _, c := range cases {
+		var p jsonPatch
+		err := json.Unmarshal([]byte(c.patch), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := p.apply(decodeJSON(t, c.document))
+		if err != nil {
+			t.Fatalf("%s + %s: %v", c.document, c.patch, err)
+		}
+		if !reflect.DeepEqual(result, decodeJSON(t, c.result)) {
+			t.Errorf("%s + %s: expected %s, got %v", c.document, c.patch, c.result, result)
+		}
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	cases := map[string]error{
+		// a failed test, or a path that isn't there, conflicts with the
+		// document as it is
+		`[{"op":"test","path":"/baz","value":"bar"}]`:   db.ErrConflict,
+		`[{"op":"remove","path":"/nothing"}]`:           db.ErrConflict,
+		`[{"op":"add","path":"/foo/bar","value":1}]`:    db.ErrConflict,
+		`[{"op":"add","path":"baz","value":1}]`:         db.ErrInvalid,
+		`[{"op":"add","path":"/baz"}]`:                  db.ErrInvalid,
+		`[{"op":"move","from":"/foo","path":"/foo/x"}]`: db.ErrInvalid,
+	}
+
+	for text, kind := range cases {
+		var p jsonPatch
+		err := json.Unmarshal([]byte(text), &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = p.apply(decodeJSON(t, `{"foo":"bar","baz":"qux"}`))
+		if !errors.Is(err, kind) {
+			t.Errorf("%s: expected %v, got %v", text, kind, err)
+		}
+	}
+}
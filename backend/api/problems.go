@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xeipuuv/gojsonschema"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"vehicledb/db"
+)
+
+const problemContentType = "application/problem+json"
+
+// problemTypePrefix starts the type of every problem; the rest is its code.
+const problemTypePrefix = "urn:vehicledb:problem:"
+
+// problemTitles are the human titles for each error code. Codes are stable
+// and what clients should branch on; titles and details may change.
+var problemTitles = map[string]string{
+	"invalid_request":        "The request is invalid",
+	"unauthorized":           "Authentication is required",
+	"invalid_credentials":    "The email address or password is wrong",
+	"forbidden":              "You may not do this",
+	"csrf_token_invalid":     "The CSRF token is missing or wrong",
+	"not_found":              "Not found",
+	"method_not_allowed":     "Method not allowed",
+	"conflict":               "The request conflicts with the current state",
+	"payload_too_large":      "The request body is too large",
+	"unsupported_media_type": "The request body is of a kind that isn't supported here",
+	"precondition_failed":    "The record has changed",
+	"not_applied":            "Not applied because another operation failed",
+	"idempotency_key_reused": "The idempotency key was used for a different request",
+	"idempotency_key_in_use": "A request with the idempotency key is still running",
+	"rate_limited":           "Too many requests",
+	"server_error":           "Something went wrong on our end",
+	"unavailable":            "The request was cancelled",
+	"timeout":                "The request took too long",
+}
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// response. Details of the error, such as which fields conflicted, are
+// extension members alongside the standard ones.
+type Problem struct {
+	Type      string
+	Title     string
+	Status    int
+	Detail    string
+	Code      string
+	RequestID string
+	// Errors are the request's invalid fields, for invalid_request.
+	Errors  []FieldError
+	Details map[string]interface{}
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	body := make(map[string]interface{}, len(p.Details)+7)
+	for k, v := range p.Details {
+		body[k] = v
+	}
+
+	body["type"] = p.Type
+	body["title"] = p.Title
+	body["status"] = p.Status
+	body["code"] = p.Code
+	if p.Detail != "" {
+		body["detail"] = p.Detail
+	}
+	if p.RequestID != "" {
+		body["request_id"] = p.RequestID
+	}
+	if len(p.Errors) > 0 {
+		body["errors"] = p.Errors
+	}
+
+	return json.Marshal(body)
+}
+
+// FieldError is what's wrong with one field of a request. Pointer is the
+// field's JSON pointer in the body, or for query parameters, its name.
+type FieldError struct {
+	Pointer string                 `json:"pointer"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// InvalidRequestError is a request with fields that are wrong in ways its
+// schema doesn't catch, e.g. query parameters.
+type InvalidRequestError struct {
+	Fields []FieldError
+}
+
+// invalidField is an InvalidRequestError for a single field.
+func invalidField(pointer string, code string, format string, args ...interface{}) *InvalidRequestError {
+	return &InvalidRequestError{Fields: []FieldError{
+		{Pointer: pointer, Code: code, Message: fmt.Sprintf(format, args...)},
+	}}
+}
+
+func (err *InvalidRequestError) Error() string {
+	messages := make([]string, 0, len(err.Fields))
+	for _, field := range err.Fields {
+		messages = append(messages, field.Pointer+": "+field.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (err *InvalidRequestError) Is(target error) bool {
+	return target == db.ErrInvalid
+}
+
+func (err *ValidationError) Is(target error) bool {
+	return target == db.ErrInvalid
+}
+
+// fieldErrors turns a schema validation result into field errors. The
+// schema reports missing and unexpected properties against their parent,
+// so they're moved onto the property itself.
+func fieldErrors(result *gojsonschema.Result) []FieldError {
+	fields := make([]FieldError, 0, len(result.Errors()))
+	for _, resultError := range result.Errors() {
+		pointer := strings.TrimPrefix(resultError.Context().String("/"), "(root)")
+
+		details := map[string]interface{}(resultError.Details())
+		if property, ok := details["property"].(string); ok {
+			switch resultError.Type() {
+			case "required", "additional_property_not_allowed":
+				pointer += "/" + property
+			}
+		}
+		delete(details, "context")
+		delete(details, "field")
+		if len(details) == 0 {
+			details = nil
+		}
+
+		fields = append(fields, FieldError{
+			Pointer: pointer,
+			Code:    resultError.Type(),
+			Message: resultError.Description(),
+			Details: details,
+		})
+	}
+	return fields
+}
+
+// statusError is an error the API itself decides the status of, rather than
+// the store.
+type statusError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (err *statusError) Error() string {
+	return err.Message
+}
+
+// problemFor describes err for the client. Errors that aren't the client's
+// doing are logged and described only by their code.
+func problemFor(err error, requestID string) *Problem {
+	problem := &Problem{Code: "server_error", Status: 500, RequestID: requestID}
+
+	var status *statusError
+	var validation *ValidationError
+	var invalid *InvalidRequestError
+
+	switch {
+	case errors.As(err, &status):
+		problem.Status, problem.Code, problem.Detail = status.Status, status.Code, status.Message
+
+	case errors.As(err, &validation):
+		problem.Status, problem.Code = 400, "invalid_request"
+		problem.Detail = "the request body doesn't match its schema"
+		problem.Errors = fieldErrors(validation.Result)
+
+	case errors.As(err, &invalid):
+		problem.Status, problem.Code = 400, "invalid_request"
+		problem.Detail = invalid.Error()
+		problem.Errors = invalid.Fields
+
+	case errorStatuses[db.ErrorKind(err)] != 0:
+		problem.Status = errorStatuses[db.ErrorKind(err)]
+		problem.Code = db.ErrorCode(err)
+		problem.Detail = err.Error()
+
+		var detailed db.DetailedError
+		if errors.As(err, &detailed) {
+			problem.Details = detailed.Details()
+		}
+
+	// the database gave up, either because the query timeout passed or
+	// the client went away; neither is a bug in the server
+	case errors.Is(err, context.DeadlineExceeded):
+		problem.Status, problem.Code = 504, "timeout"
+	case errors.Is(err, context.Canceled):
+		problem.Status, problem.Code = 503, "unavailable"
+
+	default:
+		log.Printf("request %s failed: %v", requestID, err)
+	}
+
+	problem.Type = problemTypePrefix + problem.Code
+	problem.Title = problemTitles[problem.Code]
+	return problem
+}
+
+// renderProblem writes a problem as the response.
+func renderProblem(writer http.ResponseWriter, problem *Problem) {
+	writer.Header().Set("Content-Type", problemContentType)
+	writer.WriteHeader(problem.Status)
+	renderJson(writer, problem)
+}
+
+// renderError renders err as a problem. The request ID is read back from the
+// response headers, where RequestID put it.
+func renderError(writer http.ResponseWriter, err error) {
+	var rateLimited *db.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(rateLimited.RetryAfter.Seconds())))
+	}
+
+	renderProblem(writer, problemFor(err, writer.Header().Get(requestIDHeader)))
+}
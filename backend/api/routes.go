@@ -1,29 +1,90 @@
 package api
 
 import (
+	"fmt"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/handler"
 	"net/http"
+	"time"
+	"vehicledb/db"
 )
 
-func NewHandler(schema *graphql.Schema, allowedOrigins []string) http.Handler {
+// server holds the dependencies shared by the REST handlers.
+type server struct {
+	store   db.Store
+	cookies CookieOptions
+	backups *db.BackupSet
+	schemas *schemaRegistry
+	options Options
+}
+
+// Options tune how the API handles requests.
+type Options struct {
+	// MaxBodyBytes limits the size of request bodies; 0 for no limit.
+	MaxBodyBytes int64
+	// ValidateResponses checks every response against the API's
+	// description, for development and tests.
+	ValidateResponses bool
+	// IdempotencyWindow is how long the response to a create request with
+	// an Idempotency-Key is kept for retries; 0 ignores the header.
+	IdempotencyWindow time.Duration
+	// EventPollInterval is how often event streams check for new events.
+	EventPollInterval time.Duration
+	// EventHeartbeat is how often an event stream with nothing to send
+	// sends a comment instead, so that proxies don't close it as idle.
+	EventHeartbeat time.Duration
+	// RedocScript is the path to a copy of Redoc's redoc.standalone.js,
+	// served for the docs page to show the description with. Without one,
+	// the page only links to the description.
+	RedocScript string
+}
+
+var DefaultOptions = Options{
+	MaxBodyBytes:      1 << 20,
+	IdempotencyWindow: 24 * time.Hour,
+	EventPollInterval: time.Second,
+	EventHeartbeat:    15 * time.Second,
+}
+
+// NewHandler builds the API. backups may be nil, in which case the backup
+// endpoints aren't served. It panics if the API's schemas are invalid.
+func NewHandler(store db.Store, schema *graphql.Schema, allowedOrigins []string, cookies CookieOptions, backups *db.BackupSet, options Options) http.Handler {
+	schemas, err := compileSchemas(operations, options.ValidateResponses)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &server{
+		store:   store,
+		cookies: cookies,
+		backups: backups,
+		schemas: schemas,
+		options: options,
+	}
+
 	router := mux.NewRouter()
 
 	// user routes
 	AddMappedMethods(
 		router.Path("/v1/users/me"),
 		map[string]http.HandlerFunc{
-			"GET":    RequireAuth(getUser),
-			"PATCH":  RequireAuth(updateUser),
-			"DELETE": RequireAuth(deleteUser),
+			"GET":    RequireAuth(s.getUser),
+			"PATCH":  RequireAuth(s.updateUser),
+			"DELETE": RequireAuth(s.deleteUser),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/users/me/security-events"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.listMySecurityEvents),
 		})
 
 	AddMappedMethods(
 		router.Path("/v1/users/"),
 		map[string]http.HandlerFunc{
-			"POST": createUser,
+			"POST": s.createUser,
 		})
 
 	// api token routes
@@ -42,31 +103,153 @@ func NewHandler(schema *graphql.Schema, allowedOrigins []string) http.Handler {
 			"DELETE": deleteToken,
 		})
 
+	// admin routes
+	AddMappedMethods(
+		router.Path("/v1/security-events"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.listAllSecurityEvents),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/admin/trash/users"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.listDeletedUsers),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/admin/users/{userId}"),
+		map[string]http.HandlerFunc{
+			"DELETE": RequireAuth(s.purgeUser),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/admin/users/{userId}/restore"),
+		map[string]http.HandlerFunc{
+			"POST": RequireAuth(s.restoreUser),
+		})
+
+	if backups != nil {
+		AddMappedMethods(
+			router.Path("/v1/admin/backups"),
+			map[string]http.HandlerFunc{
+				"GET":  RequireAuth(s.listBackups),
+				"POST": RequireAuth(s.createBackup),
+			})
+	}
+
+	// trash routes
+	AddMappedMethods(
+		router.Path("/v1/trash"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.listTrash),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/trash/vehicles/{vehicleId}"),
+		map[string]http.HandlerFunc{
+			"DELETE": RequireAuth(s.purgeVehicle),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/trash/vehicles/{vehicleId}/restore"),
+		map[string]http.HandlerFunc{
+			"POST": RequireAuth(s.restoreVehicle),
+		})
+
 	// sessionsRoute routes
 	AddMappedMethods(
 		router.Path("/v1/session"),
 		map[string]http.HandlerFunc{
-			"GET":    validateSession,
-			"POST":   login,
-			"DELETE": logout,
+			"GET":    s.validateSession,
+			"POST":   s.login,
+			"DELETE": s.logout,
 		})
 
 	// vehicle routes
 	AddMappedMethods(
 		router.Path("/v1/vehicles/"),
 		map[string]http.HandlerFunc{
-			"GET":  RequireAuth(listVehicles),
-			"POST": RequireAuth(createVehicle),
+			"GET":  RequireAuth(s.listVehicles),
+			"POST": RequireAuth(s.createVehicle),
 		},
 	)
 
+	// registered before the vehicle route, which would take bulk for an id
+	AddMappedMethods(
+		router.Path("/v1/vehicles/bulk"),
+		map[string]http.HandlerFunc{
+			"POST":  RequireAuth(s.bulkCreateVehicles),
+			"PATCH": RequireAuth(s.bulkUpdateVehicles),
+		})
+
 	vehicleRoute := router.Path("/v1/vehicles/{vehicleId}")
 	AddMappedMethods(vehicleRoute, map[string]http.HandlerFunc{
-		"GET":    getVehicle,
-		"PATCH":  updateVehicle,
-		"DELETE": deleteVehicle,
+		"GET":    RequireAuth(s.getVehicle),
+		"PATCH":  RequireAuth(s.updateVehicle),
+		"DELETE": RequireAuth(s.deleteVehicle),
 	})
 
+	// batch routes
+	AddMappedMethods(
+		router.Path("/v1/batch"),
+		map[string]http.HandlerFunc{
+			"POST": RequireAuth(s.batch),
+		})
+
+	// webhook routes
+	AddMappedMethods(
+		router.Path("/v1/webhooks/"),
+		map[string]http.HandlerFunc{
+			"GET":  RequireAuth(s.listWebhooks),
+			"POST": RequireAuth(s.createWebhook),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/webhooks/{webhookId}"),
+		map[string]http.HandlerFunc{
+			"GET":    RequireAuth(s.getWebhook),
+			"DELETE": RequireAuth(s.deleteWebhook),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/webhooks/{webhookId}/deliveries"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.listWebhookDeliveries),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/webhooks/{webhookId}/ping"),
+		map[string]http.HandlerFunc{
+			"POST": RequireAuth(s.pingWebhook),
+		})
+
+	// event routes
+	AddMappedMethods(
+		router.Path("/v1/events"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.streamEvents),
+		})
+
+	// search routes
+	AddMappedMethods(
+		router.Path("/v1/search"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.search),
+		})
+
+	// vehicle history routes
+	AddMappedMethods(
+		router.Path("/v1/vehicles/{vehicleId}/history"),
+		map[string]http.HandlerFunc{
+			"GET": RequireAuth(s.listVehicleHistory),
+		})
+
+	AddMappedMethods(
+		router.Path("/v1/vehicles/{vehicleId}/history/{revisionId}/revert"),
+		map[string]http.HandlerFunc{
+			"POST": RequireAuth(s.revertVehicleRevision),
+		})
+
 	// maintenance schedule routes
 	scheduleRoute := router.Path("/v1/vehicles/{vehicleId}/schedule/")
 	AddMappedMethods(scheduleRoute, map[string]http.HandlerFunc{
@@ -90,16 +273,51 @@ func NewHandler(schema *graphql.Schema, allowedOrigins []string) http.Handler {
 		Pretty:   true,
 		GraphiQL: true,
 	})
-	router.Path("/v1/graphql").Handler(graphQlHandler)
+	router.Path("/v1/graphql").Handler(queriesOnlyOnGet(graphQlHandler))
+
+	// api description routes
+	var description map[string]interface{}
+	router.Path("/v1/openapi.json").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderJson(w, description)
+	})
+	router.Path("/v1/docs").Methods("GET").HandlerFunc(s.serveDocs)
+	if options.RedocScript != "" {
+		router.Path(redocScriptPath).Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, options.RedocScript)
+		})
+	}
+
+	// every route has to be registered by now, to be described
+	description, err = openAPIDocument(router)
+	if err != nil {
+		panic(fmt.Sprintf("failed to describe the api: %v", err))
+	}
+
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderNotFound(w)
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderError(w, &statusError{Status: 405, Code: "method_not_allowed", Message: r.Method + " isn't supported here"})
+	})
+
+	router.Use(s.withUser)
+	router.Use(s.idempotent(options.IdempotencyWindow))
+	if options.ValidateResponses {
+		router.Use(schemas.validateResponses)
+	}
+
+	// csrf
+	csrfProtected := CSRFProtect(router)
 
 	// cors
 	corsWrapper := handlers.CORS(
-		handlers.AllowedHeaders([]string{"content-type"}),
+		handlers.AllowedHeaders([]string{"content-type", "authorization", "x-csrf-token", "if-match", "if-none-match", "x-request-id", "idempotency-key", "last-event-id"}),
+		handlers.ExposedHeaders([]string{csrfHeaderName, "ETag", "Link", requestIDHeader, "Accept-Patch", idempotentReplayedHeader}),
 		handlers.AllowedOrigins(allowedOrigins),
 		handlers.AllowedMethods([]string{"GET", "POST", "PATCH", "PUT", "DELETE"}),
 		handlers.AllowCredentials(),
 	)
-	corsWrapped := corsWrapper(router)
+	corsWrapped := corsWrapper(csrfProtected)
 
-	return corsWrapped
+	return RequestID(limitBody(options.MaxBodyBytes, corsWrapped))
 }
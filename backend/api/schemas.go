@@ -0,0 +1,307 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xeipuuv/gojsonschema"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// schemaRegistry holds the API's JSON schemas, compiled: the schema of each
+// operation's request body and, when responses are validated, of its
+// successful response, both by operation ID. It's filled in by
+// compileSchemas and only read afterwards, so requests share it without
+// locking.
+type schemaRegistry struct {
+	requests  map[string]*gojsonschema.Schema
+	documents map[string]*gojsonschema.Schema
+	jsonPatch *gojsonschema.Schema
+	responses map[string]*gojsonschema.Schema
+	problem   *gojsonschema.Schema
+}
+
+// documentSchemas describe the whole of each resource a PATCH can change, by
+// resource. A patched document has to match its resource's schema.
+var documentSchemas = map[string]string{
+	"vehicle": createVehicleSchema,
+	"user":    userDocumentSchema,
+}
+
+// compileSchemas compiles the request schemas of ops, and their response
+// schemas too if withResponses is set. Any schema that doesn't compile is
+// an error, so that a mistake in one is found at startup rather than by
+// the first request that needs it.
+func compileSchemas(ops map[string]operation, withResponses bool) (*schemaRegistry, error) {
+	registry := &schemaRegistry{
+		requests:  make(map[string]*gojsonschema.Schema),
+		documents: make(map[string]*gojsonschema.Schema),
+	}
+
+	for key, op := range ops {
+		if op.Request == "" {
+			continue
+		}
+		schema, err := gojsonschema.NewSchemaLoader().Compile(gojsonschema.NewStringLoader(op.Request))
+		if err != nil {
+			return nil, fmt.Errorf("invalid request schema for %s: %v", key, err)
+		}
+		registry.requests[op.ID] = schema
+	}
+
+	for name, source := range documentSchemas {
+		schema, err := gojsonschema.NewSchemaLoader().Compile(gojsonschema.NewStringLoader(source))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s document schema: %v", name, err)
+		}
+		registry.documents[name] = schema
+	}
+
+	var err error
+	registry.jsonPatch, err = gojsonschema.NewSchemaLoader().Compile(gojsonschema.NewStringLoader(jsonPatchSchema))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON patch schema: %v", err)
+	}
+
+	if !withResponses {
+		return registry, nil
+	}
+
+	// response schemas refer to the models' schemas, which are only all
+	// known once every response has been described
+	builder := &openAPIBuilder{schemas: make(map[string]interface{})}
+	described := make(map[string]map[string]interface{})
+	for _, op := range ops {
+		if op.Response != nil {
+			described[op.ID] = builder.responseSchema(op)
+		}
+	}
+
+	registry.responses = make(map[string]*gojsonschema.Schema, len(described))
+	for id, schema := range described {
+		document := map[string]interface{}{
+			"components": map[string]interface{}{"schemas": builder.schemas},
+			"allOf":      []interface{}{schema},
+		}
+		compiled, err := gojsonschema.NewSchemaLoader().Compile(gojsonschema.NewGoLoader(document))
+		if err != nil {
+			return nil, fmt.Errorf("invalid response schema for %s: %v", id, err)
+		}
+		registry.responses[id] = compiled
+	}
+
+	problem, err := gojsonschema.NewSchemaLoader().Compile(gojsonschema.NewGoLoader(problemSchema))
+	if err != nil {
+		return nil, fmt.Errorf("invalid problem schema: %v", err)
+	}
+	registry.problem = problem
+
+	return registry, nil
+}
+
+// decodeRequest validates the request body against the schema of the
+// operation with the given ID, then decodes it into model.
+func (registry *schemaRegistry) decodeRequest(request *http.Request, operationID string, model interface{}) error {
+	buf, err := readBody(request)
+	if err != nil {
+		return err
+	}
+
+	return registry.decodeBody(buf, operationID, model)
+}
+
+func readBody(request *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(request.Body)
+}
+
+// decodeBody is decodeRequest for a body that's already been read, such as
+// one operation of a batch.
+func (registry *schemaRegistry) decodeBody(buf []byte, operationID string, model interface{}) error {
+	schema, ok := registry.requests[operationID]
+	if !ok {
+		return fmt.Errorf("no request schema for %s", operationID)
+	}
+	return registry.decode(schema, buf, model)
+}
+
+// decode validates buf against schema, then decodes it into model.
+func (registry *schemaRegistry) decode(schema *gojsonschema.Schema, buf []byte, model interface{}) error {
+	if len(buf) == 0 {
+		return invalidField("", "required", "request body not received")
+	}
+
+	document := gojsonschema.NewBytesLoader(buf)
+	result, err := schema.Validate(document)
+	if err != nil {
+		return invalidField("", "invalid_json", "request body isn't valid JSON: %v", err)
+	}
+
+	if !result.Valid() {
+		return &ValidationError{result}
+	}
+
+	buffer := bytes.NewBuffer(buf)
+	decoder := json.NewDecoder(buffer)
+	err = decoder.Decode(&model)
+	if err != nil {
+		return invalidField("", "invalid_value", "%v", err)
+	}
+
+	return nil
+}
+
+// validateResponses checks every response to a documented operation
+// against its description: successes against the operation's response
+// schema and errors against the problem schema. A response that doesn't
+// match is replaced with a server_error problem saying why, so that tests
+// and development servers notice; it's meant to be left off in production.
+func (registry *schemaRegistry) validateResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, ok := currentOperation(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(recorder, r)
+
+		err := registry.checkResponse(op, recorder.status, recorder.contentType, recorder.body.Bytes())
+		if err != nil {
+			log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			for _, header := range []string{"ETag", "Link", "Location"} {
+				w.Header().Del(header)
+			}
+			renderError(w, &statusError{Status: 500, Code: "server_error", Message: err.Error()})
+			return
+		}
+
+		w.WriteHeader(recorder.status)
+		_, _ = w.Write(recorder.body.Bytes())
+	})
+}
+
+// currentOperation finds the documented operation the router matched the
+// request to.
+func currentOperation(r *http.Request) (operation, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return operation{}, false
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return operation{}, false
+	}
+	op, ok := operations[r.Method+" "+path]
+	return op, ok
+}
+
+func (registry *schemaRegistry) checkResponse(op operation, status int, contentType string, body []byte) error {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	var schema *gojsonschema.Schema
+	switch {
+	case status == http.StatusNotModified:
+		return nil
+	case status >= 400:
+		if mediaType != problemContentType {
+			return fmt.Errorf("error response is %q, not a problem", contentType)
+		}
+		schema = registry.problem
+	case status != op.status():
+		return fmt.Errorf("responded %d, but %s is documented to respond %d", status, op.ID, op.status())
+	case op.Response == nil:
+		// nothing's documented but the status, e.g. the docs page
+		return nil
+	case mediaType != "application/json":
+		return fmt.Errorf("response is %q, not JSON", contentType)
+	default:
+		schema = registry.responses[op.ID]
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return fmt.Errorf("response isn't valid JSON: %v", err)
+	}
+	if !result.Valid() {
+		return fmt.Errorf("response doesn't match its schema: %v", ValidationError{result})
+	}
+	return nil
+}
+
+// responseRecorder holds back a response until it's been validated. Like
+// the real writer, it takes the headers as they were when the status was
+// written, so a Content-Type set too late is noticed.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	contentType string
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.status, r.wroteHeader = status, true
+	r.contentType = r.Header().Get("Content-Type")
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(200)
+	return r.body.Write(p)
+}
+
+// limitBody refuses request bodies longer than max bytes, with a
+// payload_too_large problem. Bodies that say how long they are up front are
+// refused before they're read; others when reading passes the limit.
+func limitBody(max int64, next http.Handler) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			renderError(w, bodyTooLarge(max))
+			return
+		}
+		if r.Body != nil {
+			r.Body = &limitedBody{ReadCloser: r.Body, max: max, remaining: max}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bodyTooLarge(max int64) error {
+	return &statusError{Status: 413, Code: "payload_too_large", Message: fmt.Sprintf("the request body may be at most %d bytes", max)}
+}
+
+// limitedBody fails reads once more than remaining bytes have been read,
+// like http.MaxBytesReader, but with an error that's rendered as a problem.
+type limitedBody struct {
+	io.ReadCloser
+	max       int64
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, bodyTooLarge(b.max)
+	}
+	// read one byte past the limit, to tell a body of exactly the limit
+	// from a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), bodyTooLarge(b.max)
+	}
+	return n, err
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"vehicledb/auth"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// search looks for q across the user's records. Results are ranked best
+// first, and each has an HTML snippet with the matching words in <mark>.
+func (s *server) search(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	query := strings.TrimSpace(request.URL.Query().Get("q"))
+	if query == "" {
+		renderError(writer, invalidField("q", "required", "q is required"))
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := request.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxSearchLimit {
+			renderError(writer, invalidField("limit", "out_of_range", "limit must be between 1 and %d", maxSearchLimit))
+			return
+		}
+		limit = parsed
+	}
+
+	results, err := s.store.Search(request.Context(), user.UserID, query, limit)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	// results are ranked rather than sorted, and limit is all there is
+	renderList(writer, request, results, nil)
+}
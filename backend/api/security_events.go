@@ -0,0 +1,93 @@
+package api
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// securityEvent fills in the request metadata of an event.
+func securityEvent(request *http.Request, event db.SecurityEvent) *db.SecurityEvent {
+	event.IPAddress = clientIP(request)
+	event.UserAgent = request.UserAgent()
+	return &event
+}
+
+// recordSecurityEvent appends an event to the security log outside of any
+// transaction. Failing to record it is logged rather than failing the
+// request it describes; events that belong to a change should instead be
+// recorded through the transaction making the change.
+func (s *server) recordSecurityEvent(request *http.Request, event db.SecurityEvent) {
+	err := s.store.RecordSecurityEvent(request.Context(), securityEvent(request, event))
+	if err != nil {
+		log.Printf("failed to record %s security event: %v", event.EventType, err)
+	}
+}
+
+func (s *server) listMySecurityEvents(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	options, err := listOptions(request, "-created_at")
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	events, next, err := s.store.ListSecurityEvents(request.Context(), user.UserID, options)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderList(writer, request, events, next)
+}
+
+// requireAdmin renders a 403 and returns false unless the user is an admin.
+func (s *server) requireAdmin(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) bool {
+	isAdmin, err := s.store.IsAdmin(request.Context(), user.UserID)
+	if err != nil {
+		renderError(writer, err)
+		return false
+	}
+
+	if !isAdmin {
+		renderError(writer, db.NewError(db.ErrForbidden, "only admins may do this"))
+		return false
+	}
+
+	return true
+}
+
+func (s *server) listAllSecurityEvents(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	if !s.requireAdmin(user, writer, request) {
+		return
+	}
+
+	options, err := listOptions(request, "-created_at")
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	events, next, err := s.store.ListAllSecurityEvents(request.Context(), options)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	s.recordSecurityEvent(request, db.SecurityEvent{
+		EventType: db.EventAdminAction,
+		ActorID:   &user.UserID,
+		Details:   map[string]string{"action": "list_security_events"},
+	})
+
+	renderList(writer, request, events, next)
+}
@@ -7,13 +7,18 @@ import (
 	"vehicledb/db"
 )
 
-var authCookieName = "auth"
+// SessionResponse describes the session of the auth cookie, and carries the
+// CSRF token to echo back on requests that change anything.
+type SessionResponse struct {
+	EmailAddress string `json:"email_address"`
+	UserID       string `json:"user_id"`
+	CSRFToken    string `json:"csrf_token"`
+}
 
-func validateSession(writer http.ResponseWriter, request *http.Request) {
+func (s *server) validateSession(writer http.ResponseWriter, request *http.Request) {
 	cookie, err := request.Cookie(authCookieName)
 	if err == http.ErrNoCookie {
-		writer.WriteHeader(401)
-		renderJson(writer, map[string]string {"code": "unauthorized"})
+		renderError(writer, db.NewError(db.ErrUnauthenticated, "not logged in"))
 		return
 	}
 
@@ -24,14 +29,17 @@ func validateSession(writer http.ResponseWriter, request *http.Request) {
 
 	user, err := auth.ValidateToken(cookie.Value)
 	if err != nil {
-		writer.WriteHeader(403)
-		renderJson(writer, map[string]string {"code": "forbidden"})
+		renderError(writer, db.NewError(db.ErrForbidden, "invalid or expired session"))
 		return
 	}
 
-	renderJson(writer, map[string]string{
-		"email_address": user.EmailAddress,
-		"user_id": user.UserID.String(),
+	csrfToken := auth.CreateCSRFToken(cookie.Value)
+	writer.Header().Set(csrfHeaderName, csrfToken)
+
+	renderJson(writer, SessionResponse{
+		EmailAddress: user.EmailAddress,
+		UserID:       user.UserID.String(),
+		CSRFToken:    csrfToken,
 	})
 }
 
@@ -53,38 +61,67 @@ var loginSchema = `{
   ]
 }`
 
-func login(writer http.ResponseWriter, request *http.Request) {
+func (s *server) login(writer http.ResponseWriter, request *http.Request) {
 	var loginRequest LoginRequest
-	err := validateSchemaBuildModel(request, loginSchema, &loginRequest)
+	err := s.schemas.decodeRequest(request, "login", &loginRequest)
 	if err != nil {
 		renderError(writer, err)
 		return
 	}
 
-	user, err := db.FindUserByEmailAddress(loginRequest.EmailAddress)
+	user, err := s.store.FindUserByEmailAddress(request.Context(), loginRequest.EmailAddress)
+	if _, ok := err.(*db.EmailAddressNotFoundError); ok {
+		user, err = nil, nil
+	}
 	if err != nil {
 		renderError(writer, err)
 		return
 	}
 
-	if user == nil {
-		renderError(writer, fmt.Errorf("failed to find user with email address %s", loginRequest.EmailAddress))
+	// unknown addresses and bad passwords get the same response, so that
+	// login can't be used to discover which addresses have accounts
+	if user == nil || !user.DoesPasswordMatch(loginRequest.Password) {
+		event := db.SecurityEvent{
+			EventType: db.EventLoginFailed,
+			Details:   map[string]string{"email_address": loginRequest.EmailAddress},
+		}
+		if user != nil {
+			event.UserID = &user.UserId
+		}
+		s.recordSecurityEvent(request, event)
+
+		renderError(writer, &statusError{Status: 401, Code: "invalid_credentials", Message: "the email address or password is wrong"})
 		return
 	}
 
-	if !user.DoesPasswordMatch(loginRequest.Password) {
-		renderError(writer, fmt.Errorf("password does not match"))
+	s.recordSecurityEvent(request, db.SecurityEvent{
+		EventType: db.EventLogin,
+		UserID:    &user.UserId,
+		ActorID:   &user.UserId,
+	})
+
+	err = s.setAuthCookie(writer, user)
+	if err != nil {
+		renderError(writer, err)
 		return
 	}
 
- 	setAuthCookie(writer, user)
-
 	renderJson(writer, user)
 }
 
-func logout(writer http.ResponseWriter, request *http.Request) {
+func (s *server) logout(writer http.ResponseWriter, request *http.Request) {
+	if cookie, err := request.Cookie(authCookieName); err == nil {
+		if user, err := auth.ValidateToken(cookie.Value); err == nil {
+			s.recordSecurityEvent(request, db.SecurityEvent{
+				EventType: db.EventLogout,
+				UserID:    &user.UserID,
+				ActorID:   &user.UserID,
+			})
+		}
+	}
+
 	// wipe cookie
-	removeAuthCookie(writer)
+	s.removeAuthCookie(writer)
 
 	writer.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+// deletedVehicleSortKeys are the orders the trash can be listed in; the
+// trash is small, so it's paged after it's read.
+var deletedVehicleSortKeys = []db.SortKey{
+	{Name: "deleted_at", Column: "deleted_at"},
+	{Name: "year", Column: "year"},
+	{Name: "make", Column: "make"},
+	{Name: "model", Column: "model"},
+}
+
+// listTrash lists what the user has deleted but not yet lost for good,
+// most recently deleted first unless asked otherwise.
+func (s *server) listTrash(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	vehicles, err := s.store.ListDeletedVehicles(request.Context(), user.UserID)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	indexes, next, err := pageOf(request, len(vehicles), deletedVehicleSortKeys, "-deleted_at", func(idx int, key string) (interface{}, db.RowID) {
+		vehicle := vehicles[idx]
+		switch key {
+		case "year":
+			return int64(vehicle.Year), vehicle.VehicleID
+		case "make":
+			return vehicle.Make, vehicle.VehicleID
+		case "model":
+			return vehicle.Model, vehicle.VehicleID
+		}
+		return db.CursorTime(*vehicle.DeletedAt), vehicle.VehicleID
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	page := make([]*db.Vehicle, 0, len(indexes))
+	for _, idx := range indexes {
+		page = append(page, vehicles[idx])
+	}
+	renderList(writer, request, page, next)
+}
+
+// deletedVehicle loads a vehicle from the trash. Vehicles that aren't there,
+// or belong to someone else, are not found.
+func deletedVehicle(tx db.Tx, user *auth.ClaimsUser, request *http.Request) (*db.Vehicle, error) {
+	vehicleId, err := db.ParseRowID(mux.Vars(request)["vehicleId"])
+	if err != nil {
+		return nil, err
+	}
+
+	vehicle, err := tx.GetDeletedVehicle(request.Context(), vehicleId)
+	if err != nil {
+		return nil, err
+	}
+
+	if vehicle.UserID != user.UserID {
+		return nil, &db.VehicleNotFoundError{VehicleID: vehicleId}
+	}
+
+	return vehicle, nil
+}
+
+func (s *server) restoreVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	var vehicle *db.Vehicle
+	err := s.store.InTx(request.Context(), func(tx db.Tx) error {
+		deleted, err := deletedVehicle(tx, user, request)
+		if err != nil {
+			return err
+		}
+
+		err = tx.RestoreVehicle(request.Context(), deleted.VehicleID)
+		if err != nil {
+			return err
+		}
+
+		vehicle, err = tx.GetVehicle(request.Context(), deleted.VehicleID)
+		return err
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderJson(writer, vehicle)
+}
+
+// purgeVehicle removes a vehicle from the trash for good. Vehicles have to be
+// deleted before they can be purged.
+func (s *server) purgeVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	err := s.store.InTx(request.Context(), func(tx db.Tx) error {
+		vehicle, err := deletedVehicle(tx, user, request)
+		if err != nil {
+			return err
+		}
+
+		return tx.PurgeVehicle(request.Context(), vehicle.VehicleID)
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	writer.WriteHeader(204)
+}
+
+var deletedUserSortKeys = []db.SortKey{
+	{Name: "deleted_at", Column: "deleted_at"},
+	{Name: "email_address", Column: "email_address"},
+}
+
+func (s *server) listDeletedUsers(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	if !s.requireAdmin(user, writer, request) {
+		return
+	}
+
+	users, err := s.store.ListDeletedUsers(request.Context())
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	indexes, next, err := pageOf(request, len(users), deletedUserSortKeys, "-deleted_at", func(idx int, key string) (interface{}, db.RowID) {
+		user := users[idx]
+		if key == "email_address" {
+			return user.EmailAddress, user.UserId
+		}
+		return db.CursorTime(*user.DeletedAt), user.UserId
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	page := make([]*db.User, 0, len(indexes))
+	for _, idx := range indexes {
+		page = append(page, users[idx])
+	}
+	renderList(writer, request, page, next)
+}
+
+func (s *server) restoreUser(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	if !s.requireAdmin(user, writer, request) {
+		return
+	}
+
+	userId, err := db.ParseRowID(mux.Vars(request)["userId"])
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	var restored *db.User
+	err = s.store.InTx(request.Context(), func(tx db.Tx) error {
+		err := tx.RestoreUser(request.Context(), userId)
+		if err != nil {
+			return err
+		}
+
+		restored, err = tx.GetUser(request.Context(), userId)
+		if err != nil {
+			return err
+		}
+
+		return tx.RecordSecurityEvent(request.Context(), securityEvent(request, db.SecurityEvent{
+			EventType: db.EventUserRestored,
+			UserID:    &userId,
+			ActorID:   &user.UserID,
+		}))
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderJson(writer, restored)
+}
+
+// purgeUser erases an account and its vehicles whether or not it is in the
+// trash, for requests that can't wait out the retention period. The
+// account's security events are kept, with its email addresses scrubbed
+// from them; see db.IdentifyingDetails.
+func (s *server) purgeUser(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	if !s.requireAdmin(user, writer, request) {
+		return
+	}
+
+	userId, err := db.ParseRowID(mux.Vars(request)["userId"])
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	err = s.store.InTx(request.Context(), func(tx db.Tx) error {
+		err := tx.PurgeUser(request.Context(), userId)
+		if err != nil {
+			return err
+		}
+
+		return tx.RecordSecurityEvent(request.Context(), securityEvent(request, db.SecurityEvent{
+			EventType: db.EventUserPurged,
+			UserID:    &userId,
+			ActorID:   &user.UserID,
+		}))
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	writer.WriteHeader(204)
+}
@@ -24,100 +24,167 @@ var createUserSchema = `{
   ]
 }`
 
-func createUser(w http.ResponseWriter, request *http.Request) {
+func (s *server) createUser(w http.ResponseWriter, request *http.Request) {
 	var createUserRequest CreateUserRequest
-	err := validateSchemaBuildModel(request, createUserSchema, &createUserRequest)
+	err := s.schemas.decodeRequest(request, "createUser", &createUserRequest)
 	if err != nil {
 		renderError(w, err)
 		return
 	}
 
-	user, err := db.CreateUser(createUserRequest.EmailAddress, createUserRequest.Password)
+	var user *db.User
+	err = s.store.InTx(request.Context(), func(tx db.Tx) error {
+		user, err = tx.CreateUser(request.Context(), createUserRequest.EmailAddress, createUserRequest.Password)
+		if err != nil {
+			return err
+		}
+
+		return tx.RecordSecurityEvent(request.Context(), securityEvent(request, db.SecurityEvent{
+			EventType: db.EventUserCreated,
+			UserID:    &user.UserId,
+			ActorID:   &user.UserId,
+		}))
+	})
 	if err != nil {
 		renderError(w, err)
 		return
 	}
 
-	setAuthCookie(w, user)
-
-	renderJson(w, user)
-}
-
-func setAuthCookie(w http.ResponseWriter, user *db.User) {
-	token, err := auth.CreateToken(user)
+	err = s.setAuthCookie(w, user)
 	if err != nil {
 		renderError(w, err)
 		return
 	}
 
-	cookie := http.Cookie{
-		Path: "/",
-		Name: authCookieName,
-		Value: token,
-	}
-	http.SetCookie(w, &cookie)
-}
-
-func removeAuthCookie(w http.ResponseWriter) {
-	cookie := http.Cookie{
-		Path: "/",
-		Name: authCookieName,
-		Value: "",
-	}
-	http.SetCookie(w, &cookie)
+	renderJson(w, user)
 }
 
-func getUser(claimsUser *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
-	user, err := db.GetUser(claimsUser.UserID)
+func (s *server) getUser(claimsUser *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	user, err := s.store.GetUser(request.Context(), claimsUser.UserID)
 	if err != nil {
 		renderError(writer, err)
 		return
 	}
 
+	if notModified(request, user.Version) {
+		renderNotModified(writer, user.Version)
+		return
+	}
+
+	setETag(writer, user.Version)
 	renderJson(writer, user)
 }
 
+// UpdateUserRequest is the part of an account a PATCH can change, and so
+// what it's applied to.
 type UpdateUserRequest struct {
 	EmailAddress string `json:"email_address"`
 }
 
+// updateUserSchema is that of a merge patch of an account.
 var updateUserSchema = `{
 	"type": "object",
 	"additionalProperties": false,
 	"properties": {
-		"email_address": {"type": "string"}
+		"email_address": {"type": ["string", "null"]}
 	}
 }`
 
-func updateUser(claimsUser *auth.ClaimsUser, w http.ResponseWriter, request *http.Request) {
-	var updateUserRequest UpdateUserRequest
-	err := validateSchemaBuildModel(request, updateUserSchema, &updateUserRequest)
+var userDocumentSchema = `{
+	"type": "object",
+	"additionalProperties": false,
+	"properties": {
+		"email_address": {"type": "string"}
+	},
+	"required": ["email_address"]
+}`
+
+// updateUser applies a merge patch or JSON patch to the account.
+func (s *server) updateUser(claimsUser *auth.ClaimsUser, w http.ResponseWriter, request *http.Request) {
+	changes, err := s.schemas.readPatchRequest(w, request, "updateUser")
 	if err != nil {
 		renderError(w, err)
 		return
 	}
 
-	user, err := db.UpdateUser(claimsUser.UserID, updateUserRequest.EmailAddress)
+	var user *db.User
+	err = s.store.InTx(request.Context(), func(tx db.Tx) error {
+		previous, err := tx.GetUser(request.Context(), claimsUser.UserID)
+		if err != nil {
+			return err
+		}
+
+		version, err := expectedVersion(request, previous.Version)
+		if err != nil {
+			return err
+		}
+
+		var updateUserRequest UpdateUserRequest
+		err = s.schemas.applyPatch(changes, UpdateUserRequest{EmailAddress: previous.EmailAddress}, "user", &updateUserRequest)
+		if err != nil {
+			return err
+		}
+
+		user, err = tx.UpdateUser(request.Context(), claimsUser.UserID, version, updateUserRequest.EmailAddress)
+		if err != nil {
+			return err
+		}
+
+		if user.EmailAddress == previous.EmailAddress {
+			return nil
+		}
+
+		return tx.RecordSecurityEvent(request.Context(), securityEvent(request, db.SecurityEvent{
+			EventType: db.EventEmailChanged,
+			UserID:    &user.UserId,
+			ActorID:   &claimsUser.UserID,
+			Details: map[string]string{
+				"previous_email_address": previous.EmailAddress,
+				"email_address":          user.EmailAddress,
+			},
+		}))
+	})
 	if err != nil {
 		renderError(w, err)
 		return
 	}
 
+	setETag(w, user.Version)
 	renderJson(w, user)
 }
 
-func deleteUser(claimsUser *auth.ClaimsUser, w http.ResponseWriter, request *http.Request) {
-	user, err := db.GetUser(claimsUser.UserID)
-	if err != nil {
-		renderError(w, err)
-		return
-	}
-
-	err = db.DeleteUser(claimsUser.UserID)
+func (s *server) deleteUser(claimsUser *auth.ClaimsUser, w http.ResponseWriter, request *http.Request) {
+	var user *db.User
+	err := s.store.InTx(request.Context(), func(tx db.Tx) error {
+		var err error
+		user, err = tx.GetUser(request.Context(), claimsUser.UserID)
+		if err != nil {
+			return err
+		}
+
+		version, err := expectedVersion(request, user.Version)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteUser(request.Context(), claimsUser.UserID, version)
+		if err != nil {
+			return err
+		}
+
+		return tx.RecordSecurityEvent(request.Context(), securityEvent(request, db.SecurityEvent{
+			EventType: db.EventUserDeleted,
+			UserID:    &user.UserId,
+			ActorID:   &claimsUser.UserID,
+			Details:   map[string]string{"email_address": user.EmailAddress},
+		}))
+	})
 	if err != nil {
 		renderError(w, err)
 		return
 	}
 
+	// the session goes with the account
+	s.removeAuthCookie(w)
 	renderJson(w, user)
 }
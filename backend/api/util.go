@@ -1,69 +1,22 @@
 package api
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/xeipuuv/gojsonschema"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"strings"
+	"vehicledb/db"
 )
 
-var cache = make(map[string]*gojsonschema.Schema)
-
-func validateSchemaBuildModel(request *http.Request, schemaText string, model interface{}) error {
-	var err error
-
-	schema, ok := cache[schemaText]
-	if !ok {
-		loader := gojsonschema.NewStringLoader(schemaText)
-		sl := gojsonschema.NewSchemaLoader()
-		schema, err = sl.Compile(loader)
-		if err != nil {
-			return err
-		}
-
-		cache[schemaText] = schema
-	}
-
-	buf, err := ioutil.ReadAll(request.Body)
-	if err != nil {
-		return err
-	}
-
-	if len(buf) == 0 {
-		return fmt.Errorf("request body not received")
-	}
-
-	document := gojsonschema.NewBytesLoader(buf)
-	result, err := schema.Validate(document)
-	if err != nil {
-		return err
-	}
-
-	if !result.Valid() {
-		return &ValidationError{result}
-	}
-
-	buffer := bytes.NewBuffer(buf)
-	decoder := json.NewDecoder(buffer)
-	err = decoder.Decode(&model)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 type ValidationError struct {
 	Result *gojsonschema.Result
 }
 
 func (error ValidationError) Error() string {
-	errors := make([]string, len(error.Result.Errors()))
+	errors := make([]string, 0, len(error.Result.Errors()))
 
 	for _, err := range error.Result.Errors() {
 		errors = append(errors, err.String())
@@ -71,43 +24,32 @@ func (error ValidationError) Error() string {
 	return strings.Join(errors, "\n")
 }
 
+// renderJson writes data as JSON. Responses are labelled as JSON unless
+// they already say otherwise, e.g. problems.
 func renderJson(writer io.Writer, data interface{}) {
+	if w, ok := writer.(http.ResponseWriter); ok && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	err := json.NewEncoder(writer).Encode(data)
 	if err != nil {
 		fmt.Println("failed to write json")
 	}
 }
 
-func renderError(writer http.ResponseWriter, err error) {
-	switch e := err.(type) {
-	case *ValidationError:
-		writer.WriteHeader(400)
-
-		errors := make([]interface{}, 0)
-
-		for _, result := range e.Result.Errors() {
-			errJson := map[string]interface{}{
-				"code": result.Type(),
-			}
-
-			details := result.Details()
-			for k, v := range details {
-				errJson[k] = v
-			}
-
-			errors = append(errors, errJson)
-		}
-
-		renderJson(writer, map[string]interface{}{
-			"code":   "invalid_request",
-			"errors": errors,
-		})
+// errorStatuses maps the store's kinds of error to HTTP statuses. Errors of
+// any other kind are the server's fault.
+var errorStatuses = map[error]int{
+	db.ErrNotFound:           404,
+	db.ErrConflict:           409,
+	db.ErrForbidden:          403,
+	db.ErrUnauthenticated:    401,
+	db.ErrRateLimited:        429,
+	db.ErrPreconditionFailed: 412,
+	db.ErrInvalid:            400,
+}
 
-	default:
-		fmt.Println(err)
-		writer.WriteHeader(500)
-		renderJson(writer, map[string]interface{}{"code": "server_error"})
-	}
+func renderNotFound(writer http.ResponseWriter) {
+	renderError(writer, db.NewError(db.ErrNotFound, "not found"))
 }
 
 func keys(mapped map[string]http.HandlerFunc) []string {
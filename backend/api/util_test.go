@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderErrorContext(t *testing.T) {
+	cases := map[error]int{
+		fmt.Errorf("failed to execute list vehicles query: %w", context.DeadlineExceeded): 504,
+		fmt.Errorf("failed to execute list vehicles query: %w", context.Canceled):         503,
+		fmt.Errorf("something else"):                                                      500,
+	}
+
+	for err, status := range cases {
+		recorder := httptest.NewRecorder()
+		renderError(recorder, err)
+
+		if recorder.Code != status {
+			t.Errorf("%v: expected %d, got %d", err, status, recorder.Code)
+		}
+	}
+}
+
+func TestRenderErrorProblem(t *testing.T) {
+	request := httptest.NewRequest("POST", "/v1/vehicles/", strings.NewReader(`{"year": "2017", "colour": "red"}`))
+	schemas, err := compileSchemas(operations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var model CreateVehicleRequest
+	err = schemas.decodeRequest(request, "createVehicle", &model)
+	if err == nil {
+		t.Fatal("expected the request to be invalid")
+	}
+
+	recorder := httptest.NewRecorder()
+	RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderError(w, err)
+	})).ServeHTTP(recorder, request)
+
+	if recorder.Code != 400 || recorder.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("expected a 400 problem, got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+
+	var problem struct {
+		Type      string       `json:"type"`
+		Title     string       `json:"title"`
+		Status    int          `json:"status"`
+		Code      string       `json:"code"`
+		RequestID string       `json:"request_id"`
+		Errors    []FieldError `json:"errors"`
+	}
+	err = json.NewDecoder(recorder.Body).Decode(&problem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != "invalid_request" || problem.Status != 400 || problem.Type != "urn:vehicledb:problem:invalid_request" || problem.Title == "" {
+		t.Fatalf("unexpected problem: %+v", problem)
+	}
+	if problem.RequestID == "" || problem.RequestID != recorder.Header().Get("X-Request-ID") {
+		t.Fatalf("expected the problem to carry the request id %q, got %q", recorder.Header().Get("X-Request-ID"), problem.RequestID)
+	}
+
+	pointers := make(map[string]string)
+	for _, field := range problem.Errors {
+		pointers[field.Pointer] = field.Code
+	}
+	expected := map[string]string{
+		"/year":   "invalid_type",
+		"/colour": "additional_property_not_allowed",
+		"/make":   "required",
+		"/model":  "required",
+	}
+	for pointer, code := range expected {
+		if pointers[pointer] != code {
+			t.Errorf("expected %s to be %s, got %v", pointer, code, pointers)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Request-ID", "from-the-proxy")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Header().Get("X-Request-ID") != "from-the-proxy" {
+		t.Fatalf("expected the proxy's request id to be kept, got %q", recorder.Header().Get("X-Request-ID"))
+	}
+
+	request.Header.Set("X-Request-ID", "has spaces\nand lines")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if id := recorder.Header().Get("X-Request-ID"); len(id) != 32 {
+		t.Fatalf("expected a generated request id, got %q", id)
+	}
+}
+
+func TestCompileSchemas(t *testing.T) {
+	_, err := compileSchemas(operations, true)
+	if err != nil {
+		t.Fatalf("expected the api's schemas to compile, got %v", err)
+	}
+
+	broken := map[string]operation{
+		"POST /v1/broken": {ID: "broken", Request: `{"type": "object", "properties": {"year": {"type": "nonsense"}}}`},
+	}
+	_, err = compileSchemas(broken, false)
+	if err == nil || !strings.Contains(err.Error(), "POST /v1/broken") {
+		t.Fatalf("expected the broken schema to be reported, got %v", err)
+	}
+}
+
+func TestValidationErrorLines(t *testing.T) {
+	schemas, err := compileSchemas(operations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("POST", "/v1/vehicles/", strings.NewReader(`{"year": "2017"}`))
+	err = schemas.decodeRequest(request, "createVehicle", &CreateVehicleRequest{})
+
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a line for each of the 3 errors, got %q", err.Error())
+	}
+	for _, line := range lines {
+		if line == "" {
+			t.Fatalf("expected no blank lines, got %q", err.Error())
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	schemas, err := compileSchemas(operations, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"year": 2017, "make": "Honda", "model": "Civic"}`
+	handler := limitBody(int64(len(body)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var model CreateVehicleRequest
+		err := schemas.decodeRequest(r, "createVehicle", &model)
+		if err != nil {
+			renderError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+
+	cases := map[string]int{
+		body:       204,
+		body + " ": 413,
+	}
+	for body, status := range cases {
+		for _, knownLength := range []bool{true, false} {
+			var reader io.Reader = strings.NewReader(body)
+			if !knownLength {
+				// hides the length, as a chunked body would
+				reader = io.MultiReader(reader)
+			}
+			request := httptest.NewRequest("POST", "/v1/vehicles/", reader)
+			if !knownLength {
+				request.ContentLength = -1
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != status {
+				t.Errorf("%d bytes, length known %v: expected %d, got %d %s", len(body), knownLength, status, recorder.Code, recorder.Body)
+			}
+		}
+	}
+}
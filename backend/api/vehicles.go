@@ -1,20 +1,57 @@
 package api
 
 import (
+	"context"
 	"github.com/gorilla/mux"
 	"net/http"
+	"strconv"
 	"vehicledb/auth"
 	"vehicledb/db"
 )
 
-func listVehicles(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
-	vehicles, err := db.ListVehicles(user.UserID)
+// vehicleFilter reads the ?year_from=, ?year_to= and ?make= of a request to
+// list vehicles.
+func vehicleFilter(request *http.Request) (db.VehicleFilter, error) {
+	query := request.URL.Query()
+	filter := db.VehicleFilter{Make: query.Get("make")}
+
+	for name, year := range map[string]*db.Year{"year_from": &filter.YearFrom, "year_to": &filter.YearTo} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return filter, invalidField(name, "invalid_type", "%s must be a year", name)
+		}
+		*year = db.Year(parsed)
+	}
+
+	return filter, nil
+}
+
+// listVehicles lists a page of the user's vehicles, which may be sorted by
+// id, year, make or model and filtered by year range and make.
+func (s *server) listVehicles(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	filter, err := vehicleFilter(request)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	options, err := listOptions(request, "id")
 	if err != nil {
-		renderJson(writer, err)
+		renderError(writer, err)
 		return
 	}
 
-	renderJson(writer, vehicles)
+	vehicles, next, err := s.store.ListVehicles(request.Context(), user.UserID, filter, options)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderList(writer, request, vehicles, next)
 }
 
 type CreateVehicleRequest struct {
@@ -38,15 +75,15 @@ var createVehicleSchema = `{
   ]
 }`
 
-func createVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+func (s *server) createVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
 	var createVehicleRequest CreateVehicleRequest
-	err := validateSchemaBuildModel(request, createVehicleSchema, &createVehicleRequest)
+	err := s.schemas.decodeRequest(request, "createVehicle", &createVehicleRequest)
 	if err != nil {
 		renderError(writer, err)
 		return
 	}
 
-	vehicle, err := db.CreateVehicle(user.UserID, createVehicleRequest.Year, createVehicleRequest.Make, createVehicleRequest.Model)
+	vehicle, err := s.store.CreateVehicle(request.Context(), user.UserID, createVehicleRequest.Year, createVehicleRequest.Make, createVehicleRequest.Model)
 	if err != nil {
 		renderError(writer, err)
 	} else {
@@ -54,7 +91,22 @@ func createVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *h
 	}
 }
 
-func getVehicle(writer http.ResponseWriter, request *http.Request) {
+// userVehicle loads one of the user's vehicles. Other users' vehicles are
+// not found rather than forbidden, so that ids can't be probed.
+func userVehicle(ctx context.Context, tx db.Tx, user *auth.ClaimsUser, vehicleId db.RowID) (*db.Vehicle, error) {
+	vehicle, err := tx.GetVehicle(ctx, vehicleId)
+	if err != nil {
+		return nil, err
+	}
+
+	if vehicle.UserID != user.UserID {
+		return nil, &db.VehicleNotFoundError{VehicleID: vehicleId}
+	}
+
+	return vehicle, nil
+}
+
+func (s *server) getVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	vehicleId, err := db.ParseRowID(vars["vehicleId"])
 	if err != nil {
@@ -62,32 +114,43 @@ func getVehicle(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	vehicle, err := db.GetVehicle(vehicleId)
+	vehicle, err := userVehicle(request.Context(), s.store, user, vehicleId)
 	if err != nil {
 		renderError(writer, err)
 		return
 	}
 
+	if notModified(request, vehicle.Version) {
+		renderNotModified(writer, vehicle.Version)
+		return
+	}
+
+	setETag(writer, vehicle.Version)
 	renderJson(writer, vehicle)
 }
 
+// updateVehicleSchema is that of a merge patch of a vehicle. Its fields can
+// be null, as far as the patch goes, but none of a vehicle's can be removed.
 var updateVehicleSchema = `{
   "type": "object",
   "additionalProperties": false,
   "properties": {
-    "year": {"type": "integer"},
-	"make": {"type": "string"},
-	"model": {"type": "string"}
+    "year": {"type": ["integer", "null"]},
+	"make": {"type": ["string", "null"]},
+	"model": {"type": ["string", "null"]}
   }
 }`
 
+// UpdateVehicleRequest is a merge patch of a vehicle. Fields that are nil
+// are left out, and so left alone.
 type UpdateVehicleRequest struct {
-	Year  *db.NullYear   `json:"year"`
-	Make  *db.NullString `json:"make"`
-	Model *db.NullString `json:"model"`
+	Year  *db.NullYear   `json:"year,omitempty"`
+	Make  *db.NullString `json:"make,omitempty"`
+	Model *db.NullString `json:"model,omitempty"`
 }
 
-func updateVehicle(writer http.ResponseWriter, request *http.Request) {
+// updateVehicle applies a merge patch or JSON patch to a vehicle.
+func (s *server) updateVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	vehicleId, err := db.ParseRowID(vars["vehicleId"])
 	if err != nil {
@@ -95,25 +158,61 @@ func updateVehicle(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	var updateVehicleRequest UpdateVehicleRequest
-	err = validateSchemaBuildModel(request, updateVehicleSchema, &updateVehicleRequest)
+	changes, err := s.schemas.readPatchRequest(writer, request, "updateVehicle")
 	if err != nil {
 		renderError(writer, err)
 		return
 	}
 
-	err = db.UpdateVehicle(vehicleId, updateVehicleRequest.Year, updateVehicleRequest.Make, updateVehicleRequest.Model)
+	vehicle, err := s.updateUserVehicle(request.Context(), s.store, user, vehicleId, request.Header.Get("If-Match"), changes)
 	if err != nil {
 		renderError(writer, err)
 		return
 	}
 
-	vehicle, err := db.GetVehicle(vehicleId)
-
+	setETag(writer, vehicle.Version)
 	renderJson(writer, vehicle)
 }
 
-func deleteVehicle(writer http.ResponseWriter, request *http.Request) {
+// updateUserVehicle patches one of the user's vehicles, if it's still the
+// version ifMatch names. The patch is applied to the vehicle's year, make
+// and model, as a CreateVehicleRequest, and the result has to be one too.
+func (s *server) updateUserVehicle(ctx context.Context, tx db.Tx, user *auth.ClaimsUser, vehicleId db.RowID, ifMatch string, changes patch) (*db.Vehicle, error) {
+	var vehicle *db.Vehicle
+	err := tx.InTx(ctx, func(tx db.Tx) error {
+		previous, err := userVehicle(ctx, tx, user, vehicleId)
+		if err != nil {
+			return err
+		}
+
+		version, err := matchVersion(ifMatch, previous.Version)
+		if err != nil {
+			return err
+		}
+
+		document := CreateVehicleRequest{Year: previous.Year, Make: previous.Make, Model: previous.Model}
+		var patched CreateVehicleRequest
+		err = s.schemas.applyPatch(changes, document, "vehicle", &patched)
+		if err != nil {
+			return err
+		}
+
+		err = tx.UpdateVehicle(ctx, vehicleId, version,
+			&db.NullYear{Year: patched.Year, Valid: true},
+			&db.NullString{String: patched.Make, Valid: true},
+			&db.NullString{String: patched.Model, Valid: true},
+		)
+		if err != nil {
+			return err
+		}
+
+		vehicle, err = tx.GetVehicle(ctx, vehicleId)
+		return err
+	})
+	return vehicle, err
+}
+
+func (s *server) deleteVehicle(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	vehicleId, err := db.ParseRowID(vars["vehicleId"])
 	if err != nil {
@@ -121,13 +220,7 @@ func deleteVehicle(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	vehicle, err := db.GetVehicle(vehicleId)
-	if err != nil {
-		renderError(writer, err)
-		return
-	}
-
-	err = db.DeleteVehicle(vehicleId)
+	vehicle, err := deleteUserVehicle(request.Context(), s.store, user, vehicleId, request.Header.Get("If-Match"))
 	if err != nil {
 		renderError(writer, err)
 		return
@@ -135,3 +228,24 @@ func deleteVehicle(writer http.ResponseWriter, request *http.Request) {
 
 	renderJson(writer, vehicle)
 }
+
+// deleteUserVehicle moves one of the user's vehicles to the trash, if it's
+// still the version ifMatch names.
+func deleteUserVehicle(ctx context.Context, tx db.Tx, user *auth.ClaimsUser, vehicleId db.RowID, ifMatch string) (*db.Vehicle, error) {
+	var vehicle *db.Vehicle
+	err := tx.InTx(ctx, func(tx db.Tx) error {
+		var err error
+		vehicle, err = userVehicle(ctx, tx, user, vehicleId)
+		if err != nil {
+			return err
+		}
+
+		version, err := matchVersion(ifMatch, vehicle.Version)
+		if err != nil {
+			return err
+		}
+
+		return tx.DeleteVehicle(ctx, vehicleId, version)
+	})
+	return vehicle, err
+}
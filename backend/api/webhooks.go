@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+var createWebhookSchema = func() string {
+	changeTypes, _ := json.Marshal(db.ChangeTypes)
+	return fmt.Sprintf(`{
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "url": {"type": "string", "maxLength": 2048},
+    "events": {"type": "array", "minItems": 1, "uniqueItems": true, "items": {"enum": %s}}
+  },
+  "required": ["url", "events"]
+}`, changeTypes)
+}()
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// newWebhookSecret makes the key deliveries are signed with.
+func newWebhookSecret() string {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return "whsec_" + hex.EncodeToString(buf)
+}
+
+func (s *server) createWebhook(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	var createWebhookRequest CreateWebhookRequest
+	err := s.schemas.decodeRequest(request, "createWebhook", &createWebhookRequest)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	target, err := url.Parse(createWebhookRequest.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		renderError(writer, invalidField("/url", "invalid_value", "the url must be an absolute http or https URL"))
+		return
+	}
+
+	webhook, err := s.store.CreateWebhook(request.Context(), user.UserID, target.String(), createWebhookRequest.Events, newWebhookSecret())
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	// the one time the secret is shown
+	renderJson(writer, webhook)
+}
+
+func (s *server) listWebhooks(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	webhooks, err := s.store.ListWebhooks(request.Context(), user.UserID)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderList(writer, request, webhooks, nil)
+}
+
+// userWebhook loads one of the user's webhooks. Other users' webhooks are
+// not found, as userVehicle has it.
+func userWebhook(ctx context.Context, tx db.Tx, user *auth.ClaimsUser, request *http.Request) (*db.Webhook, error) {
+	webhookId, err := db.ParseRowID(mux.Vars(request)["webhookId"])
+	if err != nil {
+		return nil, err
+	}
+
+	webhook, err := tx.GetWebhook(ctx, webhookId)
+	if err != nil {
+		return nil, err
+	}
+
+	if webhook.UserID != user.UserID {
+		return nil, &db.WebhookNotFoundError{WebhookID: webhookId}
+	}
+
+	return webhook, nil
+}
+
+func (s *server) getWebhook(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	webhook, err := userWebhook(request.Context(), s.store, user, request)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderJson(writer, webhook)
+}
+
+func (s *server) deleteWebhook(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	err := s.store.InTx(request.Context(), func(tx db.Tx) error {
+		webhook, err := userWebhook(request.Context(), tx, user, request)
+		if err != nil {
+			return err
+		}
+
+		return tx.DeleteWebhook(request.Context(), webhook.WebhookID)
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	writer.WriteHeader(204)
+}
+
+// pingWebhook sends a webhook.ping event to the webhook, to try it out.
+func (s *server) pingWebhook(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	var delivery *db.WebhookDelivery
+	err := s.store.InTx(request.Context(), func(tx db.Tx) error {
+		webhook, err := userWebhook(request.Context(), tx, user, request)
+		if err != nil {
+			return err
+		}
+
+		delivery, err = tx.PingWebhook(request.Context(), webhook.WebhookID)
+		return err
+	})
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderJson(writer, delivery)
+}
+
+func (s *server) listWebhookDeliveries(user *auth.ClaimsUser, writer http.ResponseWriter, request *http.Request) {
+	options, err := listOptions(request, "-created_at")
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	webhook, err := userWebhook(request.Context(), s.store, user, request)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	deliveries, next, err := s.store.ListWebhookDeliveries(request.Context(), webhook.WebhookID, options)
+	if err != nil {
+		renderError(writer, err)
+		return
+	}
+
+	renderList(writer, request, deliveries, next)
+}
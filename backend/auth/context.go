@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"context"
+	"vehicledb/db"
+)
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+// NewContext returns a copy of ctx carrying the authenticated user, who is
+// also recorded as the actor of any writes made with it.
+func NewContext(ctx context.Context, user *ClaimsUser) context.Context {
+	ctx = db.WithActor(ctx, user.UserID)
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// FromContext returns the authenticated user stored by NewContext, or nil.
+func FromContext(ctx context.Context) *ClaimsUser {
+	user, _ := ctx.Value(userContextKey).(*ClaimsUser)
+	return user
+}
@@ -9,12 +9,15 @@ import (
 
 var secretToken = []byte("sup3rs3cr3t")
 
+// TokenLifetime is how long a session token, and the cookie carrying it, stays valid.
+const TokenLifetime = time.Hour * 24
+
 func CreateToken(user *db.User) (string, error) {
 	claims := ClaimsUser{
 		EmailAddress: user.EmailAddress,
 		UserID:       user.UserId,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
+			ExpiresAt: time.Now().Add(TokenLifetime).Unix(),
 			Issuer:    "vehicledb",
 		},
 	}
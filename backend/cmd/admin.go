@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"vehicledb/db"
+)
+
+var grantAdminCmd = &cobra.Command{
+	Use:   "grant-admin <email address>",
+	Short: "Give an existing user access to the admin endpoints",
+	Args:  cobra.ExactArgs(1),
+	Run:   runGrantAdmin,
+}
+
+func init() {
+	rootCmd.AddCommand(grantAdminCmd)
+}
+
+func runGrantAdmin(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+
+	store, err := db.Open(database, storeOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	user, err := store.FindUserByEmailAddress(ctx, args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = store.GrantAdmin(ctx, user.UserId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = store.RecordSecurityEvent(ctx, &db.SecurityEvent{
+		EventType: db.EventAdminAction,
+		UserID:    &user.UserId,
+		IPAddress: "local",
+		UserAgent: "vehicledb grant-admin",
+		Details:   map[string]string{"action": "grant_admin"},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("%s is now an admin", user.EmailAddress)
+}
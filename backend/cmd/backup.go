@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"vehicledb/db"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup [file]",
+	Short: "Back up the database while the server is running",
+	Long: "Back up the database to the given file, or into --backupDir when no file is given, " +
+		"pruning old backups as the server does.",
+	Args: cobra.MaximumNArgs(1),
+	Run:  runBackup,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "Replace the database with a backup; stop the server first",
+	Args:  cobra.ExactArgs(1),
+	Run:   runRestore,
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func runBackup(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+
+	store, err := db.Connect(database, storeOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	if len(args) == 1 {
+		err = store.Backup(ctx, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Backed up database to %s", args[0])
+		return
+	}
+
+	if backupDir == "" {
+		log.Fatal("pass a file to back up to or set --backupDir")
+	}
+
+	backups, err := db.NewBackupSet(store, backupDir, backupKeep)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	backup, err := backups.Create(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Backed up database to %s", backups.Path(backup))
+}
+
+func runRestore(cmd *cobra.Command, args []string) {
+	replaced, err := db.RestoreSQLite(context.Background(), args[0], database)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if replaced != "" {
+		log.Printf("The previous database was moved to %s", replaced)
+	}
+	log.Printf("Restored %s; it will be migrated when the server next starts", args[0])
+}
+
+// backupForever backs up the database on every tick. It never returns; run
+// it in its own goroutine.
+func backupForever(backups *db.BackupSet, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		backup, err := backups.Create(context.Background())
+		if err != nil {
+			log.Printf("failed to back up database: %v", err)
+			continue
+		}
+
+		log.Printf("Backed up database to %s", backups.Path(backup))
+	}
+}
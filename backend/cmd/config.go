@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix starts the name of every environment variable that sets a flag,
+// e.g. VEHICLEDB_DATABASE for --database.
+const envPrefix = "VEHICLEDB_"
+
+var configFile = ""
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(
+		&configFile, "config", "", "a JSON file of flag values, keyed by flag name (also "+envPrefix+"CONFIG)",
+	)
+	rootCmd.PersistentPreRunE = loadConfig
+}
+
+// loadConfig fills in every flag that wasn't given on the command line from
+// its environment variable or, failing that, the config file. Flags given on
+// the command line always win.
+func loadConfig(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+
+	path := configFile
+	if !flags.Changed("config") {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	config, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		known[flag.Name] = true
+		if err != nil || flag.Changed || flag.Name == "config" {
+			return
+		}
+
+		if value, ok := os.LookupEnv(envName(flag.Name)); ok {
+			err = setFlag(flags, flag, []string{value})
+			if err != nil {
+				err = fmt.Errorf("invalid %s: %v", envName(flag.Name), err)
+			}
+			return
+		}
+
+		if values, ok := config[flag.Name]; ok {
+			err = setFlag(flags, flag, values)
+			if err != nil {
+				err = fmt.Errorf("invalid %s in %s: %v", flag.Name, path, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for name := range config {
+		if !known[name] {
+			return fmt.Errorf("unknown setting %s in %s", name, path)
+		}
+	}
+
+	return nil
+}
+
+// readConfigFile reads a JSON object of flag values. A value is a string,
+// number or boolean, or an array of them for flags that may be repeated.
+func readConfigFile(path string) (map[string][]string, error) {
+	config := make(map[string][]string)
+	if path == "" {
+		return config, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// numbers are kept as written, as 1048576 rather than 1.048576e+06, so
+	// that integer flags can parse them
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+	err = decoder.Decode(&raw)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("unexpected content after the settings")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	for name, value := range raw {
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			switch item.(type) {
+			case string, json.Number, bool:
+				values = append(values, fmt.Sprint(item))
+			default:
+				return nil, fmt.Errorf("%s in %s must be a string, number or boolean", name, path)
+			}
+		}
+		config[name] = values
+	}
+
+	return config, nil
+}
+
+// setFlag replaces a flag's default with values, as if each had been given
+// on the command line in turn.
+func setFlag(flags *pflag.FlagSet, flag *pflag.Flag, values []string) error {
+	for _, value := range values {
+		err := flags.Set(flag.Name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envName is the environment variable for a flag: sqliteBusyTimeout is set
+// by VEHICLEDB_SQLITE_BUSY_TIMEOUT.
+func envName(flagName string) string {
+	var name strings.Builder
+	name.WriteString(envPrefix)
+	for idx, r := range flagName {
+		if idx > 0 && unicode.IsUpper(r) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
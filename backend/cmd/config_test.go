@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vehicledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"database": "from-file.sqlite",
+		"listen": "0.0.0.0:80",
+		"queryTimeout": "1s",
+		"maxBodySize": 2000000,
+		"cookieSecure": true,
+		"cosOrigin": ["https://a.example", "https://b.example"]
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		database, listen string
+		timeout          time.Duration
+		origins          []string
+		maxBodySize      int64
+		cookieSecure     bool
+	)
+	cmd := &cobra.Command{Run: func(*cobra.Command, []string) {}}
+	flags := cmd.Flags()
+	flags.StringVar(&configFile, "config", "", "")
+	flags.StringVar(&database, "database", "db.sqlite", "")
+	flags.StringVar(&listen, "listen", "127.0.0.1:8000", "")
+	flags.DurationVar(&timeout, "queryTimeout", 5*time.Second, "")
+	flags.StringArrayVar(&origins, "cosOrigin", []string{"http://localhost:8080"}, "")
+	flags.Int64Var(&maxBodySize, "maxBodySize", 1<<20, "")
+	flags.BoolVar(&cookieSecure, "cookieSecure", false, "")
+	defer func() { configFile = "" }()
+
+	os.Setenv("VEHICLEDB_CONFIG", path)
+	os.Setenv("VEHICLEDB_QUERY_TIMEOUT", "2s")
+	defer os.Unsetenv("VEHICLEDB_CONFIG")
+	defer os.Unsetenv("VEHICLEDB_QUERY_TIMEOUT")
+
+	// the command line beats the environment, which beats the config file
+	err = flags.Parse([]string{"--listen", "127.0.0.1:9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadConfig(cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if listen != "127.0.0.1:9000" {
+		t.Fatalf("expected the command line listen address, got %s", listen)
+	}
+	if timeout != 2*time.Second {
+		t.Fatalf("expected the environment's query timeout, got %v", timeout)
+	}
+	if database != "from-file.sqlite" {
+		t.Fatalf("expected the config file's database, got %s", database)
+	}
+	if expected := []string{"https://a.example", "https://b.example"}; !reflect.DeepEqual(origins, expected) {
+		t.Fatalf("expected origins %v, got %v", expected, origins)
+	}
+
+	if maxBodySize != 2000000 || !cookieSecure {
+		t.Fatalf("expected the config file's numbers and booleans, got %d and %v", maxBodySize, cookieSecure)
+	}
+
+	// unknown settings are mistakes, not silently ignored
+	err = ioutil.WriteFile(path, []byte(`{"databse": "typo.sqlite"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadConfig(cmd, nil)
+	if err == nil {
+		t.Fatalf("expected an unknown setting to be refused")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for flag, expected := range map[string]string{
+		"database":          "VEHICLEDB_DATABASE",
+		"sqliteBusyTimeout": "VEHICLEDB_SQLITE_BUSY_TIMEOUT",
+	} {
+		if name := envName(flag); name != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, flag, name)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"vehicledb/db"
+)
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "migrate-down <version>",
+	Short: "Revert schema migrations until the database is at the given version",
+	Args:  cobra.ExactArgs(1),
+	Run:   runMigrateDown,
+}
+
+func init() {
+	rootCmd.AddCommand(migrateDownCmd)
+}
+
+func runMigrateDown(cmd *cobra.Command, args []string) {
+	target, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.Fatalf("invalid version '%s': %v", args[0], err)
+	}
+
+	ctx := context.Background()
+
+	store, err := db.Connect(database, storeOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	err = store.MigrateDown(ctx, target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Database is at schema version %d", version)
+}
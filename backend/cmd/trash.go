@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"vehicledb/db"
+)
+
+// trashPurgeInterval is how often the server looks for trash that has
+// outlived the retention period.
+const trashPurgeInterval = time.Hour
+
+// purgeTrashForever purges expired trash once at startup and then on every
+// tick. It never returns; run it in its own goroutine.
+func purgeTrashForever(store db.Store, retention time.Duration) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purgeTrash(store, retention)
+		<-ticker.C
+	}
+}
+
+func purgeTrash(store db.Store, retention time.Duration) {
+	purged, err := store.PurgeDeleted(context.Background(), time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("failed to purge trash: %v", err)
+		return
+	}
+
+	if purged > 0 {
+		log.Printf("Purged %d rows deleted more than %s ago", purged, retention)
+	}
+}
+
+// purgeIdempotencyKeysForever forgets idempotency keys once they're older
+// than the window they're kept for, on the same schedule as the trash.
+func purgeIdempotencyKeysForever(store db.Store, window time.Duration) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := store.PurgeIdempotencyKeys(context.Background(), time.Now().Add(-window))
+		if err != nil {
+			log.Printf("failed to purge idempotency keys: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d idempotency keys older than %s", purged, window)
+		}
+		<-ticker.C
+	}
+}
+
+// purgeChangeEventsForever forgets change events, and the log of their
+// webhook deliveries, once they're older than retention.
+func purgeChangeEventsForever(store db.Store, retention time.Duration) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := store.PurgeChangeEvents(context.Background(), time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("failed to purge change events: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d change events older than %s", purged, retention)
+		}
+		<-ticker.C
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"vehicledb/api"
 	"vehicledb/db"
 	"vehicledb/graph"
+	"vehicledb/webhooks"
 )
 
 var (
@@ -22,6 +24,27 @@ var (
 	}
 	corsOrigins []string
 	listen = ""
+	database = ""
+	queryTimeout time.Duration
+	cookieDomain = ""
+	cookieSecure = false
+	cookieSameSite = ""
+	trashRetention time.Duration
+	backupDir = ""
+	backupInterval time.Duration
+	backupKeep = 0
+	sqliteForeignKeys = false
+	sqliteJournalMode = ""
+	sqliteSynchronous = ""
+	sqliteBusyTimeout time.Duration
+	sqliteReaders = 0
+	maxBodySize int64
+	validateResponses = false
+	idempotencyWindow time.Duration
+	deliverWebhooks = false
+	webhookAllowedNetworks []string
+	redocScript = ""
+	eventRetention time.Duration
 )
 
 func init() {
@@ -32,6 +55,69 @@ func init() {
 	persistentFlags.StringVarP(
 		&listen, "listen", "l", "127.0.0.1:8000", "the host to listen for requests on",
 	)
+	persistentFlags.StringVarP(
+		&database, "database", "d", "db.sqlite", "the SQLite database: a file path, a sqlite:// or file: URL with connection parameters, a postgres:// URL, or memory for a throwaway in-memory database",
+	)
+	persistentFlags.BoolVar(
+		&sqliteForeignKeys, "sqliteForeignKeys", db.DefaultSQLiteOptions.ForeignKeys, "enforce foreign keys in SQLite",
+	)
+	persistentFlags.StringVar(
+		&sqliteJournalMode, "sqliteJournalMode", db.DefaultSQLiteOptions.JournalMode, "the SQLite journal mode (wal, delete, truncate, ...; empty for SQLite's default)",
+	)
+	persistentFlags.StringVar(
+		&sqliteSynchronous, "sqliteSynchronous", db.DefaultSQLiteOptions.Synchronous, "the SQLite synchronous level (off, normal, full or extra; empty for SQLite's default)",
+	)
+	persistentFlags.DurationVar(
+		&sqliteBusyTimeout, "sqliteBusyTimeout", db.DefaultSQLiteOptions.BusyTimeout, "how long SQLite waits on another connection's lock before giving up",
+	)
+	persistentFlags.IntVar(
+		&sqliteReaders, "sqliteReaders", db.DefaultSQLiteOptions.Readers, "how many read-only SQLite connections to pool alongside the single writer (0 for one shared pool)",
+	)
+	persistentFlags.DurationVar(
+		&queryTimeout, "queryTimeout", 5*time.Second, "how long a single database call may run before it's abandoned (0 for no limit)",
+	)
+	persistentFlags.StringVar(
+		&cookieDomain, "cookieDomain", "", "the domain attribute of the session cookies",
+	)
+	persistentFlags.BoolVar(
+		&cookieSecure, "cookieSecure", false, "only send session cookies over https",
+	)
+	persistentFlags.StringVar(
+		&cookieSameSite, "cookieSameSite", "lax", "the SameSite mode of the session cookies (lax, strict or none)",
+	)
+	persistentFlags.DurationVar(
+		&trashRetention, "trashRetention", 30*24*time.Hour, "how long deleted vehicles and accounts stay in the trash before they're purged (0 to keep them forever)",
+	)
+	persistentFlags.StringVar(
+		&backupDir, "backupDir", "", "the directory to write SQLite backups to (empty to disable backups)",
+	)
+	persistentFlags.DurationVar(
+		&backupInterval, "backupInterval", 24*time.Hour, "how often to back up the database when --backupDir is set (0 for on demand only)",
+	)
+	persistentFlags.IntVar(
+		&backupKeep, "backupKeep", 7, "how many backups to keep in --backupDir (0 to keep them all)",
+	)
+	persistentFlags.Int64Var(
+		&maxBodySize, "maxBodySize", api.DefaultOptions.MaxBodyBytes, "the largest request body accepted, in bytes (0 for no limit)",
+	)
+	persistentFlags.DurationVar(
+		&idempotencyWindow, "idempotencyWindow", api.DefaultOptions.IdempotencyWindow, "how long responses to create requests with an Idempotency-Key are kept for retries (0 to ignore the header)",
+	)
+	persistentFlags.BoolVar(
+		&deliverWebhooks, "webhooks", true, "deliver events to webhooks from this server (turn off on all but one of several servers sharing a database)",
+	)
+	persistentFlags.StringArrayVar(
+		&webhookAllowedNetworks, "webhookAllowedNetworks", nil, "a private network webhooks may deliver to, such as 127.0.0.0/8 for a receiver on this machine (others are refused)",
+	)
+	persistentFlags.DurationVar(
+		&eventRetention, "eventRetention", 7*24*time.Hour, "how long change events and their webhook delivery logs are kept (0 to keep them forever)",
+	)
+	persistentFlags.StringVar(
+		&redocScript, "redocScript", "", "a copy of Redoc's redoc.standalone.js to show the API docs at /v1/docs with (without it, the page links to the description)",
+	)
+	persistentFlags.BoolVar(
+		&validateResponses, "validateResponses", false, "check every response against the API description, failing those that don't match (for development)",
+	)
 }
 
 func Execute() {
@@ -41,14 +127,85 @@ func Execute() {
 	}
 }
 
+// storeOptions collects the database flags.
+func storeOptions() db.Options {
+	return db.Options{
+		QueryTimeout: queryTimeout,
+		SQLite: db.SQLiteOptions{
+			ForeignKeys: sqliteForeignKeys,
+			JournalMode: sqliteJournalMode,
+			Synchronous: sqliteSynchronous,
+			BusyTimeout: sqliteBusyTimeout,
+			Readers:     sqliteReaders,
+		},
+	}
+}
+
 func runApiServer(cmd *cobra.Command, args []string) {
-	db.OpenDatabase("db.sqlite")
+	store, err := db.Open(database, storeOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
 
-	schema, err := graph.GenerateSchema()
+	schema, err := graph.GenerateSchema(store)
 	if err != nil {
 		log.Fatal("Failed to generate schema", err)
 	}
-	handler := api.NewHandler(schema, corsOrigins)
+	sameSite, err := api.ParseSameSite(cookieSameSite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cookies := api.CookieOptions{
+		Domain:   cookieDomain,
+		Secure:   cookieSecure,
+		SameSite: sameSite,
+	}
+
+	if trashRetention > 0 {
+		go purgeTrashForever(store, trashRetention)
+	}
+
+	if idempotencyWindow > 0 {
+		go purgeIdempotencyKeysForever(store, idempotencyWindow)
+	}
+
+	if deliverWebhooks {
+		webhookOptions := webhooks.DefaultOptions
+		webhookOptions.AllowedNetworks, err = webhooks.ParseNetworks(webhookAllowedNetworks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go webhooks.NewDispatcher(store, webhookOptions).Run(context.Background())
+	}
+	if eventRetention > 0 {
+		go purgeChangeEventsForever(store, eventRetention)
+	}
+
+	var backups *db.BackupSet
+	if backupDir != "" {
+		backups, err = db.NewBackupSet(store, backupDir, backupKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if backupInterval > 0 {
+			go backupForever(backups, backupInterval)
+		}
+	}
+
+	options := api.DefaultOptions
+	options.MaxBodyBytes = maxBodySize
+	options.ValidateResponses = validateResponses
+	options.IdempotencyWindow = idempotencyWindow
+	if redocScript != "" {
+		_, err = os.Stat(redocScript)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.RedocScript = redocScript
+	}
+	handler := api.NewHandler(store, schema, corsOrigins, cookies, backups, options)
 
 	srv := &http.Server{
 		Handler: handler,
@@ -56,6 +213,8 @@ func runApiServer(cmd *cobra.Command, args []string) {
 
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout: 15 * time.Second,
+		// lets /v1/events outlast the timeouts
+		ConnContext: api.ConnContext,
 	}
 
 	log.Println("Serving on " + listen)
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,8 +12,11 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 	"vehicledb/api"
 	"vehicledb/db"
 	"vehicledb/graph"
@@ -19,20 +24,35 @@ import (
 
 var server *httptest.Server
 var client *http.Client
+var store *db.MemoryStore
 
 func TestMain(m *testing.M) {
 	// setup database
-	db.OpenDatabase("testing.sqlite")
-	defer func() { logError(db.CloseDatabase()) }()
+	store = db.NewMemoryStore()
+	defer func() { logError(store.Close()) }()
 
 	// setup schema
-	schema, err := graph.GenerateSchema()
+	schema, err := graph.GenerateSchema(store)
 	if err != nil {
 		log.Fatal("Failed to se up graph", err)
 	}
 
 	// setup global server
-	mux := api.NewHandler(schema)
+	options := api.DefaultOptions
+	options.ValidateResponses = true
+	options.EventPollInterval = 10 * time.Millisecond
+	options.EventHeartbeat = 50 * time.Millisecond
+	redoc, err := ioutil.TempFile("", "redoc-*.js")
+	if err != nil {
+		log.Fatal("Failed to set up Redoc", err)
+	}
+	_, err = redoc.WriteString("// redoc")
+	logError(redoc.Close())
+	if err != nil {
+		log.Fatal("Failed to set up Redoc", err)
+	}
+	options.RedocScript = redoc.Name()
+	mux := api.NewHandler(store, schema, nil, api.DefaultCookieOptions, nil, options)
 	server = httptest.NewServer(mux)
 	defer server.Close()
 
@@ -47,6 +67,7 @@ func TestMain(m *testing.M) {
 	result := m.Run()
 
 	// quit
+	logError(os.Remove(redoc.Name()))
 	os.Exit(result)
 }
 
@@ -67,7 +88,7 @@ func TestUserRoundTrip(t *testing.T) {
 
 	// get user
 	var getUserResponse db.User
-	makeApiRequest(t, "GET", fmt.Sprintf("/v1/users/%d/", createUserResponse.UserId), nil, &getUserResponse)
+	makeApiRequest(t, "GET", "/v1/users/me", nil, &getUserResponse)
 	if getUserResponse.UserId != createUserResponse.UserId {
 		t.Fatalf("Returned user id != created user id")
 	}
@@ -80,7 +101,7 @@ func TestUserRoundTrip(t *testing.T) {
 		EmailAddress: "joe@eventray.com",
 	}
 	var updateUserResponse db.User
-	makeApiRequest(t, "PATCH", fmt.Sprintf("/v1/users/%d/", createUserResponse.UserId), &updateUserRequest, &updateUserResponse)
+	makeApiRequest(t, "PATCH", "/v1/users/me", &updateUserRequest, &updateUserResponse)
 	if updateUserResponse.UserId != createUserResponse.UserId {
 		t.Fatalf("Returned user id != created user id")
 	}
@@ -90,7 +111,7 @@ func TestUserRoundTrip(t *testing.T) {
 
 	// delete user
 	var deleteUserResponse db.User
-	makeApiRequest(t, "DELETE", fmt.Sprintf("/v1/users/%d/", createUserResponse.UserId), nil, &deleteUserResponse)
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, &deleteUserResponse)
 }
 
 func TestVehicleRoundTrip(t *testing.T) {
@@ -171,6 +192,1107 @@ func TestVehicleRoundTrip(t *testing.T) {
 	}
 }
 
+func TestDuplicateEmailAddress(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "taken@djeebus.net", Password: "Password1"}, nil)
+
+	response := sendApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "Taken@DJEEBUS.net", Password: "Password1"}, nil)
+	if response.StatusCode != 409 {
+		t.Fatalf("expected 409 signing up with a taken address, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "untaken@djeebus.net", Password: "Password1"}, nil)
+	response = sendApiRequest(t, "PATCH", "/v1/users/me", &api.UpdateUserRequest{EmailAddress: "TAKEN@djeebus.net"}, nil)
+	if response.StatusCode != 409 {
+		t.Fatalf("expected 409 changing to a taken address, got %d", response.StatusCode)
+	}
+
+	// logging in ignores case too
+	makeApiRequest(t, "POST", "/v1/session", &api.LoginRequest{EmailAddress: "TAKEN@djeebus.net", Password: "Password1"}, nil)
+	var me db.User
+	makeApiRequest(t, "GET", "/v1/users/me", nil, &me)
+	if me.EmailAddress != "taken@djeebus.net" {
+		t.Fatalf("expected to log in as taken@djeebus.net, got %s", me.EmailAddress)
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	createUserRequest := api.CreateUserRequest{
+		EmailAddress: "csrf@djeebus.net",
+		Password:     "Password1",
+	}
+	makeApiRequest(t, "POST", "/v1/users/", &createUserRequest, nil)
+
+	updateUserRequest := api.UpdateUserRequest{
+		EmailAddress: "csrf2@djeebus.net",
+	}
+
+	// cookie auth without the csrf header is rejected
+	response := sendApiRequest(t, "PATCH", "/v1/users/me", &updateUserRequest, map[string]string{})
+	if response.StatusCode != 403 {
+		t.Fatalf("expected 403 without csrf token, got %d", response.StatusCode)
+	}
+
+	// cookie auth with the wrong csrf token is rejected
+	response = sendApiRequest(t, "PATCH", "/v1/users/me", &updateUserRequest, map[string]string{
+		"X-CSRF-Token": "nope",
+	})
+	if response.StatusCode != 403 {
+		t.Fatalf("expected 403 with bad csrf token, got %d", response.StatusCode)
+	}
+
+	// bearer auth doesn't need a csrf token
+	serverURL, _ := url.Parse(server.URL)
+	var token string
+	for _, cookie := range client.Jar.Cookies(serverURL) {
+		if cookie.Name == "auth" {
+			token = cookie.Value
+		}
+	}
+	response = sendApiRequest(t, "PATCH", "/v1/users/me", &updateUserRequest, map[string]string{
+		"Authorization": "Bearer " + token,
+	})
+	if response.StatusCode != 200 {
+		t.Fatalf("expected 200 with bearer token, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestDeletedAccountSessions(t *testing.T) {
+	serverURL, _ := url.Parse(server.URL)
+	authToken := func() string {
+		for _, cookie := range client.Jar.Cookies(serverURL) {
+			if cookie.Name == "auth" {
+				return cookie.Value
+			}
+		}
+		return ""
+	}
+	createVehicle := func(token string) int {
+		response := sendApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, map[string]string{
+			"Authorization": "Bearer " + token,
+		})
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	// deleting an account logs it out, and its token stops working
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "deleted-session@djeebus.net", Password: "Password1"}, nil)
+	token := authToken()
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+	if authToken() != "" {
+		t.Fatalf("expected deleting the account to clear the auth cookie")
+	}
+	if status := createVehicle(token); status != 401 {
+		t.Fatalf("expected 401 with a deleted account's token, got %d", status)
+	}
+
+	// nor does a purged account's
+	var purged db.User
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "purged-session@djeebus.net", Password: "Password1"}, &purged)
+	token = authToken()
+	err := store.PurgeUser(context.Background(), purged.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := createVehicle(token); status != 401 {
+		t.Fatalf("expected 401 with a purged account's token, got %d", status)
+	}
+}
+
+func TestSecurityEvents(t *testing.T) {
+	createUserRequest := api.CreateUserRequest{
+		EmailAddress: "audit@djeebus.net",
+		Password:     "Password1",
+	}
+	makeApiRequest(t, "POST", "/v1/users/", &createUserRequest, nil)
+	makeApiRequest(t, "DELETE", "/v1/session", nil, nil)
+
+	// a bad password is rejected and recorded
+	badLogin := api.LoginRequest{EmailAddress: createUserRequest.EmailAddress, Password: "wrong"}
+	response := sendApiRequest(t, "POST", "/v1/session", &badLogin, nil)
+	if response.StatusCode != 401 {
+		t.Fatalf("expected 401 for a bad password, got %d", response.StatusCode)
+	}
+
+	goodLogin := api.LoginRequest{EmailAddress: createUserRequest.EmailAddress, Password: createUserRequest.Password}
+	makeApiRequest(t, "POST", "/v1/session", &goodLogin, nil)
+
+	var page struct {
+		Items []db.SecurityEvent `json:"items"`
+	}
+	makeApiRequest(t, "GET", "/v1/users/me/security-events", nil, &page)
+	events := page.Items
+
+	expected := []string{db.EventLogin, db.EventLoginFailed, db.EventLogout, db.EventUserCreated}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d security events, got %d", len(expected), len(events))
+	}
+	for idx, eventType := range expected {
+		if events[idx].EventType != eventType {
+			t.Fatalf("event %d: expected %s, got %s", idx, eventType, events[idx].EventType)
+		}
+	}
+
+	// the global log is for admins only
+	response = sendApiRequest(t, "GET", "/v1/security-events", nil, nil)
+	if response.StatusCode != 403 {
+		t.Fatalf("expected 403 for a non-admin, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestTrash(t *testing.T) {
+	createUserRequest := api.CreateUserRequest{
+		EmailAddress: "trash@djeebus.net",
+		Password:     "Password1",
+	}
+	makeApiRequest(t, "POST", "/v1/users/", &createUserRequest, nil)
+
+	createVehicleRequest := api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &createVehicleRequest, &vehicle)
+	makeApiRequest(t, "DELETE", fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID), nil, nil)
+
+	var trash struct {
+		Items []db.Vehicle `json:"items"`
+	}
+	makeApiRequest(t, "GET", "/v1/trash", nil, &trash)
+	if len(trash.Items) != 1 || trash.Items[0].VehicleID != vehicle.VehicleID {
+		t.Fatalf("expected the deleted vehicle in the trash, got %+v", trash.Items)
+	}
+
+	var restored db.Vehicle
+	makeApiRequest(t, "POST", fmt.Sprintf("/v1/trash/vehicles/%d/restore", vehicle.VehicleID), nil, &restored)
+	if restored.VehicleID != vehicle.VehicleID || restored.DeletedAt != nil {
+		t.Fatalf("unexpected restored vehicle: %+v", restored)
+	}
+
+	// only vehicles in the trash can be purged
+	response := sendApiRequest(t, "DELETE", fmt.Sprintf("/v1/trash/vehicles/%d", vehicle.VehicleID), nil, nil)
+	if response.StatusCode != 404 {
+		t.Fatalf("expected 404 purging a vehicle that isn't in the trash, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID), nil, nil)
+	response = sendApiRequest(t, "DELETE", fmt.Sprintf("/v1/trash/vehicles/%d", vehicle.VehicleID), nil, nil)
+	if response.StatusCode != 204 {
+		t.Fatalf("expected 204 purging a vehicle, got %d", response.StatusCode)
+	}
+
+	trash.Items = nil
+	makeApiRequest(t, "GET", "/v1/trash", nil, &trash)
+	if len(trash.Items) != 0 {
+		t.Fatalf("expected the trash to be empty, got %+v", trash.Items)
+	}
+
+	// account trash is for admins only
+	response = sendApiRequest(t, "GET", "/v1/admin/trash/users", nil, nil)
+	if response.StatusCode != 403 {
+		t.Fatalf("expected 403 for a non-admin, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestAdminTrash(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "trash-admin@djeebus.net", Password: "Password1"}, nil)
+	var admin db.User
+	makeApiRequest(t, "GET", "/v1/users/me", nil, &admin)
+	err := store.GrantAdmin(context.Background(), admin.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only accounts in the trash can be restored, and only real ones purged
+	for _, request := range [][2]string{
+		{"POST", fmt.Sprintf("/v1/admin/users/%d/restore", admin.UserId)},
+		{"POST", "/v1/admin/users/999999/restore"},
+		{"DELETE", "/v1/admin/users/999999"},
+	} {
+		response := sendApiRequest(t, request[0], request[1], nil, nil)
+		response.Body.Close()
+		if response.StatusCode != 404 {
+			t.Fatalf("expected 404 for %s %s, got %d", request[0], request[1], response.StatusCode)
+		}
+	}
+
+	var events api.ListResponse
+	var logged []db.SecurityEvent
+	events.Items = &logged
+	makeApiRequest(t, "GET", "/v1/security-events", nil, &events)
+	for _, event := range logged {
+		if event.EventType == db.EventUserRestored || event.EventType == db.EventUserPurged {
+			t.Fatalf("expected nothing to be logged for what didn't happen, got %+v", event)
+		}
+	}
+
+	// an account that leaves a trail of its addresses in the security log
+	var leaving db.User
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "leaving@djeebus.net", Password: "Password1"}, &leaving)
+	makeApiRequest(t, "PATCH", "/v1/users/me", &api.UpdateUserRequest{EmailAddress: "left@djeebus.net"}, nil)
+	response := sendApiRequest(t, "POST", "/v1/session", &api.LoginRequest{EmailAddress: "left@djeebus.net", Password: "wrong"}, nil)
+	response.Body.Close()
+	if response.StatusCode != 401 {
+		t.Fatalf("expected the wrong password to be refused, got %d", response.StatusCode)
+	}
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+
+	// purging it leaves the events, but not the addresses
+	makeApiRequest(t, "POST", "/v1/session", &api.LoginRequest{EmailAddress: "trash-admin@djeebus.net", Password: "Password1"}, nil)
+	makeApiRequest(t, "DELETE", fmt.Sprintf("/v1/admin/users/%d", leaving.UserId), nil, nil)
+
+	var trail []db.SecurityEvent
+	path := "/v1/security-events?limit=200"
+	for path != "" {
+		var page []db.SecurityEvent
+		events = api.ListResponse{Items: &page}
+		makeApiRequest(t, "GET", path, nil, &events)
+		for _, event := range page {
+			if event.UserID != nil && *event.UserID == leaving.UserId {
+				trail = append(trail, event)
+			}
+		}
+		path = ""
+		if events.NextCursor != "" {
+			path = "/v1/security-events?limit=200&cursor=" + url.QueryEscape(events.NextCursor)
+		}
+	}
+	if len(trail) < 4 {
+		t.Fatalf("expected the purged account's events to be kept, got %+v", trail)
+	}
+	for _, event := range trail {
+		for name, value := range event.Details {
+			if strings.Contains(value, "@") {
+				t.Fatalf("expected no addresses in the purged account's events, found %s in %+v", name, event)
+			}
+		}
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestSearch(t *testing.T) {
+	createUserRequest := api.CreateUserRequest{
+		EmailAddress: "search@djeebus.net",
+		Password:     "Password1",
+	}
+	makeApiRequest(t, "POST", "/v1/users/", &createUserRequest, nil)
+
+	createVehicleRequest := api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &createVehicleRequest, &vehicle)
+
+	var page struct {
+		Items []db.SearchResult `json:"items"`
+	}
+	makeApiRequest(t, "GET", "/v1/search?q=chevy", nil, &page)
+	results := page.Items
+	if len(results) != 1 || results[0].ID != vehicle.VehicleID {
+		t.Fatalf("expected to find the vehicle, got %+v", results)
+	}
+
+	response := sendApiRequest(t, "GET", "/v1/search?q=", nil, nil)
+	if response.StatusCode != 400 {
+		t.Fatalf("expected 400 for an empty query, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestVehicleHistory(t *testing.T) {
+	createUserRequest := api.CreateUserRequest{
+		EmailAddress: "history@djeebus.net",
+		Password:     "Password1",
+	}
+	var user db.User
+	makeApiRequest(t, "POST", "/v1/users/", &createUserRequest, &user)
+
+	createVehicleRequest := api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &createVehicleRequest, &vehicle)
+
+	updateVehicleRequest := api.UpdateVehicleRequest{
+		Year:  &db.NullYear{Year: 2017, Valid: true},
+		Make:  &db.NullString{String: "Chevy", Valid: true},
+		Model: &db.NullString{String: "Commodore", Valid: true},
+	}
+	makeApiRequest(t, "PATCH", fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID), &updateVehicleRequest, nil)
+
+	var page struct {
+		Items []db.VehicleRevision `json:"items"`
+	}
+	makeApiRequest(t, "GET", fmt.Sprintf("/v1/vehicles/%d/history", vehicle.VehicleID), nil, &page)
+	revisions := page.Items
+	if len(revisions) != 2 || revisions[0].Action != db.RevisionUpdated || len(revisions[0].Changes) != 1 {
+		t.Fatalf("unexpected history: %+v", revisions)
+	}
+	if revisions[0].ActorID == nil || *revisions[0].ActorID != user.UserId {
+		t.Fatalf("expected the update to record who made it, got %v", revisions[0].ActorID)
+	}
+
+	// the vehicle was updated since version 1, so reverting that is stale
+	revertPath := fmt.Sprintf("/v1/vehicles/%d/history/%d/revert", vehicle.VehicleID, revisions[0].RevisionID)
+	response := sendApiRequest(t, "POST", revertPath, nil, withCSRF(map[string]string{"If-Match": `"1"`}))
+	response.Body.Close()
+	if response.StatusCode != 412 {
+		t.Fatalf("expected 412 reverting a stale vehicle, got %d", response.StatusCode)
+	}
+
+	response = sendApiRequest(t, "POST", revertPath, nil, withCSRF(map[string]string{"If-Match": `"2"`}))
+	var reverted db.Vehicle
+	err := json.NewDecoder(response.Body).Decode(&reverted)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 || response.Header.Get("ETag") != `"3"` || reverted.Model != "SS" {
+		t.Fatalf("expected the model to be reverted at version 3, got %d %q %s", response.StatusCode, response.Header.Get("ETag"), reverted.Model)
+	}
+
+	response = sendApiRequest(t, "POST", fmt.Sprintf("/v1/vehicles/%d/history/%d/revert", vehicle.VehicleID, revisions[1].RevisionID), nil, nil)
+	if response.StatusCode != 409 {
+		t.Fatalf("expected 409 reverting the creation of a vehicle, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestListVehiclesPages(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "pages@djeebus.net", Password: "Password1"}, nil)
+	for _, vehicle := range []api.CreateVehicleRequest{
+		{Year: 2017, Make: "Chevy", Model: "SS"},
+		{Year: 2011, Make: "BMW", Model: "550i"},
+		{Year: 2004, Make: "Holden", Model: "Monaro"},
+		{Year: 2014, Make: "Chevy", Model: "Volt"},
+	} {
+		vehicle := vehicle
+		makeApiRequest(t, "POST", "/v1/vehicles/", &vehicle, nil)
+	}
+
+	type page struct {
+		Items      []db.Vehicle `json:"items"`
+		NextCursor string       `json:"next_cursor"`
+	}
+
+	models := make([]string, 0)
+	path := "/v1/vehicles/?sort=-year&limit=3"
+	for path != "" {
+		response := sendApiRequest(t, "GET", path, nil, nil)
+		var body page
+		err := json.NewDecoder(response.Body).Decode(&body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, vehicle := range body.Items {
+			models = append(models, vehicle.Model)
+		}
+
+		path = ""
+		if link := response.Header.Get("Link"); link != "" {
+			if body.NextCursor == "" || !strings.HasSuffix(link, `>; rel="next"`) {
+				t.Fatalf("unexpected Link %q for cursor %q", link, body.NextCursor)
+			}
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	if strings.Join(models, ",") != "SS,Volt,550i,Monaro" {
+		t.Fatalf("unexpected vehicles by year: %v", models)
+	}
+
+	var filtered page
+	makeApiRequest(t, "GET", "/v1/vehicles/?make=chevy&year_from=2015", nil, &filtered)
+	if len(filtered.Items) != 1 || filtered.Items[0].Model != "SS" || filtered.NextCursor != "" {
+		t.Fatalf("unexpected filtered vehicles: %+v", filtered)
+	}
+
+	for _, path := range []string{"/v1/vehicles/?sort=color", "/v1/vehicles/?limit=0", "/v1/vehicles/?cursor=nope", "/v1/vehicles/?year_from=new"} {
+		response := sendApiRequest(t, "GET", path, nil, nil)
+		response.Body.Close()
+		if response.StatusCode != 400 {
+			t.Fatalf("expected 400 for %s, got %d", path, response.StatusCode)
+		}
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestErrorStatuses(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "owner@djeebus.net", Password: "Password1"}, nil)
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, &vehicle)
+
+	expectError := func(method string, path string, status int, code string) {
+		t.Helper()
+
+		response := sendApiRequest(t, method, path, nil, nil)
+		defer response.Body.Close()
+
+		var body map[string]interface{}
+		err := json.NewDecoder(response.Body).Decode(&body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != status || body["code"] != code {
+			t.Fatalf("expected %d %s for %s %s, got %d %v", status, code, method, path, response.StatusCode, body)
+		}
+		if response.Header.Get("Content-Type") != "application/problem+json" || body["status"] != float64(status) || body["request_id"] == nil {
+			t.Fatalf("expected a problem for %s %s, got %s %v", method, path, response.Header.Get("Content-Type"), body)
+		}
+	}
+
+	expectError("GET", "/v1/vehicles/999999", 404, "not_found")
+	expectError("GET", "/v1/vehicles/chevy", 404, "not_found")
+	expectError("GET", "/v1/nowhere", 404, "not_found")
+	expectError("PUT", "/v1/users/me", 405, "method_not_allowed")
+
+	// someone else's vehicle is indistinguishable from a missing one
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "snoop@djeebus.net", Password: "Password1"}, nil)
+	vehiclePath := fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID)
+	expectError("GET", vehiclePath, 404, "not_found")
+	expectError("DELETE", vehiclePath, 404, "not_found")
+
+	query := map[string]string{"query": fmt.Sprintf(`{ vehicle(vehicle_id: "%d") { model } }`, vehicle.VehicleID)}
+	var response struct {
+		Errors []struct {
+			Message    string                 `json:"message"`
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	makeApiRequest(t, "POST", "/v1/graphql", &query, &response)
+	if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "not_found" {
+		t.Fatalf("expected a not_found graphql error, got %+v", response.Errors)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+	makeApiRequest(t, "DELETE", "/v1/session", nil, nil)
+	expectError("GET", vehiclePath, 401, "unauthorized")
+}
+
+func TestETags(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "etags@djeebus.net", Password: "Password1"}, nil)
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, &vehicle)
+	vehiclePath := fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID)
+
+	response := sendApiRequest(t, "GET", vehiclePath, nil, nil)
+	response.Body.Close()
+	tag := response.Header.Get("ETag")
+	if tag != `"1"` {
+		t.Fatalf("expected ETag \"1\", got %q", tag)
+	}
+
+	response = sendApiRequest(t, "GET", vehiclePath, nil, map[string]string{"If-None-Match": tag})
+	response.Body.Close()
+	if response.StatusCode != 304 {
+		t.Fatalf("expected 304 for a current If-None-Match, got %d", response.StatusCode)
+	}
+
+	update := api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "Camaro"}
+	response = sendApiRequest(t, "PATCH", vehiclePath, &update, withCSRF(map[string]string{"If-Match": tag}))
+	response.Body.Close()
+	if response.StatusCode != 200 || response.Header.Get("ETag") != `"2"` {
+		t.Fatalf("expected 200 with ETag \"2\", got %d %q", response.StatusCode, response.Header.Get("ETag"))
+	}
+
+	// the other household member still has version 1
+	update.Model = "Impala"
+	response = sendApiRequest(t, "PATCH", vehiclePath, &update, withCSRF(map[string]string{"If-Match": tag}))
+	var body map[string]interface{}
+	err := json.NewDecoder(response.Body).Decode(&body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 412 || body["code"] != "precondition_failed" || body["current_version"] != float64(2) {
+		t.Fatalf("expected 412 precondition_failed at version 2, got %d %v", response.StatusCode, body)
+	}
+
+	response = sendApiRequest(t, "DELETE", vehiclePath, nil, withCSRF(map[string]string{"If-Match": tag}))
+	response.Body.Close()
+	if response.StatusCode != 412 {
+		t.Fatalf("expected 412 deleting a stale vehicle, got %d", response.StatusCode)
+	}
+
+	query := map[string]string{"query": fmt.Sprintf(
+		`mutation { updateVehicle(vehicle_id: "%d", expected_version: 1, model: "Impala") { version } }`, vehicle.VehicleID,
+	)}
+	var graphResponse struct {
+		Errors []struct {
+			Extensions map[string]interface{} `json:"extensions"`
+		} `json:"errors"`
+	}
+	makeApiRequest(t, "POST", "/v1/graphql", &query, &graphResponse)
+	if len(graphResponse.Errors) != 1 || graphResponse.Errors[0].Extensions["code"] != "precondition_failed" {
+		t.Fatalf("expected a precondition_failed graphql error, got %+v", graphResponse.Errors)
+	}
+
+	query = map[string]string{"query": fmt.Sprintf(
+		`mutation { updateVehicle(vehicle_id: "%d", expected_version: 2, model: "Impala") { model version } }`, vehicle.VehicleID,
+	)}
+	var updated struct {
+		Data struct {
+			UpdateVehicle struct {
+				Model   string `json:"model"`
+				Version int64  `json:"version"`
+			} `json:"updateVehicle"`
+		} `json:"data"`
+	}
+	makeApiRequest(t, "POST", "/v1/graphql", &query, &updated)
+	if updated.Data.UpdateVehicle.Model != "Impala" || updated.Data.UpdateVehicle.Version != 3 {
+		t.Fatalf("unexpected updated vehicle: %+v", updated.Data.UpdateVehicle)
+	}
+
+	response = sendApiRequest(t, "DELETE", vehiclePath, nil, withCSRF(map[string]string{"If-Match": `"3"`}))
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		t.Fatalf("expected 200 deleting the current version, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestBatch(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "batch@djeebus.net", Password: "Password1"}, nil)
+
+	// one bad vehicle doesn't hold up the others
+	var created api.BatchResponse
+	makeApiRequest(t, "POST", "/v1/vehicles/bulk", map[string]interface{}{
+		"vehicles": []interface{}{
+			map[string]interface{}{"year": 2017, "make": "Chevy", "model": "SS"},
+			map[string]interface{}{"year": "2018", "make": "Chevy"},
+			map[string]interface{}{"year": 2019, "make": "Chevy", "model": "Bolt"},
+		},
+	}, &created)
+	statuses := make([]int, 0, len(created.Results))
+	for _, result := range created.Results {
+		statuses = append(statuses, result.Status)
+	}
+	if fmt.Sprint(statuses) != "[200 400 200]" {
+		t.Fatalf("expected the second vehicle alone to fail, got %v", statuses)
+	}
+	if created.Results[1].Error == nil || created.Results[1].Error.Code != "invalid_request" {
+		t.Fatalf("expected the second vehicle to be invalid, got %+v", created.Results[1])
+	}
+
+	var vehicles api.ListResponse
+	var listed []db.Vehicle
+	vehicles.Items = &listed
+	makeApiRequest(t, "GET", "/v1/vehicles/?sort=year", nil, &vehicles)
+	if len(listed) != 2 {
+		t.Fatalf("expected 2 vehicles, got %d", len(listed))
+	}
+	ss, bolt := listed[0], listed[1]
+
+	// a stale delete rolls back the whole of an atomic batch
+	response := sendApiRequest(t, "POST", "/v1/batch", map[string]interface{}{
+		"atomic": true,
+		"operations": []interface{}{
+			map[string]interface{}{"method": "PATCH", "path": fmt.Sprintf("/v1/vehicles/%d", ss.VehicleID), "body": map[string]interface{}{"year": 2017, "make": "Chevy", "model": "Camaro"}},
+			map[string]interface{}{"method": "DELETE", "path": fmt.Sprintf("/v1/vehicles/%d", bolt.VehicleID), "if_match": `"7"`},
+		},
+	}, nil)
+	var failed struct {
+		Code    string            `json:"code"`
+		Results []api.BatchResult `json:"results"`
+	}
+	err := json.NewDecoder(response.Body).Decode(&failed)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 412 || failed.Code != "precondition_failed" || len(failed.Results) != 2 {
+		t.Fatalf("expected 412 precondition_failed with 2 results, got %d %+v", response.StatusCode, failed)
+	}
+	if failed.Results[0].Status != 424 || failed.Results[1].Status != 412 {
+		t.Fatalf("expected the update not applied and the delete failed, got %+v", failed.Results)
+	}
+
+	var vehicle db.Vehicle
+	makeApiRequest(t, "GET", fmt.Sprintf("/v1/vehicles/%d", ss.VehicleID), nil, &vehicle)
+	if vehicle.Model != "SS" || vehicle.Version != 1 {
+		t.Fatalf("expected the update to be rolled back, got %+v", vehicle)
+	}
+
+	var updated api.BatchResponse
+	makeApiRequest(t, "PATCH", "/v1/vehicles/bulk", map[string]interface{}{
+		"atomic": true,
+		"vehicles": []interface{}{
+			map[string]interface{}{"vehicle_id": ss.VehicleID, "if_match": `"1"`, "changes": map[string]interface{}{"year": 2017, "make": "Chevy", "model": "Camaro"}},
+			map[string]interface{}{"vehicle_id": bolt.VehicleID, "changes": map[string]interface{}{"year": 2020, "make": "Chevy", "model": "Bolt"}},
+		},
+	}, &updated)
+	if len(updated.Results) != 2 || updated.Results[0].Status != 200 || updated.Results[1].Status != 200 {
+		t.Fatalf("expected both updates to succeed, got %+v", updated.Results)
+	}
+
+	makeApiRequest(t, "GET", fmt.Sprintf("/v1/vehicles/%d", ss.VehicleID), nil, &vehicle)
+	if vehicle.Model != "Camaro" || vehicle.Version != 2 {
+		t.Fatalf("expected the update to be applied, got %+v", vehicle)
+	}
+}
+
+func TestPatchVehicle(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "patch@djeebus.net", Password: "Password1"}, nil)
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, &vehicle)
+	vehiclePath := fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID)
+
+	// fields that are left out are left alone
+	makeApiRequest(t, "PATCH", vehiclePath, map[string]interface{}{"model": "Camaro"}, &vehicle)
+	if vehicle.Year != 2017 || vehicle.Make != "Chevy" || vehicle.Model != "Camaro" {
+		t.Fatalf("expected only the model to change, got %+v", vehicle)
+	}
+
+	patch := func(contentType string, body interface{}) (int, map[string]interface{}) {
+		response := sendApiRequest(t, "PATCH", vehiclePath, body, withCSRF(map[string]string{"Content-Type": contentType}))
+		defer response.Body.Close()
+		var decoded map[string]interface{}
+		err := json.NewDecoder(response.Body).Decode(&decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode, decoded
+	}
+
+	status, body := patch("application/merge-patch+json", map[string]interface{}{"year": 2018})
+	if status != 200 || body["year"] != float64(2018) || body["model"] != "Camaro" {
+		t.Fatalf("expected a merge patch to change the year, got %d %v", status, body)
+	}
+
+	// a vehicle can't do without a make
+	status, body = patch("application/merge-patch+json", map[string]interface{}{"make": nil})
+	errors, _ := body["errors"].([]interface{})
+	if status != 400 || len(errors) != 1 || errors[0].(map[string]interface{})["pointer"] != "/make" {
+		t.Fatalf("expected removing the make to be invalid, got %d %v", status, body)
+	}
+
+	status, body = patch("application/json-patch+json", []interface{}{
+		map[string]interface{}{"op": "test", "path": "/model", "value": "Camaro"},
+		map[string]interface{}{"op": "replace", "path": "/model", "value": "Impala"},
+	})
+	if status != 200 || body["model"] != "Impala" || body["year"] != float64(2018) {
+		t.Fatalf("expected a JSON patch to change the model, got %d %v", status, body)
+	}
+
+	status, body = patch("application/json-patch+json", []interface{}{
+		map[string]interface{}{"op": "test", "path": "/model", "value": "Camaro"},
+	})
+	if status != 409 || body["code"] != "conflict" {
+		t.Fatalf("expected a failed test to conflict, got %d %v", status, body)
+	}
+
+	status, body = patch("text/plain", map[string]interface{}{"model": "SS"})
+	if status != 415 || body["code"] != "unsupported_media_type" {
+		t.Fatalf("expected text to be unsupported, got %d %v", status, body)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	// creating an account isn't replayed: the retry is the request again,
+	// which fails as the address is taken
+	signup := &api.CreateUserRequest{EmailAddress: "idempotency@djeebus.net", Password: "Password1"}
+	signedUp := sendApiRequest(t, "POST", "/v1/users/", signup, map[string]string{"Idempotency-Key": "signup"})
+	signedUp.Body.Close()
+	if signedUp.StatusCode != 200 || len(signedUp.Cookies()) == 0 {
+		t.Fatalf("expected the account to be created and logged in to, got %d", signedUp.StatusCode)
+	}
+	retried := sendApiRequest(t, "POST", "/v1/users/", signup, map[string]string{"Idempotency-Key": "signup"})
+	retried.Body.Close()
+	if retried.StatusCode != 409 || retried.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected the retry to be made again rather than replayed, got %d %v", retried.StatusCode, retried.Header)
+	}
+
+	create := func(key string, request *api.CreateVehicleRequest) (*http.Response, map[string]interface{}) {
+		response := sendApiRequest(t, "POST", "/v1/vehicles/", request, withCSRF(map[string]string{"Idempotency-Key": key}))
+		defer response.Body.Close()
+		var decoded map[string]interface{}
+		err := json.NewDecoder(response.Body).Decode(&decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, decoded
+	}
+
+	first, created := create("first", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"})
+	if first.StatusCode != 200 || first.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected the vehicle to be created, got %d %v", first.StatusCode, created)
+	}
+
+	// a retry gets the same vehicle, rather than another
+	retry, replayed := create("first", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"})
+	if retry.StatusCode != 200 || retry.Header.Get("Idempotent-Replayed") != "true" || replayed["vehicle_id"] != created["vehicle_id"] {
+		t.Fatalf("expected the first response again, got %d %v", retry.StatusCode, replayed)
+	}
+	if retry.Header.Get("ETag") != first.Header.Get("ETag") || retry.Header.Get("Content-Type") != first.Header.Get("Content-Type") {
+		t.Fatalf("expected the first response's headers again, got %v", retry.Header)
+	}
+
+	reused, body := create("first", &api.CreateVehicleRequest{Year: 2018, Make: "Chevy", Model: "Bolt"})
+	if reused.StatusCode != 422 || body["code"] != "idempotency_key_reused" {
+		t.Fatalf("expected a key reused for another vehicle to be refused, got %d %v", reused.StatusCode, body)
+	}
+
+	// without a key, every request counts
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, nil)
+
+	var vehicles api.ListResponse
+	var listed []db.Vehicle
+	vehicles.Items = &listed
+	makeApiRequest(t, "GET", "/v1/vehicles/", nil, &vehicles)
+	if len(listed) != 2 {
+		t.Fatalf("expected 2 vehicles, got %d", len(listed))
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestWebhooks(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "webhooks@djeebus.net", Password: "Password1"}, nil)
+
+	var webhook db.Webhook
+	makeApiRequest(t, "POST", "/v1/webhooks/", &api.CreateWebhookRequest{
+		URL:    "http://127.0.0.1:9000/hooks",
+		Events: []string{db.ChangeVehicleCreated, db.ChangeVehicleUpdated},
+	}, &webhook)
+	if !strings.HasPrefix(webhook.Secret, "whsec_") {
+		t.Fatalf("expected the secret to be returned on create, got %+v", webhook)
+	}
+	webhookPath := fmt.Sprintf("/v1/webhooks/%d", webhook.WebhookID)
+
+	var got db.Webhook
+	makeApiRequest(t, "GET", webhookPath, nil, &got)
+	if got.URL != webhook.URL || got.Secret != "" {
+		t.Fatalf("expected the webhook without its secret, got %+v", got)
+	}
+
+	for _, invalid := range []api.CreateWebhookRequest{
+		{URL: "/hooks", Events: []string{db.ChangeVehicleCreated}},
+		{URL: "ftp://127.0.0.1/", Events: []string{db.ChangeVehicleCreated}},
+		{URL: "http://127.0.0.1/", Events: []string{"fuel.added"}},
+		{URL: "http://127.0.0.1/", Events: []string{}},
+	} {
+		response := sendApiRequest(t, "POST", "/v1/webhooks/", &invalid, withCSRF(map[string]string{}))
+		response.Body.Close()
+		if response.StatusCode != 400 {
+			t.Fatalf("expected %+v to be refused, got %d", invalid, response.StatusCode)
+		}
+	}
+
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, &vehicle)
+	makeApiRequest(t, "DELETE", fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID), nil, nil)
+
+	var ping db.WebhookDelivery
+	makeApiRequest(t, "POST", webhookPath+"/ping", nil, &ping)
+	if ping.EventType != db.ChangeWebhookPing || ping.State != db.DeliveryPending {
+		t.Fatalf("expected a pending ping, got %+v", ping)
+	}
+
+	// vehicle.deleted isn't subscribed to
+	var deliveries api.ListResponse
+	var listed []db.WebhookDelivery
+	deliveries.Items = &listed
+	makeApiRequest(t, "GET", webhookPath+"/deliveries", nil, &deliveries)
+	if len(listed) != 2 || listed[0].EventType != db.ChangeWebhookPing || listed[1].EventType != db.ChangeVehicleCreated {
+		t.Fatalf("expected the ping and vehicle.created, newest first, got %+v", listed)
+	}
+
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "webhooks-snoop@djeebus.net", Password: "Password1"}, nil)
+	for _, request := range [][2]string{{"GET", webhookPath}, {"GET", webhookPath + "/deliveries"}, {"POST", webhookPath + "/ping"}, {"DELETE", webhookPath}} {
+		response := sendApiRequest(t, request[0], request[1], nil, withCSRF(map[string]string{}))
+		response.Body.Close()
+		if response.StatusCode != 404 {
+			t.Fatalf("expected someone else's webhook to be not found for %s %s, got %d", request[0], request[1], response.StatusCode)
+		}
+	}
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+
+	makeApiRequest(t, "POST", "/v1/session", &api.LoginRequest{EmailAddress: "webhooks@djeebus.net", Password: "Password1"}, nil)
+	makeApiRequest(t, "DELETE", webhookPath, nil, nil)
+	var webhooks api.ListResponse
+	var remaining []db.Webhook
+	webhooks.Items = &remaining
+	makeApiRequest(t, "GET", "/v1/webhooks/", nil, &webhooks)
+	if len(remaining) != 0 {
+		t.Fatalf("expected the webhook to be deleted, got %+v", remaining)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestEvents(t *testing.T) {
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "events@djeebus.net", Password: "Password1"}, nil)
+
+	events := openEvents(t, server.URL, "")
+	if events.response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", events.response.Header.Get("Content-Type"))
+	}
+	start := events.next()
+	if start.ID == "" || start.Event != "" {
+		t.Fatalf("expected the stream to start with an id to resume from, got %+v", start)
+	}
+
+	// someone else's changes aren't streamed
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "events-snoop@djeebus.net", Password: "Password1"}, nil)
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2011, Make: "BMW", Model: "550i"}, nil)
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+	makeApiRequest(t, "POST", "/v1/session", &api.LoginRequest{EmailAddress: "events@djeebus.net", Password: "Password1"}, nil)
+
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, &vehicle)
+
+	created := events.nextEvent()
+	var event db.ChangeEvent
+	err := json.Unmarshal([]byte(created.Data), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Event != db.ChangeVehicleCreated || event.ResourceID != vehicle.VehicleID || created.ID != event.EventID.String() {
+		t.Fatalf("expected vehicle.created for the vehicle, got %+v", created)
+	}
+	if heartbeat := events.next(); heartbeat.Comment != "heartbeat" {
+		t.Fatalf("expected a heartbeat while there's nothing to send, got %+v", heartbeat)
+	}
+	events.close()
+
+	// EventSource sends the last id it saw when it reconnects
+	makeApiRequest(t, "DELETE", fmt.Sprintf("/v1/vehicles/%d", vehicle.VehicleID), nil, nil)
+	resumed := openEvents(t, server.URL, created.ID)
+	if deleted := resumed.nextEvent(); deleted.Event != db.ChangeVehicleDeleted {
+		t.Fatalf("expected to resume with vehicle.deleted, got %+v", deleted)
+	}
+	resumed.close()
+
+	// events that aren't kept can't be resumed from
+	forgotten := openEvents(t, server.URL, "999999999")
+	if reset := forgotten.nextEvent(); reset.Event != "reset" || reset.ID == "" {
+		t.Fatalf("expected a reset, got %+v", reset)
+	}
+	forgotten.close()
+
+	response := sendApiRequest(t, "GET", "/v1/events", nil, map[string]string{"Last-Event-ID": "latest"})
+	response.Body.Close()
+	if response.StatusCode != 400 {
+		t.Fatalf("expected an invalid Last-Event-ID to be refused, got %d", response.StatusCode)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestEventsOutlastTimeouts(t *testing.T) {
+	timed := httptest.NewUnstartedServer(server.Config.Handler)
+	timed.Config.ReadTimeout = 100 * time.Millisecond
+	timed.Config.WriteTimeout = 100 * time.Millisecond
+	timed.Config.ConnContext = api.ConnContext
+	timed.Start()
+	defer timed.Close()
+
+	makeApiRequest(t, "POST", "/v1/users/", &api.CreateUserRequest{EmailAddress: "events-timeouts@djeebus.net", Password: "Password1"}, nil)
+
+	events := openEvents(t, timed.URL, "")
+	events.next()
+	time.Sleep(300 * time.Millisecond)
+
+	makeApiRequest(t, "POST", "/v1/vehicles/", &api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}, nil)
+	if created := events.nextEvent(); created.Event != db.ChangeVehicleCreated {
+		t.Fatalf("expected the stream to still be open, got %+v", created)
+	}
+	events.close()
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+func TestOpenAPI(t *testing.T) {
+	var description struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	makeApiRequest(t, "GET", "/v1/openapi.json", nil, &description)
+
+	if description.OpenAPI != "3.1.0" {
+		t.Fatalf("expected an OpenAPI 3.1 description, got %q", description.OpenAPI)
+	}
+	updateVehicle := description.Paths["/v1/vehicles/{vehicleId}"]["patch"]
+	if updateVehicle["operationId"] != "updateVehicle" || updateVehicle["requestBody"] == nil {
+		t.Fatalf("expected updateVehicle to be described with its request body, got %+v", updateVehicle)
+	}
+	if _, ok := description.Paths["/v1/vehicles/"]["get"]; !ok {
+		t.Fatalf("expected listVehicles to be described, got %v", description.Paths["/v1/vehicles/"])
+	}
+	if _, ok := description.Components.Schemas["Vehicle"].Properties["version"]; !ok {
+		t.Fatalf("expected the Vehicle model to be described, got %+v", description.Components.Schemas["Vehicle"])
+	}
+
+	response := sendApiRequest(t, "GET", "/v1/docs", nil, nil)
+	page, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 || !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("expected the docs page, got %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(page), `<script src="/v1/docs/redoc.standalone.js">`) || strings.Contains(string(page), "https://") {
+		t.Fatalf("expected the docs page to load Redoc from the server, got %s", page)
+	}
+
+	response = sendApiRequest(t, "GET", "/v1/docs/redoc.standalone.js", nil, nil)
+	script, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 || string(script) != "// redoc" {
+		t.Fatalf("expected the copy of Redoc, got %d %s", response.StatusCode, script)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	createUserRequest := api.CreateUserRequest{
+		EmailAddress: "graph@djeebus.net",
+		Password:     "Password1",
+	}
+	makeApiRequest(t, "POST", "/v1/users/", &createUserRequest, nil)
+
+	createVehicleRequest := api.CreateVehicleRequest{Year: 2017, Make: "Chevy", Model: "SS"}
+	var vehicle db.Vehicle
+	makeApiRequest(t, "POST", "/v1/vehicles/", &createVehicleRequest, &vehicle)
+
+	// a link with only the cookie can read, but not change anything
+	read := sendApiRequest(t, "GET", "/v1/graphql?query="+url.QueryEscape("{ vehicles { model } }"), nil, map[string]string{})
+	read.Body.Close()
+	if read.StatusCode != 200 {
+		t.Fatalf("expected a query sent with GET to run, got %d", read.StatusCode)
+	}
+	mutation := fmt.Sprintf(`mutation { deleteVehicle(vehicle_id: "%d") { vehicle_id } }`, vehicle.VehicleID)
+	refused := sendApiRequest(t, "GET", "/v1/graphql?query="+url.QueryEscape(mutation), nil, map[string]string{})
+	refused.Body.Close()
+	if refused.StatusCode != 405 {
+		t.Fatalf("expected a mutation sent with GET to be refused, got %d", refused.StatusCode)
+	}
+
+	query := map[string]string{"query": "{ me { email_address } vehicles { year make model } }"}
+	var response struct {
+		Data struct {
+			Me struct {
+				EmailAddress string `json:"email_address"`
+			} `json:"me"`
+			Vehicles []db.Vehicle `json:"vehicles"`
+		} `json:"data"`
+	}
+	makeApiRequest(t, "POST", "/v1/graphql", &query, &response)
+
+	if response.Data.Me.EmailAddress != createUserRequest.EmailAddress {
+		t.Fatalf("expected me to be %s, got %s", createUserRequest.EmailAddress, response.Data.Me.EmailAddress)
+	}
+	if len(response.Data.Vehicles) != 1 || response.Data.Vehicles[0].Model != "SS" {
+		t.Fatalf("unexpected vehicles: %+v", response.Data.Vehicles)
+	}
+
+	makeApiRequest(t, "DELETE", "/v1/users/me", nil, nil)
+}
+
+// sentEvent is one block of an event stream: an event, or just a comment.
+type sentEvent struct {
+	ID      string
+	Event   string
+	Data    string
+	Comment string
+}
+
+// eventReader reads an event stream opened with the shared cookie jar.
+type eventReader struct {
+	t        *testing.T
+	response *http.Response
+	lines    *bufio.Scanner
+	close    context.CancelFunc
+}
+
+func openEvents(t *testing.T, baseURL string, lastEventID string) *eventReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequest("GET", baseURL+"/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request = request.WithContext(ctx)
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("expected an event stream, got %d", response.StatusCode)
+	}
+
+	return &eventReader{t: t, response: response, lines: bufio.NewScanner(response.Body), close: cancel}
+}
+
+// next reads the next block of the stream, giving up after a few seconds.
+func (events *eventReader) next() sentEvent {
+	events.t.Helper()
+	timer := time.AfterFunc(5*time.Second, events.close)
+	defer timer.Stop()
+
+	var event sentEvent
+	for events.lines.Scan() {
+		line := events.lines.Text()
+		if line == "" {
+			return event
+		}
+		field, value := line, ""
+		if idx := strings.Index(line, ":"); idx >= 0 {
+			field, value = line[:idx], strings.TrimPrefix(line[idx+1:], " ")
+		}
+		switch field {
+		case "":
+			event.Comment = value
+		case "id":
+			event.ID = value
+		case "event":
+			event.Event = value
+		case "data":
+			event.Data = value
+		}
+	}
+	events.t.Fatalf("the event stream ended: %v", events.lines.Err())
+	return event
+}
+
+// nextEvent reads the next event, skipping heartbeats.
+func (events *eventReader) nextEvent() sentEvent {
+	events.t.Helper()
+	for {
+		event := events.next()
+		if event.Comment == "" {
+			return event
+		}
+	}
+}
+
+// withCSRF adds the CSRF token to headers, which sendApiRequest only sends
+// by itself without any.
+func withCSRF(headers map[string]string) map[string]string {
+	serverURL, _ := url.Parse(server.URL)
+	for _, cookie := range client.Jar.Cookies(serverURL) {
+		if cookie.Name == "csrf_token" {
+			headers["X-CSRF-Token"] = cookie.Value
+		}
+	}
+	return headers
+}
+
 func jsonToReader(model interface{}) (*bytes.Reader, error) {
 	buf, err := json.Marshal(model)
 	if err != nil {
@@ -185,7 +1307,9 @@ func jsonToReader(model interface{}) (*bytes.Reader, error) {
 	return r, nil
 }
 
-func makeApiRequest(t *testing.T, method string, path string, requestBody interface{}, responseBody interface{}) {
+// sendApiRequest sends a request using the shared cookie jar. When headers is
+// nil the CSRF token from the jar is echoed back the way the frontend does.
+func sendApiRequest(t *testing.T, method string, path string, requestBody interface{}, headers map[string]string) *http.Response {
 	var err error
 	t.Logf("API request: %s %s\n", method, path)
 
@@ -208,6 +1332,13 @@ func makeApiRequest(t *testing.T, method string, path string, requestBody interf
 	cookies := client.Jar.Cookies(req.URL)
 	for _, cookie := range cookies {
 		req.AddCookie(cookie)
+		if headers == nil && cookie.Name == "csrf_token" {
+			req.Header.Set("X-CSRF-Token", cookie.Value)
+		}
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
 	}
 
 	response, err := client.Do(req)
@@ -217,6 +1348,12 @@ func makeApiRequest(t *testing.T, method string, path string, requestBody interf
 
 	t.Logf("API request: %s %s [%d]", method, path, response.StatusCode)
 
+	return response
+}
+
+func makeApiRequest(t *testing.T, method string, path string, requestBody interface{}, responseBody interface{}) {
+	response := sendApiRequest(t, method, path, requestBody, nil)
+
 	if response.StatusCode >= 400 {
 		bodyBytes, err := ioutil.ReadAll(response.Body)
 		if err != nil {
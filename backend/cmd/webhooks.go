@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"vehicledb/webhooks"
+)
+
+var receiveWebhooksCmd = &cobra.Command{
+	Use:   "receive-webhooks <secret>",
+	Short: "Print the webhook deliveries posted to a local address, for trying webhooks out",
+	Long: "Listen for webhook deliveries, check that they're signed with the given secret and print them. " +
+		"Create a webhook with the address as its url, e.g. http://127.0.0.1:9000/, and ping it. " +
+		"Answer with --status 500 to watch failed deliveries being retried.",
+	Args: cobra.ExactArgs(1),
+	Run:  runReceiveWebhooks,
+}
+
+var (
+	receiverAddress = ""
+	receiverStatus  = 0
+)
+
+// signatureTolerance is how long after it's signed a delivery is accepted.
+const signatureTolerance = 5 * time.Minute
+
+func init() {
+	rootCmd.AddCommand(receiveWebhooksCmd)
+
+	flags := receiveWebhooksCmd.Flags()
+	flags.StringVar(&receiverAddress, "address", "127.0.0.1:9000", "the address to listen for deliveries on")
+	flags.IntVar(&receiverStatus, "status", http.StatusNoContent, "the status to answer deliveries with")
+}
+
+func runReceiveWebhooks(cmd *cobra.Command, args []string) {
+	secret := args[0]
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = webhooks.Verify(secret, r.Header.Get(webhooks.SignatureHeader), body, time.Now(), signatureTolerance)
+		if err != nil {
+			log.Printf("refused delivery %s: %v", r.Header.Get(webhooks.DeliveryHeader), err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		log.Printf("delivery %s, %s: %s", r.Header.Get(webhooks.DeliveryHeader), r.Header.Get(webhooks.EventHeader), body)
+		w.WriteHeader(receiverStatus)
+	})
+
+	log.Println("Receiving webhooks on " + receiverAddress)
+	log.Fatal(http.ListenAndServe(receiverAddress, handler))
+}
@@ -0,0 +1,336 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrBackupUnsupported is returned when backing up a store that isn't a
+// SQLite database. Postgres deployments are expected to use pg_dump or their
+// provider's snapshots.
+var ErrBackupUnsupported = errors.New("online backups are only supported for SQLite databases")
+
+const (
+	// backupStepPages is how many pages a backup copies at a time; writers
+	// are only held up while a step runs.
+	backupStepPages = 256
+	backupStepPause = 10 * time.Millisecond
+
+	backupPrefix     = "vehicledb-"
+	backupSuffix     = ".sqlite"
+	backupTimeFormat = "20060102T150405.000Z"
+)
+
+// Backuper is a store that can copy itself while it's in use.
+type Backuper interface {
+	Backup(ctx context.Context, path string) error
+}
+
+// Backup copies a consistent snapshot of the live database to path using
+// SQLite's online backup API, so the server keeps serving while it runs. The
+// copy is written next to path and renamed into place, so path never holds a
+// partial backup.
+func (s *SQLStore) Backup(ctx context.Context, path string) error {
+	if s.dialect != sqliteDialect {
+		return ErrBackupUnsupported
+	}
+
+	tmpPath := path + ".tmp"
+	err := copySQLite(ctx, s.path, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move backup into place: %w", err)
+	}
+
+	return nil
+}
+
+// copySQLite copies the SQLite database at srcPath over destPath a few pages
+// at a time. If the source changes mid-copy SQLite starts over, so the result
+// is always a snapshot of a single point in time.
+func copySQLite(ctx context.Context, srcPath string, destPath string) error {
+	driver := &sqlite3.SQLiteDriver{}
+
+	src, err := driver.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", srcPath, err)
+	}
+	defer src.Close()
+
+	dest, err := driver.Open(destPath)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", destPath, err)
+	}
+	defer dest.Close()
+
+	backup, err := dest.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return fmt.Errorf("failed to start backup: %w", err)
+	}
+
+	for {
+		err = ctx.Err()
+		if err != nil {
+			backup.Finish()
+			return fmt.Errorf("backup abandoned: %w", err)
+		}
+
+		done, err := backup.Step(backupStepPages)
+		if err != nil {
+			backup.Finish()
+			return fmt.Errorf("failed to copy database: %w", err)
+		}
+		if done {
+			break
+		}
+
+		time.Sleep(backupStepPause)
+	}
+
+	err = backup.Finish()
+	if err != nil {
+		return fmt.Errorf("failed to finish backup: %w", err)
+	}
+
+	return nil
+}
+
+// BackupInfo describes one file in a BackupSet.
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupSet is a directory of timestamped backups of one store. Creating a
+// backup prunes the oldest ones so that at most keep remain.
+type BackupSet struct {
+	store Backuper
+	dir   string
+	keep  int
+
+	// mu keeps scheduled and on-demand backups from pruning each other's
+	// files mid-write
+	mu sync.Mutex
+}
+
+// NewBackupSet creates dir if needed. keep <= 0 keeps every backup.
+func NewBackupSet(store Store, dir string, keep int) (*BackupSet, error) {
+	backuper, ok := store.(Backuper)
+	if !ok {
+		return nil, ErrBackupUnsupported
+	}
+	if sqlStore, ok := store.(*SQLStore); ok && sqlStore.dialect != sqliteDialect {
+		return nil, ErrBackupUnsupported
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	return &BackupSet{store: backuper, dir: dir, keep: keep}, nil
+}
+
+// Create writes a new backup and prunes old ones.
+func (b *BackupSet) Create(ctx context.Context) (*BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// backups taken in the same millisecond would otherwise overwrite
+	// each other
+	createdAt := time.Now().UTC().Truncate(time.Millisecond)
+	var name, path string
+	for {
+		name = backupPrefix + createdAt.Format(backupTimeFormat) + backupSuffix
+		path = filepath.Join(b.dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		createdAt = createdAt.Add(time.Millisecond)
+	}
+
+	err := b.store.Backup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup: %w", err)
+	}
+
+	err = b.prune()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupInfo{Name: name, Size: info.Size(), CreatedAt: createdAt}, nil
+}
+
+// List returns the backups in the directory, newest first.
+func (b *BackupSet) List() ([]*BackupInfo, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	backups := make([]*BackupInfo, 0)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+
+		createdAt, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, &BackupInfo{Name: name, Size: file.Size(), CreatedAt: createdAt})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+
+	return backups, nil
+}
+
+// Path returns the file a listed backup is stored in.
+func (b *BackupSet) Path(backup *BackupInfo) string {
+	return filepath.Join(b.dir, backup.Name)
+}
+
+func (b *BackupSet) prune() error {
+	if b.keep <= 0 {
+		return nil
+	}
+
+	backups, err := b.List()
+	if err != nil {
+		return err
+	}
+
+	for idx := b.keep; idx < len(backups); idx++ {
+		log.Printf("Removing old backup %s", backups[idx].Name)
+		err = os.Remove(b.Path(backups[idx]))
+		if err != nil {
+			return fmt.Errorf("failed to remove old backup: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// BackupVersion checks that the file at path is an intact vehicledb database
+// and returns its schema version, without modifying it.
+func BackupVersion(ctx context.Context, path string) (int, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	sqlDb, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer sqlDb.Close()
+
+	var integrity string
+	err = sqlDb.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&integrity)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check backup: %w", err)
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("backup failed its integrity check: %s", integrity)
+	}
+
+	var version sql.NullInt64
+	err = sqlDb.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if err != nil || !version.Valid {
+		return 0, fmt.Errorf("'%s' is not a vehicledb database", path)
+	}
+
+	return int(version.Int64), nil
+}
+
+// RestoreSQLite replaces the SQLite database named by dsn with a backup and
+// returns where the database it replaced was moved to, if there was one. The
+// backup must be intact and no newer than this binary; an older one is
+// migrated the next time the server starts. The server must be stopped
+// while this runs.
+func RestoreSQLite(ctx context.Context, backupPath string, dsn string) (string, error) {
+	if isPostgresDSN(dsn) {
+		return "", ErrBackupUnsupported
+	}
+
+	if IsMemoryDSN(dsn) {
+		return "", ErrBackupUnsupported
+	}
+
+	dbPath, _, err := parseSQLiteDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	dbPath, err = filepath.Abs(dbPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to find abs path for %s: %v", dsn, err)
+	}
+
+	version, err := BackupVersion(ctx, backupPath)
+	if err != nil {
+		return "", err
+	}
+	if latest := sqliteDialect.latestVersion(); version > latest {
+		return "", &SchemaTooNewError{DatabaseVersion: version, BinaryVersion: latest}
+	}
+	log.Printf("Restoring %s (schema version %d) to %s", backupPath, version, dbPath)
+
+	restoringPath := dbPath + ".restoring"
+	os.Remove(restoringPath)
+	err = copySQLite(ctx, backupPath, restoringPath)
+	if err != nil {
+		os.Remove(restoringPath)
+		return "", err
+	}
+
+	// move the current database aside along with its journal files, which
+	// would otherwise be replayed into the restored one
+	replacedPath := ""
+	if _, err := os.Stat(dbPath); err == nil {
+		replacedPath = fmt.Sprintf("%s.pre-restore-%s.bak", dbPath, time.Now().UTC().Format("20060102T150405"))
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			err = os.Rename(dbPath+suffix, replacedPath+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				os.Remove(restoringPath)
+				return "", fmt.Errorf("failed to move the current database aside: %w", err)
+			}
+		}
+	}
+
+	err = os.Rename(restoringPath, dbPath)
+	if err != nil {
+		return replacedPath, fmt.Errorf("failed to move the restored database into place: %w", err)
+	}
+
+	return replacedPath, nil
+}
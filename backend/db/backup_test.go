@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "vehicledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "live.sqlite")
+	store, err := OpenSQLite(dbPath, Options{SQLite: DefaultSQLiteOptions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := NewBackupSet(store, filepath.Join(dir, "backups"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first *BackupInfo
+	for idx := 0; idx < 3; idx++ {
+		backup, err := backups.Create(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = backup
+		}
+	}
+
+	listed, err := backups.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("expected 2 backups to be kept, found %d", len(listed))
+	}
+	for _, backup := range listed {
+		if backup.Name == first.Name {
+			t.Fatalf("expected the oldest backup to be pruned")
+		}
+	}
+
+	version, err := BackupVersion(ctx, backups.Path(listed[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != store.LatestSchemaVersion() {
+		t.Fatalf("expected backup at schema version %d, got %d", store.LatestSchemaVersion(), version)
+	}
+
+	// restoring over another database keeps it aside and brings the data back
+	restoredPath := filepath.Join(dir, "restored.sqlite")
+	err = ioutil.WriteFile(restoredPath, []byte("not a database"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, err := RestoreSQLite(ctx, backups.Path(listed[0]), "sqlite://"+restoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "not a database" {
+		t.Fatalf("expected the replaced database to be kept at %s", replaced)
+	}
+
+	restored, err := OpenSQLite(restoredPath, Options{SQLite: DefaultSQLiteOptions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	_, err = restored.GetUser(ctx, user.UserId)
+	if err != nil {
+		t.Fatalf("expected the restored database to hold the user: %v", err)
+	}
+
+	// backups that aren't vehicledb databases, or are too new, are refused
+	_, err = RestoreSQLite(ctx, replaced, restoredPath)
+	if err == nil {
+		t.Fatalf("expected restoring a file that isn't a database to fail")
+	}
+
+	_, err = store.db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from the future', CURRENT_TIMESTAMP)`, store.LatestSchemaVersion()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooNewPath := filepath.Join(dir, "too-new.sqlite")
+	err = store.Backup(ctx, tooNewPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = RestoreSQLite(ctx, tooNewPath, restoredPath)
+	if _, ok := err.(*SchemaTooNewError); !ok {
+		t.Fatalf("expected a too new backup to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect captures the differences between the SQL databases SQLStore can
+// run on. Queries are written once with ? placeholders and rebound for the
+// databases that number their parameters.
+type dialect struct {
+	name string
+
+	// numberedPlaceholders rewrites ? to $1, $2... for postgres.
+	numberedPlaceholders bool
+
+	// returningID means inserts report the new id through RETURNING rather
+	// than sql.Result.LastInsertId, which lib/pq doesn't support.
+	returningID bool
+
+	// forUpdate, appended to a SELECT, locks the rows it reads until the
+	// transaction ends. SQLite has no need, with one writer at a time.
+	forUpdate string
+
+	// listTablesQuery returns the name of every table in the database.
+	listTablesQuery string
+
+	// schemaMigrationsTable creates the table recording applied migrations.
+	schemaMigrationsTable string
+
+	migrations []Migration
+}
+
+var sqliteDialect = &dialect{
+	name:            "sqlite",
+	listTablesQuery: `SELECT name FROM sqlite_master WHERE type='table'`,
+	schemaMigrationsTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	"version" INTEGER NOT NULL PRIMARY KEY,
+	"name" TEXT NOT NULL,
+	"applied_at" DATETIME NOT NULL
+)`,
+	migrations: sqliteMigrations,
+}
+
+var postgresDialect = &dialect{
+	name:                 "postgres",
+	numberedPlaceholders: true,
+	returningID:          true,
+	forUpdate:            " FOR UPDATE",
+	listTablesQuery:      `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()`,
+	schemaMigrationsTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP WITH TIME ZONE NOT NULL
+)`,
+	migrations: postgresMigrations,
+}
+
+// rebind converts a query written with ? placeholders into the dialect's
+// placeholder syntax. It doesn't try to parse SQL, so queries must not
+// contain a literal ? in a string.
+func (d *dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var rebound strings.Builder
+	param := 0
+	for _, r := range query {
+		if r == '?' {
+			param++
+			rebound.WriteString("$" + strconv.Itoa(param))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+
+	return rebound.String()
+}
+
+// latestVersion is the schema version this binary was built for.
+func (d *dialect) latestVersion() int {
+	if len(d.migrations) == 0 {
+		return 0
+	}
+	return d.migrations[len(d.migrations)-1].Version
+}
+
+// isUniqueViolation reports whether err is a unique constraint failing,
+// from either database.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+
+	return false
+}
@@ -1,6 +1,83 @@
 package db
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The kinds of error the store returns. Callers match them with errors.Is
+// and translate them for their clients; the errors below carry the details.
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrForbidden          = errors.New("forbidden")
+	ErrUnauthenticated    = errors.New("unauthenticated")
+	ErrRateLimited        = errors.New("rate limited")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrInvalid            = errors.New("invalid")
+)
+
+// errorCodes are the stable codes clients see for each kind of error.
+var errorCodes = []struct {
+	kind error
+	code string
+}{
+	{ErrNotFound, "not_found"},
+	{ErrConflict, "conflict"},
+	{ErrForbidden, "forbidden"},
+	{ErrUnauthenticated, "unauthorized"},
+	{ErrRateLimited, "rate_limited"},
+	{ErrPreconditionFailed, "precondition_failed"},
+	{ErrInvalid, "invalid_request"},
+}
+
+// ErrorKind returns which of the kinds above err is, or nil if it's none of
+// them, which makes it a bug or an outage rather than the client's doing.
+func ErrorKind(err error) error {
+	for _, kind := range errorCodes {
+		if errors.Is(err, kind.kind) {
+			return kind.kind
+		}
+	}
+	return nil
+}
+
+// DetailedError is an error with more for the client than its message, e.g.
+// which fields conflicted.
+type DetailedError interface {
+	error
+	Details() map[string]interface{}
+}
+
+// ErrorCode returns the code for err's kind, or "server_error".
+func ErrorCode(err error) string {
+	for _, kind := range errorCodes {
+		if errors.Is(err, kind.kind) {
+			return kind.code
+		}
+	}
+	return "server_error"
+}
+
+// Error is an error of one of the kinds above with a message of its own.
+type Error struct {
+	Kind    error
+	Message string
+}
+
+// NewError returns an error of the given kind.
+func NewError(kind error, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func (err *Error) Is(target error) bool {
+	return target == err.Kind
+}
 
 type UserNotFoundError struct {
 	UserID RowID
@@ -10,6 +87,10 @@ func (u *UserNotFoundError) Error() string {
 	return fmt.Sprintf("User #%d not found", u.UserID)
 }
 
+func (u *UserNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
 type EmailAddressNotFoundError struct {
 	EmailAddress string
 }
@@ -17,3 +98,108 @@ type EmailAddressNotFoundError struct {
 func (err *EmailAddressNotFoundError) Error() string {
 	return fmt.Sprintf("User with email address %s not found", err.EmailAddress)
 }
+
+func (err *EmailAddressNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// EmailAddressTakenError is returned when another account already uses an
+// email address, ignoring case and Unicode normalization.
+type EmailAddressTakenError struct {
+	EmailAddress string
+}
+
+func (err *EmailAddressTakenError) Error() string {
+	return fmt.Sprintf("%s is already in use by another account", err.EmailAddress)
+}
+
+func (err *EmailAddressTakenError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+type VehicleNotFoundError struct {
+	VehicleID RowID
+}
+
+func (err *VehicleNotFoundError) Error() string {
+	return fmt.Sprintf("Vehicle #%d not found", err.VehicleID)
+}
+
+func (err *VehicleNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+type RevisionNotFoundError struct {
+	RevisionID RowID
+}
+
+func (err *RevisionNotFoundError) Error() string {
+	return fmt.Sprintf("Revision #%d not found", err.RevisionID)
+}
+
+func (err *RevisionNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+type WebhookNotFoundError struct {
+	WebhookID RowID
+}
+
+func (err *WebhookNotFoundError) Error() string {
+	return fmt.Sprintf("Webhook #%d not found", err.WebhookID)
+}
+
+func (err *WebhookNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// VersionMismatchError is returned when a write was made against a copy of a
+// record that has been changed since.
+type VersionMismatchError struct {
+	Expected int64
+	Current  int64
+}
+
+func (err *VersionMismatchError) Error() string {
+	if err.Current == 0 {
+		return fmt.Sprintf("the record changed after version %d was read", err.Expected)
+	}
+	return fmt.Sprintf("expected version %d, but the record is at version %d", err.Expected, err.Current)
+}
+
+func (err *VersionMismatchError) Is(target error) bool {
+	return target == ErrPreconditionFailed
+}
+
+func (err *VersionMismatchError) Details() map[string]interface{} {
+	if err.Current == 0 {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{"current_version": err.Current}
+}
+
+// checkVersion compares the version a write expects with the record's.
+func checkVersion(expected int64, current int64) error {
+	if expected != 0 && expected != current {
+		return &VersionMismatchError{Expected: expected, Current: current}
+	}
+	return nil
+}
+
+// RateLimitedError is returned when a client has made too many requests and
+// should wait RetryAfter before trying again.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (err *RateLimitedError) Error() string {
+	return fmt.Sprintf("too many requests; retry in %s", err.RetryAfter)
+}
+
+func (err *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (err *RateLimitedError) Details() map[string]interface{} {
+	return map[string]interface{}{"retry_after": int(err.RetryAfter.Seconds())}
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// ChangeEventStore reads back the log of change events that WebhookStore
+// records, for streaming them to their users as they happen. The log is
+// bounded: PurgeChangeEvents forgets the oldest events.
+type ChangeEventStore interface {
+	// ListChangeEvents returns up to limit of the user's events after the
+	// given one, oldest first. Pings, which are for a webhook alone, aren't
+	// included.
+	ListChangeEvents(ctx context.Context, userID RowID, after RowID, limit int) ([]*ChangeEvent, error)
+	// ChangeEventRange returns the ids of the oldest and newest events kept,
+	// or zeroes when there are none.
+	ChangeEventRange(ctx context.Context) (oldest RowID, newest RowID, err error)
+}
+
+func (s *SQLStore) ListChangeEvents(ctx context.Context, userID RowID, after RowID, limit int) ([]*ChangeEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, user_id, type, resource, resource_id, data, created_at FROM change_events WHERE user_id = ? AND id > ? AND type != ? ORDER BY id LIMIT ?`
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), userID, after, ChangeWebhookPing, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list change events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*ChangeEvent, 0)
+	for rows.Next() {
+		var event ChangeEvent
+		var data string
+		err = rows.Scan(&event.EventID, &event.UserID, &event.Type, &event.Resource, &event.ResourceID, &data, &event.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		event.Data = json.RawMessage(data)
+		events = append(events, &event)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list change events: %w", err)
+	}
+
+	return events, nil
+}
+
+func (s *SQLStore) ChangeEventRange(ctx context.Context) (RowID, RowID, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var oldest, newest sql.NullInt64
+	err := s.reader.QueryRowContext(ctx, `SELECT MIN(id), MAX(id) FROM change_events`).Scan(&oldest, &newest)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read change event range: %w", err)
+	}
+
+	return RowID(oldest.Int64), RowID(newest.Int64), nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IdempotentResponse is the response to a request made with an idempotency
+// key, kept so that a retry of the request can be answered with it rather
+// than repeating it. Fingerprint identifies the request, so that the key
+// can't be reused for a different one.
+type IdempotentResponse struct {
+	Fingerprint string
+	// Status is 0 while the request is still being handled.
+	Status    int
+	Header    map[string]string
+	Body      []byte
+	CreatedAt time.Time
+}
+
+// IdempotencyStore keeps the responses to requests made with idempotency
+// keys. Keys belong to the user who sent them.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey claims a key for the request with the given
+	// fingerprint, unless it was claimed after since. Then it returns the
+	// earlier claim instead, which is still running if its Status is 0.
+	// A claim that is still running but was made before abandoned is
+	// taken to have died with its server, and the key is claimed again.
+	ReserveIdempotencyKey(ctx context.Context, userID RowID, key string, fingerprint string, since time.Time, abandoned time.Time) (*IdempotentResponse, error)
+	// SaveIdempotentResponse keeps the response to the request a key was
+	// reserved for.
+	SaveIdempotentResponse(ctx context.Context, userID RowID, key string, response *IdempotentResponse) error
+	// ReleaseIdempotencyKey forgets a key, so that the request can be
+	// retried, e.g. when it failed on the server's end.
+	ReleaseIdempotencyKey(ctx context.Context, userID RowID, key string) error
+	// PurgeIdempotencyKeys forgets keys reserved before the given time,
+	// returning how many there were.
+	PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error)
+}
+
+func (s *SQLStore) ReserveIdempotencyKey(ctx context.Context, userID RowID, key string, fingerprint string, since time.Time, abandoned time.Time) (*IdempotentResponse, error) {
+	var existing *IdempotentResponse
+
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		query := `SELECT fingerprint, status, headers, body, created_at FROM idempotency_keys WHERE user_id = ? AND key = ?`
+		response := &IdempotentResponse{}
+		var header string
+		err := sqlTx.conn.QueryRowContext(ctx, sqlTx.rebind(query), userID, key).Scan(
+			&response.Fingerprint, &response.Status, &header, &response.Body, &response.CreatedAt,
+		)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return fmt.Errorf("failed to query idempotency key: %w", err)
+		case !response.CreatedAt.Before(since) && (response.Status != 0 || !response.CreatedAt.Before(abandoned)):
+			err = json.Unmarshal([]byte(header), &response.Header)
+			if err != nil {
+				return fmt.Errorf("failed to decode idempotent response headers: %w", err)
+			}
+			existing = response
+			return nil
+		default:
+			// the key has expired, or its request was abandoned, and may be
+			// used again
+			_, err = sqlTx.conn.ExecContext(ctx, sqlTx.rebind(`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?`), userID, key)
+			if err != nil {
+				return fmt.Errorf("failed to delete expired idempotency key: %w", err)
+			}
+		}
+
+		query = `INSERT INTO idempotency_keys (user_id, key, fingerprint, status, headers, body, created_at) VALUES (?, ?, ?, 0, '{}', ?, ?)`
+		_, err = sqlTx.conn.ExecContext(ctx, sqlTx.rebind(query), userID, key, fingerprint, []byte{}, time.Now().UTC())
+		if isUniqueViolation(err) {
+			return errIdempotencyKeyTaken
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reserve idempotency key: %w", err)
+		}
+		return nil
+	})
+	if err == errIdempotencyKeyTaken {
+		// another request reserved it between the select and the insert,
+		// and is still running; postgres won't commit after the failed
+		// insert, so the transaction is rolled back to say so
+		return &IdempotentResponse{Fingerprint: fingerprint}, nil
+	}
+
+	return existing, err
+}
+
+var errIdempotencyKeyTaken = errors.New("idempotency key taken")
+
+func (s *SQLStore) SaveIdempotentResponse(ctx context.Context, userID RowID, key string, response *IdempotentResponse) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return fmt.Errorf("failed to encode idempotent response headers: %w", err)
+	}
+
+	query := `UPDATE idempotency_keys SET status = ?, headers = ?, body = ? WHERE user_id = ? AND key = ?`
+	_, err = s.conn.ExecContext(ctx, s.rebind(query), response.Status, string(header), response.Body, userID, key)
+	if err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) ReleaseIdempotencyKey(ctx context.Context, userID RowID, key string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.conn.ExecContext(ctx, s.rebind(`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?`), userID, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	result, err := s.conn.ExecContext(ctx, s.rebind(`DELETE FROM idempotency_keys WHERE created_at < ?`), before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+	return result.RowsAffected()
+}
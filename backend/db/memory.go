@@ -0,0 +1,1060 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in maps. It's meant for tests
+// and for embedding vehicledb without a database file; nothing survives
+// the process.
+type MemoryStore struct {
+	mu   *sync.RWMutex
+	data *memoryData
+
+	// inTx is set on the store handed to an InTx callback, which already
+	// holds the write lock
+	inTx bool
+}
+
+type memoryData struct {
+	lastID         RowID
+	users          map[RowID]User
+	vehicles       map[RowID]Vehicle
+	securityEvents []SecurityEvent
+	admins         map[RowID]bool
+	revisions      []VehicleRevision
+	idempotency    map[idempotencyScope]IdempotentResponse
+	webhooks       map[RowID]Webhook
+	changeEvents   []ChangeEvent
+	deliveries     []WebhookDelivery
+}
+
+type idempotencyScope struct {
+	userID RowID
+	key    string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu: &sync.RWMutex{},
+		data: &memoryData{
+			users:       make(map[RowID]User),
+			vehicles:    make(map[RowID]Vehicle),
+			admins:      make(map[RowID]bool),
+			idempotency: make(map[idempotencyScope]IdempotentResponse),
+			webhooks:    make(map[RowID]Webhook),
+		},
+	}
+}
+
+// clone copies the data so a transaction can work on it and be thrown away
+// on rollback. Rows are stored by value, so copying the maps is enough.
+func (d *memoryData) clone() *memoryData {
+	cloned := &memoryData{
+		lastID:         d.lastID,
+		users:          make(map[RowID]User, len(d.users)),
+		vehicles:       make(map[RowID]Vehicle, len(d.vehicles)),
+		securityEvents: append([]SecurityEvent(nil), d.securityEvents...),
+		admins:         make(map[RowID]bool, len(d.admins)),
+		revisions:      append([]VehicleRevision(nil), d.revisions...),
+		idempotency:    make(map[idempotencyScope]IdempotentResponse, len(d.idempotency)),
+		webhooks:       make(map[RowID]Webhook, len(d.webhooks)),
+		changeEvents:   append([]ChangeEvent(nil), d.changeEvents...),
+		deliveries:     append([]WebhookDelivery(nil), d.deliveries...),
+	}
+	for id, user := range d.users {
+		cloned.users[id] = user
+	}
+	for id, vehicle := range d.vehicles {
+		cloned.vehicles[id] = vehicle
+	}
+	for id, isAdmin := range d.admins {
+		cloned.admins[id] = isAdmin
+	}
+	for scope, response := range d.idempotency {
+		cloned.idempotency[scope] = response
+	}
+	for id, webhook := range d.webhooks {
+		cloned.webhooks[id] = webhook
+	}
+	return cloned
+}
+
+func (m *MemoryStore) lock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+func (m *MemoryStore) rlock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.mu.RLock()
+	return m.mu.RUnlock
+}
+
+func (m *MemoryStore) nextID() RowID {
+	m.data.lastID++
+	return m.data.lastID
+}
+
+// InTx holds the write lock for the whole of fn, so transactions are
+// serialized, and works on a copy of the data that only replaces the
+// original when fn succeeds.
+func (m *MemoryStore) InTx(ctx context.Context, fn func(tx Tx) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	defer m.lock()()
+
+	tx := &MemoryStore{mu: m.mu, data: m.data.clone(), inTx: true}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	m.data = tx.data
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// emailAddressTaken reports whether an account other than userID that isn't
+// in the trash uses the address, the way the unique index on email_key does.
+func (m *MemoryStore) emailAddressTaken(emailAddress string, userID RowID) bool {
+	key := emailAddressKey(emailAddress)
+	for _, user := range m.data.users {
+		if user.UserId != userID && user.DeletedAt == nil && emailAddressKey(user.EmailAddress) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, emailAddress string, password string) (*User, error) {
+	defer m.lock()()
+
+	emailAddress = normalizeEmailAddress(emailAddress)
+	if m.emailAddressTaken(emailAddress, 0) {
+		return nil, &EmailAddressTakenError{EmailAddress: emailAddress}
+	}
+
+	user := User{
+		UserId:       m.nextID(),
+		EmailAddress: emailAddress,
+		PasswordHash: hashPassword(password),
+		Version:      1,
+	}
+	m.data.users[user.UserId] = user
+
+	return &User{UserId: user.UserId, EmailAddress: user.EmailAddress, Version: user.Version}, nil
+}
+
+func (m *MemoryStore) FindUserByEmailAddress(ctx context.Context, emailAddress string) (*User, error) {
+	defer m.rlock()()
+
+	key := emailAddressKey(emailAddress)
+	var found *User
+	for _, user := range m.data.users {
+		if user.DeletedAt == nil && emailAddressKey(user.EmailAddress) == key {
+			user := user
+			found = &user
+			break
+		}
+	}
+
+	if found == nil {
+		return nil, &EmailAddressNotFoundError{EmailAddress: emailAddress}
+	}
+
+	return found, nil
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, userId RowID) (*User, error) {
+	defer m.rlock()()
+
+	user, ok := m.data.users[userId]
+	if !ok || user.DeletedAt != nil {
+		return nil, &UserNotFoundError{UserID: userId}
+	}
+
+	return &user, nil
+}
+
+func (m *MemoryStore) UpdateUser(ctx context.Context, userId RowID, version int64, emailAddress string) (*User, error) {
+	defer m.lock()()
+
+	user, ok := m.data.users[userId]
+	if !ok || user.DeletedAt != nil {
+		return nil, &UserNotFoundError{UserID: userId}
+	}
+	err := checkVersion(version, user.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing to update
+	emailAddress = normalizeEmailAddress(emailAddress)
+	if emailAddress != "" && emailAddress != user.EmailAddress {
+		if m.emailAddressTaken(emailAddress, userId) {
+			return nil, &EmailAddressTakenError{EmailAddress: emailAddress}
+		}
+
+		user.EmailAddress = emailAddress
+		user.Version++
+		m.data.users[userId] = user
+	}
+
+	return &User{UserId: userId, EmailAddress: user.EmailAddress, Version: user.Version}, nil
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, userId RowID, version int64) error {
+	defer m.lock()()
+
+	user, ok := m.data.users[userId]
+	if !ok || user.DeletedAt != nil {
+		return &UserNotFoundError{UserID: userId}
+	}
+	err := checkVersion(version, user.Version)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	user.DeletedAt = &now
+	user.Version++
+	m.data.users[userId] = user
+	return nil
+}
+
+func (m *MemoryStore) CreateVehicle(ctx context.Context, userID RowID, year Year, make, model string) (*Vehicle, error) {
+	defer m.lock()()
+
+	vehicle := Vehicle{
+		VehicleID: m.nextID(),
+		UserID:    userID,
+		Year:      year,
+		Make:      make,
+		Model:     model,
+		Version:   1,
+	}
+	m.data.vehicles[vehicle.VehicleID] = vehicle
+
+	changes, err := diffVehicles(nil, &vehicle)
+	if err != nil {
+		return nil, err
+	}
+	err = m.recordVehicleRevision(ctx, vehicle.VehicleID, RevisionCreated, changes, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vehicle, nil
+}
+
+func (m *MemoryStore) ListVehicles(ctx context.Context, userID RowID, filter VehicleFilter, options ListOptions) ([]*Vehicle, *Cursor, error) {
+	defer m.rlock()()
+
+	vehicles := make([]*Vehicle, 0)
+	for _, vehicle := range m.data.vehicles {
+		if vehicle.UserID != userID || vehicle.DeletedAt != nil {
+			continue
+		}
+		if (filter.YearFrom != 0 && vehicle.Year < filter.YearFrom) || (filter.YearTo != 0 && vehicle.Year > filter.YearTo) {
+			continue
+		}
+		if filter.Make != "" && !strings.EqualFold(vehicle.Make, filter.Make) {
+			continue
+		}
+
+		vehicle := vehicle
+		vehicles = append(vehicles, &vehicle)
+	}
+
+	indexes, next, err := Page(len(vehicles), VehicleSortKeys, options, func(idx int, key string) (interface{}, RowID) {
+		return vehicleSortValue(vehicles[idx], key), vehicles[idx].VehicleID
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page := make([]*Vehicle, 0, len(indexes))
+	for _, idx := range indexes {
+		page = append(page, vehicles[idx])
+	}
+	return page, next, nil
+}
+
+func (m *MemoryStore) GetVehicle(ctx context.Context, vehicleID RowID) (*Vehicle, error) {
+	defer m.rlock()()
+
+	vehicle, ok := m.data.vehicles[vehicleID]
+	if !ok || vehicle.DeletedAt != nil {
+		return nil, &VehicleNotFoundError{VehicleID: vehicleID}
+	}
+
+	return &vehicle, nil
+}
+
+func (m *MemoryStore) UpdateVehicle(ctx context.Context, vehicleID RowID, version int64, year *NullYear, vehicleMake, model *NullString) error {
+	defer m.lock()()
+
+	return m.updateVehicle(ctx, vehicleID, version, year, vehicleMake, model, RevisionUpdated, nil)
+}
+
+func (m *MemoryStore) updateVehicle(ctx context.Context, vehicleID RowID, version int64, year *NullYear, vehicleMake, model *NullString, action string, reverts *RowID) error {
+	before, ok := m.data.vehicles[vehicleID]
+	if !ok || before.DeletedAt != nil {
+		return &VehicleNotFoundError{VehicleID: vehicleID}
+	}
+	err := checkVersion(version, before.Version)
+	if err != nil {
+		return err
+	}
+
+	after := applyVehicleChanges(before, year, vehicleMake, model)
+	changes, err := diffVehicles(&before, after)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	after.Version++
+	m.data.vehicles[vehicleID] = *after
+	return m.recordVehicleRevision(ctx, vehicleID, action, changes, reverts)
+}
+
+func (m *MemoryStore) DeleteVehicle(ctx context.Context, vehicleID RowID, version int64) error {
+	defer m.lock()()
+
+	vehicle, ok := m.data.vehicles[vehicleID]
+	if !ok || vehicle.DeletedAt != nil {
+		return &VehicleNotFoundError{VehicleID: vehicleID}
+	}
+	err := checkVersion(version, vehicle.Version)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	vehicle.DeletedAt = &now
+	vehicle.Version++
+	m.data.vehicles[vehicleID] = vehicle
+	return m.recordVehicleRevision(ctx, vehicleID, RevisionDeleted, map[string]FieldChange{}, nil)
+}
+
+func (m *MemoryStore) ListDeletedVehicles(ctx context.Context, userID RowID) ([]*Vehicle, error) {
+	defer m.rlock()()
+
+	vehicles := make([]*Vehicle, 0)
+	for _, vehicle := range m.data.vehicles {
+		if vehicle.UserID == userID && vehicle.DeletedAt != nil {
+			vehicle := vehicle
+			vehicles = append(vehicles, &vehicle)
+		}
+	}
+
+	sort.Slice(vehicles, func(i, j int) bool {
+		return vehicles[i].DeletedAt.After(*vehicles[j].DeletedAt)
+	})
+
+	return vehicles, nil
+}
+
+func (m *MemoryStore) GetDeletedVehicle(ctx context.Context, vehicleID RowID) (*Vehicle, error) {
+	defer m.rlock()()
+
+	vehicle, ok := m.data.vehicles[vehicleID]
+	if !ok || vehicle.DeletedAt == nil {
+		return nil, &VehicleNotFoundError{VehicleID: vehicleID}
+	}
+
+	return &vehicle, nil
+}
+
+func (m *MemoryStore) RestoreVehicle(ctx context.Context, vehicleID RowID) error {
+	defer m.lock()()
+
+	vehicle, ok := m.data.vehicles[vehicleID]
+	if ok && vehicle.DeletedAt != nil {
+		vehicle.DeletedAt = nil
+		vehicle.Version++
+		m.data.vehicles[vehicleID] = vehicle
+		return m.recordVehicleRevision(ctx, vehicleID, RevisionRestored, map[string]FieldChange{}, nil)
+	}
+	return nil
+}
+
+func (m *MemoryStore) ListDeletedUsers(ctx context.Context) ([]*User, error) {
+	defer m.rlock()()
+
+	users := make([]*User, 0)
+	for _, user := range m.data.users {
+		if user.DeletedAt != nil {
+			users = append(users, &User{UserId: user.UserId, EmailAddress: user.EmailAddress, DeletedAt: user.DeletedAt})
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].DeletedAt.After(*users[j].DeletedAt)
+	})
+
+	return users, nil
+}
+
+func (m *MemoryStore) RestoreUser(ctx context.Context, userID RowID) error {
+	defer m.lock()()
+
+	user, ok := m.data.users[userID]
+	if !ok || user.DeletedAt == nil {
+		return &UserNotFoundError{UserID: userID}
+	}
+	if m.emailAddressTaken(user.EmailAddress, userID) {
+		return NewError(ErrConflict, "another account has taken user #%d's email address", userID)
+	}
+
+	user.DeletedAt = nil
+	user.Version++
+	m.data.users[userID] = user
+	return nil
+}
+
+func (m *MemoryStore) PurgeVehicle(ctx context.Context, vehicleID RowID) error {
+	defer m.lock()()
+
+	m.purgeVehicle(vehicleID)
+	return nil
+}
+
+func (m *MemoryStore) purgeVehicle(vehicleID RowID) {
+	revisions := m.data.revisions[:0]
+	for _, revision := range m.data.revisions {
+		if revision.VehicleID != vehicleID {
+			revisions = append(revisions, revision)
+		}
+	}
+	m.data.revisions = revisions
+
+	m.purgeChangeEvents(func(event *ChangeEvent) bool {
+		return event.Resource == "vehicle" && event.ResourceID == vehicleID
+	})
+	delete(m.data.vehicles, vehicleID)
+}
+
+func (m *MemoryStore) PurgeUser(ctx context.Context, userID RowID) error {
+	defer m.lock()()
+
+	if _, ok := m.data.users[userID]; !ok {
+		return &UserNotFoundError{UserID: userID}
+	}
+	m.purgeUser(userID)
+	return nil
+}
+
+func (m *MemoryStore) purgeUser(userID RowID) int64 {
+	var purged int64 = 1
+
+	for vehicleID, vehicle := range m.data.vehicles {
+		if vehicle.UserID == userID {
+			m.purgeVehicle(vehicleID)
+			purged++
+		}
+	}
+	delete(m.data.admins, userID)
+	delete(m.data.users, userID)
+	for scope := range m.data.idempotency {
+		if scope.userID == userID {
+			delete(m.data.idempotency, scope)
+		}
+	}
+	for webhookID, webhook := range m.data.webhooks {
+		if webhook.UserID == userID {
+			delete(m.data.webhooks, webhookID)
+		}
+	}
+	m.purgeChangeEvents(func(event *ChangeEvent) bool {
+		return event.UserID == userID
+	})
+	for idx, event := range m.data.securityEvents {
+		if event.UserID != nil && *event.UserID == userID {
+			m.data.securityEvents[idx].Details, _ = scrubDetails(event.Details)
+		}
+	}
+
+	return purged
+}
+
+func (m *MemoryStore) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock()()
+
+	var purged int64
+	for userID, user := range m.data.users {
+		if user.DeletedAt != nil && user.DeletedAt.Before(before) {
+			purged += m.purgeUser(userID)
+		}
+	}
+	for vehicleID, vehicle := range m.data.vehicles {
+		if vehicle.DeletedAt != nil && vehicle.DeletedAt.Before(before) {
+			m.purgeVehicle(vehicleID)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func (m *MemoryStore) RecordSecurityEvent(ctx context.Context, event *SecurityEvent) error {
+	defer m.lock()()
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+	event.EventID = RowID(len(m.data.securityEvents) + 1)
+
+	stored := *event
+	stored.UserID = copyRowID(event.UserID)
+	stored.ActorID = copyRowID(event.ActorID)
+	m.data.securityEvents = append(m.data.securityEvents, stored)
+
+	return nil
+}
+
+func copyRowID(id *RowID) *RowID {
+	if id == nil {
+		return nil
+	}
+	copied := *id
+	return &copied
+}
+
+func (m *MemoryStore) ListSecurityEvents(ctx context.Context, userID RowID, options ListOptions) ([]*SecurityEvent, *Cursor, error) {
+	return m.listSecurityEvents(ctx, options, func(event *SecurityEvent) bool {
+		return event.UserID != nil && *event.UserID == userID
+	})
+}
+
+func (m *MemoryStore) ListAllSecurityEvents(ctx context.Context, options ListOptions) ([]*SecurityEvent, *Cursor, error) {
+	return m.listSecurityEvents(ctx, options, func(event *SecurityEvent) bool {
+		return true
+	})
+}
+
+func (m *MemoryStore) listSecurityEvents(ctx context.Context, options ListOptions, include func(event *SecurityEvent) bool) ([]*SecurityEvent, *Cursor, error) {
+	defer m.rlock()()
+
+	events := make([]*SecurityEvent, 0)
+	for idx := range m.data.securityEvents {
+		event := m.data.securityEvents[idx]
+		if include(&event) {
+			events = append(events, &event)
+		}
+	}
+
+	indexes, next, err := Page(len(events), SecurityEventSortKeys, options, func(idx int, key string) (interface{}, RowID) {
+		return nil, events[idx].EventID
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page := make([]*SecurityEvent, 0, len(indexes))
+	for _, idx := range indexes {
+		page = append(page, events[idx])
+	}
+	return page, next, nil
+}
+
+func (m *MemoryStore) IsAdmin(ctx context.Context, userID RowID) (bool, error) {
+	defer m.rlock()()
+
+	return m.data.admins[userID], nil
+}
+
+func (m *MemoryStore) GrantAdmin(ctx context.Context, userID RowID) error {
+	defer m.lock()()
+
+	m.data.admins[userID] = true
+	return nil
+}
+
+func (m *MemoryStore) Search(ctx context.Context, userID RowID, query string, limit int) ([]*SearchResult, error) {
+	defer m.rlock()()
+
+	terms := searchTerms(query)
+	results := make([]*SearchResult, 0)
+	if len(terms) == 0 {
+		return results, nil
+	}
+
+	for _, vehicle := range m.data.vehicles {
+		if vehicle.UserID != userID || vehicle.DeletedAt != nil {
+			continue
+		}
+
+		title := fmt.Sprintf("%d %s %s", vehicle.Year, vehicle.Make, vehicle.Model)
+		snippet, matched := memorySnippet(title, terms)
+		if matched == 0 {
+			continue
+		}
+
+		results = append(results, &SearchResult{
+			Kind:    SearchKindVehicle,
+			ID:      vehicle.VehicleID,
+			Title:   title,
+			Snippet: highlightSnippet(snippet),
+			Rank:    float64(matched),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ID < results[j].ID
+	})
+
+	return rankResults(results, limit), nil
+}
+
+// memorySnippet marks the words of text that start with one of the terms
+// and counts how many terms matched.
+func memorySnippet(text string, terms []string) (string, int) {
+	matchedTerms := make(map[string]bool)
+
+	words := strings.Fields(text)
+	for idx, word := range words {
+		for _, term := range terms {
+			if strings.HasPrefix(strings.ToLower(word), term) {
+				matchedTerms[term] = true
+				words[idx] = snippetStart + word + snippetEnd
+				break
+			}
+		}
+	}
+
+	return strings.Join(words, " "), len(matchedTerms)
+}
+
+// recordVehicleRevision appends a revision made by the context's actor, and
+// the event it makes for the owner's webhooks.
+func (m *MemoryStore) recordVehicleRevision(ctx context.Context, vehicleID RowID, action string, changes map[string]FieldChange, reverts *RowID) error {
+	revision := VehicleRevision{
+		RevisionID: m.nextID(),
+		VehicleID:  vehicleID,
+		ActorID:    actorFromContext(ctx),
+		Action:     action,
+		Changes:    changes,
+		Reverts:    reverts,
+		CreatedAt:  time.Now().UTC(),
+	}
+	m.data.revisions = append(m.data.revisions, revision)
+
+	vehicle := m.data.vehicles[vehicleID]
+	event, err := vehicleChangeEvent(&vehicle, revision.RevisionID, action, changes)
+	if err != nil {
+		return err
+	}
+	m.recordChangeEvent(event)
+	return nil
+}
+
+func (m *MemoryStore) ListVehicleRevisions(ctx context.Context, vehicleID RowID) ([]*VehicleRevision, error) {
+	defer m.rlock()()
+
+	revisions := make([]*VehicleRevision, 0)
+	for idx := len(m.data.revisions) - 1; idx >= 0; idx-- {
+		revision := m.data.revisions[idx]
+		if revision.VehicleID == vehicleID {
+			revisions = append(revisions, &revision)
+		}
+	}
+
+	return revisions, nil
+}
+
+func (m *MemoryStore) GetVehicleRevision(ctx context.Context, revisionID RowID) (*VehicleRevision, error) {
+	defer m.rlock()()
+
+	revision := m.getVehicleRevision(revisionID)
+	if revision == nil {
+		return nil, &RevisionNotFoundError{RevisionID: revisionID}
+	}
+
+	return revision, nil
+}
+
+func (m *MemoryStore) getVehicleRevision(revisionID RowID) *VehicleRevision {
+	for _, revision := range m.data.revisions {
+		if revision.RevisionID == revisionID {
+			return &revision
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RevertVehicleRevision(ctx context.Context, revisionID RowID, version int64) (*Vehicle, error) {
+	defer m.lock()()
+
+	revision := m.getVehicleRevision(revisionID)
+	if revision == nil {
+		return nil, &RevisionNotFoundError{RevisionID: revisionID}
+	}
+
+	vehicle, ok := m.data.vehicles[revision.VehicleID]
+	if !ok || vehicle.DeletedAt != nil {
+		return nil, &RevisionNotFoundError{RevisionID: revisionID}
+	}
+
+	err := checkVersion(version, vehicle.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	year, vehicleMake, model, err := revertValues(&vehicle, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.updateVehicle(ctx, vehicle.VehicleID, vehicle.Version, year, vehicleMake, model, RevisionReverted, &revisionID)
+	if err != nil {
+		return nil, err
+	}
+
+	vehicle = m.data.vehicles[revision.VehicleID]
+	return &vehicle, nil
+}
+
+func (m *MemoryStore) ReserveIdempotencyKey(ctx context.Context, userID RowID, key string, fingerprint string, since time.Time, abandoned time.Time) (*IdempotentResponse, error) {
+	defer m.lock()()
+
+	scope := idempotencyScope{userID: userID, key: key}
+	existing, ok := m.data.idempotency[scope]
+	if ok && !existing.CreatedAt.Before(since) && (existing.Status != 0 || !existing.CreatedAt.Before(abandoned)) {
+		return &existing, nil
+	}
+
+	m.data.idempotency[scope] = IdempotentResponse{Fingerprint: fingerprint, Body: []byte{}, CreatedAt: time.Now().UTC()}
+	return nil, nil
+}
+
+func (m *MemoryStore) SaveIdempotentResponse(ctx context.Context, userID RowID, key string, response *IdempotentResponse) error {
+	defer m.lock()()
+
+	scope := idempotencyScope{userID: userID, key: key}
+	reserved, ok := m.data.idempotency[scope]
+	if !ok {
+		return nil
+	}
+	reserved.Status, reserved.Header, reserved.Body = response.Status, response.Header, response.Body
+	m.data.idempotency[scope] = reserved
+	return nil
+}
+
+func (m *MemoryStore) ReleaseIdempotencyKey(ctx context.Context, userID RowID, key string) error {
+	defer m.lock()()
+
+	delete(m.data.idempotency, idempotencyScope{userID: userID, key: key})
+	return nil
+}
+
+func (m *MemoryStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock()()
+
+	var purged int64
+	for scope, response := range m.data.idempotency {
+		if response.CreatedAt.Before(before) {
+			delete(m.data.idempotency, scope)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryStore) CreateWebhook(ctx context.Context, userID RowID, url string, events []string, secret string) (*Webhook, error) {
+	defer m.lock()()
+
+	webhook := Webhook{
+		WebhookID: m.nextID(),
+		UserID:    userID,
+		URL:       url,
+		Events:    append([]string(nil), events...),
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	m.data.webhooks[webhook.WebhookID] = webhook
+
+	return &webhook, nil
+}
+
+func (m *MemoryStore) ListWebhooks(ctx context.Context, userID RowID) ([]*Webhook, error) {
+	defer m.rlock()()
+
+	return m.listWebhooks(userID), nil
+}
+
+func (m *MemoryStore) listWebhooks(userID RowID) []*Webhook {
+	webhooks := make([]*Webhook, 0)
+	for _, webhook := range m.data.webhooks {
+		if webhook.UserID == userID {
+			webhook := webhook
+			webhook.Secret = ""
+			webhooks = append(webhooks, &webhook)
+		}
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].WebhookID < webhooks[j].WebhookID
+	})
+
+	return webhooks
+}
+
+func (m *MemoryStore) GetWebhook(ctx context.Context, webhookID RowID) (*Webhook, error) {
+	defer m.rlock()()
+
+	webhook, ok := m.data.webhooks[webhookID]
+	if !ok {
+		return nil, &WebhookNotFoundError{WebhookID: webhookID}
+	}
+
+	webhook.Secret = ""
+	return &webhook, nil
+}
+
+func (m *MemoryStore) DeleteWebhook(ctx context.Context, webhookID RowID) error {
+	defer m.lock()()
+
+	if _, ok := m.data.webhooks[webhookID]; !ok {
+		return &WebhookNotFoundError{WebhookID: webhookID}
+	}
+
+	deliveries := m.data.deliveries[:0]
+	for _, delivery := range m.data.deliveries {
+		if delivery.WebhookID != webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	m.data.deliveries = deliveries
+	delete(m.data.webhooks, webhookID)
+
+	return nil
+}
+
+func (m *MemoryStore) PingWebhook(ctx context.Context, webhookID RowID) (*WebhookDelivery, error) {
+	defer m.lock()()
+
+	webhook, ok := m.data.webhooks[webhookID]
+	if !ok {
+		return nil, &WebhookNotFoundError{WebhookID: webhookID}
+	}
+
+	event, err := pingEvent(&webhook)
+	if err != nil {
+		return nil, err
+	}
+	m.insertChangeEvent(event)
+	delivery := m.queueDelivery(webhookID, event)
+
+	return &delivery, nil
+}
+
+// recordChangeEvent appends an event to the outbox, with a delivery for
+// each of the user's webhooks that subscribes to it.
+func (m *MemoryStore) recordChangeEvent(event *ChangeEvent) {
+	m.insertChangeEvent(event)
+
+	for _, webhook := range m.listWebhooks(event.UserID) {
+		if webhook.Subscribes(event.Type) {
+			m.queueDelivery(webhook.WebhookID, event)
+		}
+	}
+}
+
+func (m *MemoryStore) insertChangeEvent(event *ChangeEvent) {
+	event.EventID = m.nextID()
+	event.CreatedAt = time.Now().UTC()
+	m.data.changeEvents = append(m.data.changeEvents, *event)
+}
+
+func (m *MemoryStore) queueDelivery(webhookID RowID, event *ChangeEvent) WebhookDelivery {
+	nextAttemptAt := event.CreatedAt
+	delivery := WebhookDelivery{
+		DeliveryID:    m.nextID(),
+		WebhookID:     webhookID,
+		EventID:       event.EventID,
+		EventType:     event.Type,
+		State:         DeliveryPending,
+		NextAttemptAt: &nextAttemptAt,
+		CreatedAt:     event.CreatedAt,
+	}
+	m.data.deliveries = append(m.data.deliveries, delivery)
+	return delivery
+}
+
+// changeEvent finds an event by id; events are in id order.
+func (m *MemoryStore) changeEvent(eventID RowID) (ChangeEvent, bool) {
+	idx := sort.Search(len(m.data.changeEvents), func(idx int) bool {
+		return m.data.changeEvents[idx].EventID >= eventID
+	})
+	if idx == len(m.data.changeEvents) || m.data.changeEvents[idx].EventID != eventID {
+		return ChangeEvent{}, false
+	}
+	return m.data.changeEvents[idx], true
+}
+
+func (m *MemoryStore) ListWebhookDeliveries(ctx context.Context, webhookID RowID, options ListOptions) ([]*WebhookDelivery, *Cursor, error) {
+	defer m.rlock()()
+
+	deliveries := make([]*WebhookDelivery, 0)
+	for _, delivery := range m.data.deliveries {
+		if delivery.WebhookID == webhookID {
+			delivery := delivery
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+
+	indexes, next, err := Page(len(deliveries), WebhookDeliverySortKeys, options, func(idx int, key string) (interface{}, RowID) {
+		return nil, deliveries[idx].DeliveryID
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page := make([]*WebhookDelivery, 0, len(indexes))
+	for _, idx := range indexes {
+		page = append(page, deliveries[idx])
+	}
+	return page, next, nil
+}
+
+func (m *MemoryStore) ClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*PendingDelivery, error) {
+	defer m.lock()()
+
+	due := make([]int, 0)
+	for idx, delivery := range m.data.deliveries {
+		if delivery.State == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, idx)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return m.data.deliveries[due[i]].NextAttemptAt.Before(*m.data.deliveries[due[j]].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	deliveries := make([]*PendingDelivery, 0, len(due))
+	leased := now.Add(lease).UTC()
+	for _, idx := range due {
+		delivery := &m.data.deliveries[idx]
+		webhook := m.data.webhooks[delivery.WebhookID]
+		event, ok := m.changeEvent(delivery.EventID)
+		if !ok {
+			return nil, fmt.Errorf("webhook delivery %d is of a missing event", delivery.DeliveryID)
+		}
+
+		deliveries = append(deliveries, &PendingDelivery{WebhookDelivery: *delivery, URL: webhook.URL, Secret: webhook.Secret, Event: event})
+		nextAttemptAt := leased
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+
+	return deliveries, nil
+}
+
+func (m *MemoryStore) RecordWebhookAttempt(ctx context.Context, deliveryID RowID, attempt *WebhookAttempt) error {
+	defer m.lock()()
+
+	for idx := range m.data.deliveries {
+		delivery := &m.data.deliveries[idx]
+		if delivery.DeliveryID != deliveryID {
+			continue
+		}
+
+		at := attempt.At.UTC()
+		delivery.State = attempt.State
+		delivery.Attempts++
+		delivery.ResponseStatus = nil
+		if attempt.ResponseStatus != 0 {
+			status := attempt.ResponseStatus
+			delivery.ResponseStatus = &status
+		}
+		delivery.Error = attempt.Error
+		delivery.NextAttemptAt = nil
+		if attempt.State == DeliveryPending {
+			retryAt := attempt.RetryAt.UTC()
+			delivery.NextAttemptAt = &retryAt
+		}
+		delivery.LastAttemptAt = &at
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) PurgeChangeEvents(ctx context.Context, before time.Time) (int64, error) {
+	defer m.lock()()
+
+	return m.purgeChangeEvents(func(event *ChangeEvent) bool {
+		return event.CreatedAt.Before(before)
+	}), nil
+}
+
+// purgeChangeEvents removes the events that match, and their deliveries.
+func (m *MemoryStore) purgeChangeEvents(match func(event *ChangeEvent) bool) int64 {
+	purged := make(map[RowID]bool)
+	events := m.data.changeEvents[:0]
+	for idx := range m.data.changeEvents {
+		event := m.data.changeEvents[idx]
+		if match(&event) {
+			purged[event.EventID] = true
+		} else {
+			events = append(events, event)
+		}
+	}
+	m.data.changeEvents = events
+
+	if len(purged) > 0 {
+		deliveries := m.data.deliveries[:0]
+		for _, delivery := range m.data.deliveries {
+			if !purged[delivery.EventID] {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		m.data.deliveries = deliveries
+	}
+
+	return int64(len(purged))
+}
+
+func (m *MemoryStore) ListChangeEvents(ctx context.Context, userID RowID, after RowID, limit int) ([]*ChangeEvent, error) {
+	defer m.rlock()()
+
+	events := make([]*ChangeEvent, 0)
+	for idx := range m.data.changeEvents {
+		event := m.data.changeEvents[idx]
+		if event.UserID != userID || event.EventID <= after || event.Type == ChangeWebhookPing {
+			continue
+		}
+		events = append(events, &event)
+		if len(events) == limit {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+func (m *MemoryStore) ChangeEventRange(ctx context.Context) (RowID, RowID, error) {
+	defer m.rlock()()
+
+	if len(m.data.changeEvents) == 0 {
+		return 0, 0, nil
+	}
+	return m.data.changeEvents[0].EventID, m.data.changeEvents[len(m.data.changeEvents)-1].EventID, nil
+}
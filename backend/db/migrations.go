@@ -0,0 +1,636 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Migration is a single, numbered change to the schema. Versions must be
+// applied in order and are never edited once released; fix a bad migration
+// by adding another one.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+
+	// UpFunc, if set, runs after Up in the same transaction, for changes
+	// that can't be written in SQL.
+	UpFunc func(ctx context.Context, tx *sql.Tx, d *dialect) error
+}
+
+// sqliteMigrations is the ordered history of the SQLite schema. The first
+// few use IF NOT EXISTS so that databases created before migrations existed
+// are adopted rather than rejected. Postgres has its own history in
+// postgres.go; a change to one almost always needs a matching migration in
+// the other.
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create users table",
+		Up: `
+CREATE TABLE IF NOT EXISTS users (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"email_address" TEXT,
+	"password_hash" TEXT
+)`,
+		Down: `DROP TABLE users`,
+	},
+	{
+		Version: 2,
+		Name:    "create vehicles table",
+		Up: `
+CREATE TABLE IF NOT EXISTS vehicles (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"year" INTEGER NOT NULL,
+	"make" STRING NOT NULL,
+	"model" STRING NOT NULL,
+	"userId" INTEGER NOT NULL,
+	
+	FOREIGN KEY (userId) REFERENCES users (id)
+)`,
+		Down: `DROP TABLE vehicles`,
+	},
+	{
+		Version: 3,
+		Name:    "create security_events table",
+		Up: `
+CREATE TABLE IF NOT EXISTS security_events (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"event_type" TEXT NOT NULL,
+	"user_id" INTEGER,
+	"actor_id" INTEGER,
+	"ip_address" TEXT NOT NULL,
+	"user_agent" TEXT NOT NULL,
+	"details" TEXT NOT NULL,
+	"created_at" DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS security_events_user_id ON security_events (user_id);
+
+CREATE TRIGGER IF NOT EXISTS security_events_no_update BEFORE UPDATE ON security_events
+BEGIN
+	SELECT RAISE(ABORT, 'security_events is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS security_events_no_delete BEFORE DELETE ON security_events
+BEGIN
+	SELECT RAISE(ABORT, 'security_events is append-only');
+END`,
+		Down: `DROP TABLE security_events`,
+	},
+	{
+		Version: 4,
+		Name:    "create admins table",
+		Up: `
+CREATE TABLE IF NOT EXISTS admins (
+	"user_id" INTEGER NOT NULL PRIMARY KEY,
+
+	FOREIGN KEY (user_id) REFERENCES users (id)
+)`,
+		Down: `DROP TABLE admins`,
+	},
+	{
+		Version: 5,
+		Name:    "add deleted_at columns",
+		Up: `
+ALTER TABLE users ADD COLUMN "deleted_at" DATETIME;
+ALTER TABLE vehicles ADD COLUMN "deleted_at" DATETIME`,
+		// SQLite can't drop columns, so the tables are rebuilt without them.
+		Down: `
+CREATE TABLE vehicles_previous (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"year" INTEGER NOT NULL,
+	"make" STRING NOT NULL,
+	"model" STRING NOT NULL,
+	"userId" INTEGER NOT NULL,
+
+	FOREIGN KEY (userId) REFERENCES users (id)
+);
+INSERT INTO vehicles_previous (id, year, make, model, userId) SELECT id, year, make, model, userId FROM vehicles;
+DROP TABLE vehicles;
+ALTER TABLE vehicles_previous RENAME TO vehicles;
+
+CREATE TABLE users_previous (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"email_address" TEXT,
+	"password_hash" TEXT
+);
+INSERT INTO users_previous (id, email_address, password_hash) SELECT id, email_address, password_hash FROM users;
+DROP TABLE users;
+ALTER TABLE users_previous RENAME TO users`,
+	},
+	{
+		Version: 6,
+		Name:    "create search_index table",
+		// FTS5 is only compiled into go-sqlite3 with the sqlite_fts5 build
+		// tag, so the index uses FTS4 and results are ranked in Go. kind and
+		// ref name the indexed row, so other kinds of record can share it.
+		Up: `
+CREATE VIRTUAL TABLE search_index USING fts4 (
+	kind, ref, user_id, title, body,
+	notindexed=kind, notindexed=ref, notindexed=user_id
+);
+
+CREATE TRIGGER search_index_vehicles_insert AFTER INSERT ON vehicles
+BEGIN
+	INSERT INTO search_index (kind, ref, user_id, title, body)
+	SELECT 'vehicle', new.id, new.userId, new.year || ' ' || new.make || ' ' || new.model, ''
+	WHERE new.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER search_index_vehicles_update AFTER UPDATE ON vehicles
+BEGIN
+	DELETE FROM search_index WHERE kind = 'vehicle' AND ref = old.id;
+	INSERT INTO search_index (kind, ref, user_id, title, body)
+	SELECT 'vehicle', new.id, new.userId, new.year || ' ' || new.make || ' ' || new.model, ''
+	WHERE new.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER search_index_vehicles_delete AFTER DELETE ON vehicles
+BEGIN
+	DELETE FROM search_index WHERE kind = 'vehicle' AND ref = old.id;
+END;
+
+INSERT INTO search_index (kind, ref, user_id, title, body)
+SELECT 'vehicle', id, userId, year || ' ' || make || ' ' || model, ''
+FROM vehicles WHERE deleted_at IS NULL`,
+		Down: `
+DROP TRIGGER search_index_vehicles_insert;
+DROP TRIGGER search_index_vehicles_update;
+DROP TRIGGER search_index_vehicles_delete;
+DROP TABLE search_index`,
+	},
+	{
+		Version: 7,
+		Name:    "create vehicle_revisions table",
+		Up: `
+CREATE TABLE vehicle_revisions (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"vehicle_id" INTEGER NOT NULL,
+	"actor_id" INTEGER,
+	"action" TEXT NOT NULL,
+	"changes" TEXT NOT NULL,
+	"reverts" INTEGER,
+	"created_at" DATETIME NOT NULL,
+
+	FOREIGN KEY (vehicle_id) REFERENCES vehicles (id),
+	FOREIGN KEY (reverts) REFERENCES vehicle_revisions (id)
+);
+
+CREATE INDEX vehicle_revisions_vehicle_id ON vehicle_revisions (vehicle_id)`,
+		Down: `DROP TABLE vehicle_revisions`,
+	},
+	{
+		Version: 8,
+		Name:    "add users.email_key",
+		Up:      `ALTER TABLE users ADD COLUMN "email_key" TEXT`,
+		UpFunc:  addEmailKeys,
+		Down: `
+DROP INDEX users_email_key;
+
+CREATE TABLE users_previous (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"email_address" TEXT,
+	"password_hash" TEXT,
+	"deleted_at" DATETIME
+);
+INSERT INTO users_previous (id, email_address, password_hash, deleted_at) SELECT id, email_address, password_hash, deleted_at FROM users;
+DROP TABLE users;
+ALTER TABLE users_previous RENAME TO users`,
+	},
+	{
+		Version: 9,
+		Name:    "add version columns",
+		Up: `
+ALTER TABLE users ADD COLUMN "version" INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE vehicles ADD COLUMN "version" INTEGER NOT NULL DEFAULT 1`,
+		// Rebuilding the tables drops their triggers and indexes too, so
+		// they're recreated as migrations 6 and 8 left them.
+		Down: `
+CREATE TABLE vehicles_previous (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"year" INTEGER NOT NULL,
+	"make" STRING NOT NULL,
+	"model" STRING NOT NULL,
+	"userId" INTEGER NOT NULL,
+	"deleted_at" DATETIME,
+
+	FOREIGN KEY (userId) REFERENCES users (id)
+);
+INSERT INTO vehicles_previous (id, year, make, model, userId, deleted_at) SELECT id, year, make, model, userId, deleted_at FROM vehicles;
+DROP TABLE vehicles;
+ALTER TABLE vehicles_previous RENAME TO vehicles;
+
+CREATE TRIGGER search_index_vehicles_insert AFTER INSERT ON vehicles
+BEGIN
+	INSERT INTO search_index (kind, ref, user_id, title, body)
+	SELECT 'vehicle', new.id, new.userId, new.year || ' ' || new.make || ' ' || new.model, ''
+	WHERE new.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER search_index_vehicles_update AFTER UPDATE ON vehicles
+BEGIN
+	DELETE FROM search_index WHERE kind = 'vehicle' AND ref = old.id;
+	INSERT INTO search_index (kind, ref, user_id, title, body)
+	SELECT 'vehicle', new.id, new.userId, new.year || ' ' || new.make || ' ' || new.model, ''
+	WHERE new.deleted_at IS NULL;
+END;
+
+CREATE TRIGGER search_index_vehicles_delete AFTER DELETE ON vehicles
+BEGIN
+	DELETE FROM search_index WHERE kind = 'vehicle' AND ref = old.id;
+END;
+
+CREATE TABLE users_previous (
+	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"email_address" TEXT,
+	"password_hash" TEXT,
+	"deleted_at" DATETIME,
+	"email_key" TEXT
+);
+INSERT INTO users_previous (id, email_address, password_hash, deleted_at, email_key) SELECT id, email_address, password_hash, deleted_at, email_key FROM users;
+DROP TABLE users;
+ALTER TABLE users_previous RENAME TO users;
+
+CREATE UNIQUE INDEX users_email_key ON users (email_key) WHERE deleted_at IS NULL`,
+	},
+	{
+		Version: 10,
+		Name:    "create idempotency_keys table",
+		Up: `
+CREATE TABLE idempotency_keys (
+	"user_id" INTEGER NOT NULL,
+	"key" TEXT NOT NULL,
+	"fingerprint" TEXT NOT NULL,
+	"status" INTEGER NOT NULL,
+	"headers" TEXT NOT NULL,
+	"body" BLOB NOT NULL,
+	"created_at" DATETIME NOT NULL,
+
+	PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at)`,
+		Down: `DROP TABLE idempotency_keys`,
+	},
+	{
+		Version: 11,
+		Name:    "create webhook tables",
+		Up: `
+CREATE TABLE webhooks (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"user_id" INTEGER NOT NULL,
+	"url" TEXT NOT NULL,
+	"events" TEXT NOT NULL,
+	"secret" TEXT NOT NULL,
+	"created_at" DATETIME NOT NULL,
+
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX webhooks_user_id ON webhooks (user_id);
+
+CREATE TABLE change_events (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"user_id" INTEGER NOT NULL,
+	"type" TEXT NOT NULL,
+	"resource" TEXT NOT NULL,
+	"resource_id" INTEGER NOT NULL,
+	"data" TEXT NOT NULL,
+	"created_at" DATETIME NOT NULL
+);
+
+CREATE INDEX change_events_user_id ON change_events (user_id, id);
+CREATE INDEX change_events_resource ON change_events (resource, resource_id);
+
+CREATE TABLE webhook_deliveries (
+	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"webhook_id" INTEGER NOT NULL,
+	"event_id" INTEGER NOT NULL,
+	"state" TEXT NOT NULL,
+	"attempts" INTEGER NOT NULL,
+	"response_status" INTEGER,
+	"error" TEXT NOT NULL,
+	"next_attempt_at" DATETIME,
+	"last_attempt_at" DATETIME,
+	"created_at" DATETIME NOT NULL,
+
+	FOREIGN KEY (webhook_id) REFERENCES webhooks (id),
+	FOREIGN KEY (event_id) REFERENCES change_events (id)
+);
+
+CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (state, next_attempt_at)`,
+		Down: `
+DROP TABLE webhook_deliveries;
+DROP TABLE change_events;
+DROP TABLE webhooks`,
+	},
+	{
+		Version: 12,
+		Name:    "let purges scrub security event details",
+		// a trigger naming columns only fires when one of them is updated,
+		// so details can be scrubbed and nothing else can change
+		Up: `
+DROP TRIGGER security_events_no_update;
+
+CREATE TRIGGER security_events_no_update
+BEFORE UPDATE OF id, event_type, user_id, actor_id, ip_address, user_agent, created_at ON security_events
+BEGIN
+	SELECT RAISE(ABORT, 'security_events is append-only');
+END`,
+		Down: `
+DROP TRIGGER security_events_no_update;
+
+CREATE TRIGGER security_events_no_update BEFORE UPDATE ON security_events
+BEGIN
+	SELECT RAISE(ABORT, 'security_events is append-only');
+END`,
+	},
+}
+
+// DuplicateEmailAddressesError is returned by the migration that makes email
+// addresses unique when accounts already share one. Accounts maps each
+// shared address to the accounts using it; they have to be merged or
+// renamed by hand before the migration can run.
+type DuplicateEmailAddressesError struct {
+	Accounts map[string][]RowID
+}
+
+func (err *DuplicateEmailAddressesError) Error() string {
+	addresses := make([]string, 0, len(err.Accounts))
+	for address := range err.Accounts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	report := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ids := make([]string, 0, len(err.Accounts[address]))
+		for _, id := range err.Accounts[address] {
+			ids = append(ids, id.String())
+		}
+		report = append(report, fmt.Sprintf("%s (users %s)", address, strings.Join(ids, ", ")))
+	}
+
+	return fmt.Sprintf(
+		"%d email addresses are shared by more than one account; rename or delete the extra accounts and migrate again: %s",
+		len(addresses), strings.Join(report, "; "),
+	)
+}
+
+// addEmailKeys fills in email_key for every user and then makes it unique
+// among the accounts that aren't in the trash. The keys are worked out in
+// Go because neither database can case fold and normalize Unicode the same
+// way.
+func addEmailKeys(ctx context.Context, tx *sql.Tx, d *dialect) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, email_address, deleted_at IS NULL FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+
+	type account struct {
+		id      RowID
+		address string
+		key     string
+	}
+	accounts := make([]account, 0)
+	active := make(map[string][]account)
+	for rows.Next() {
+		var (
+			a        account
+			address  sql.NullString
+			isActive bool
+		)
+		err = rows.Scan(&a.id, &address, &isActive)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		a.address = address.String
+		a.key = emailAddressKey(a.address)
+		accounts = append(accounts, a)
+		if isActive {
+			active[a.key] = append(active[a.key], a)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	duplicates := make(map[string][]RowID)
+	for _, shared := range active {
+		if len(shared) < 2 {
+			continue
+		}
+		for _, a := range shared {
+			duplicates[shared[0].address] = append(duplicates[shared[0].address], a.id)
+		}
+	}
+	if len(duplicates) > 0 {
+		return &DuplicateEmailAddressesError{Accounts: duplicates}
+	}
+
+	for _, a := range accounts {
+		_, err = tx.ExecContext(ctx, d.rebind(`UPDATE users SET email_key = ? WHERE id = ?`), a.key, a.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE UNIQUE INDEX users_email_key ON users (email_key) WHERE deleted_at IS NULL`)
+	return err
+}
+
+// LatestSchemaVersion is the schema version this binary was built for.
+func (s *SQLStore) LatestSchemaVersion() int {
+	return s.dialect.latestVersion()
+}
+
+type SchemaTooNewError struct {
+	DatabaseVersion int
+	BinaryVersion   int
+}
+
+func (err *SchemaTooNewError) Error() string {
+	return fmt.Sprintf(
+		"database schema version %d is newer than this binary supports (%d); upgrade vehicledb",
+		err.DatabaseVersion, err.BinaryVersion,
+	)
+}
+
+// SchemaVersion returns the highest migration applied to the database, or 0
+// for a database that has never been migrated.
+func (s *SQLStore) SchemaVersion(ctx context.Context) (int, error) {
+	_, err := s.db.ExecContext(ctx, s.dialect.schemaMigrationsTable)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	var version sql.NullInt64
+	err = s.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	return int(version.Int64), nil
+}
+
+// Migrate brings the database up to LatestSchemaVersion.
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	latest := s.LatestSchemaVersion()
+	if current > latest {
+		return &SchemaTooNewError{DatabaseVersion: current, BinaryVersion: latest}
+	}
+
+	if current == latest {
+		return nil
+	}
+
+	err = s.backupBeforeMigrating(ctx, current)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range s.dialect.migrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		log.Printf("Applying migration %d: %s", migration.Version, migration.Name)
+		err = s.applyMigration(ctx, migration, true)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// backupBeforeMigrating copies a SQLite database that already holds tables
+// next to the database file, so a failed upgrade can be rolled back by hand.
+// Postgres deployments are expected to have their own backups.
+func (s *SQLStore) backupBeforeMigrating(ctx context.Context, current int) error {
+	if s.dialect != sqliteDialect {
+		return nil
+	}
+
+	tables, err := s.getTableList(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get table list: %w", err)
+	}
+	delete(tables, "schema_migrations")
+	delete(tables, "sqlite_sequence")
+
+	if len(tables) == 0 {
+		return nil
+	}
+
+	// a migration that failed and is retried straight away has already
+	// left a backup with this timestamp
+	base := fmt.Sprintf("%s.v%d-%s", s.path, current, time.Now().UTC().Format("20060102T150405"))
+	backupPath := base + ".bak"
+	for attempt := 2; ; attempt++ {
+		if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+			break
+		}
+		backupPath = fmt.Sprintf("%s-%d.bak", base, attempt)
+	}
+	log.Printf("Backing up database to %s before migrating", backupPath)
+
+	_, err = s.db.ExecContext(ctx, `VACUUM INTO ?`, backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to back up database before migrating: %w", err)
+	}
+
+	return nil
+}
+
+// MigrateDown reverts migrations, newest first, until the database is at
+// the target version.
+func (s *SQLStore) MigrateDown(ctx context.Context, target int) error {
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	migrations := s.dialect.migrations
+	for idx := len(migrations) - 1; idx >= 0; idx-- {
+		migration := migrations[idx]
+		if migration.Version > current || migration.Version <= target {
+			continue
+		}
+
+		if migration.Down == "" {
+			return fmt.Errorf("migration %d (%s) can't be reverted", migration.Version, migration.Name)
+		}
+
+		log.Printf("Reverting migration %d: %s", migration.Version, migration.Name)
+		err = s.applyMigration(ctx, migration, false)
+		if err != nil {
+			return fmt.Errorf("failed to revert migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStore) applyMigration(ctx context.Context, migration Migration, up bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// rebuilding a table drops it while other tables still refer to it;
+	// check foreign keys once the migration is done instead of on every
+	// statement
+	if s.dialect == sqliteDialect {
+		_, err = tx.ExecContext(ctx, `PRAGMA defer_foreign_keys = ON`)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := migration.Down
+	if up {
+		query = migration.Up
+	}
+
+	_, err = tx.ExecContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	if up && migration.UpFunc != nil {
+		err = migration.UpFunc(ctx, tx, s.dialect)
+		if err != nil {
+			return err
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`), migration.Version, migration.Name, time.Now().UTC())
+	} else {
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM schema_migrations WHERE version = ?`), migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "vehicledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "migrations.sqlite")
+	store, err := OpenSQLite(dbPath, Options{SQLite: DefaultSQLiteOptions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != store.LatestSchemaVersion() {
+		t.Fatalf("expected schema version %d, got %d", store.LatestSchemaVersion(), version)
+	}
+
+	// migrating an up to date database is a no-op
+	err = store.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("failed to re-run migrations: %v", err)
+	}
+
+	// every migration can be reverted and re-applied
+	err = store.MigrateDown(ctx, 0)
+	if err != nil {
+		t.Fatalf("failed to revert migrations: %v", err)
+	}
+	tables, err := store.getTableList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables["users"] || tables["vehicles"] {
+		t.Fatalf("expected tables to be dropped, found %v", tables)
+	}
+	err = store.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("failed to re-apply migrations: %v", err)
+	}
+
+	// upgrading a database that holds data backs it up first
+	err = store.MigrateDown(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := filepath.Glob(dbPath + ".v1-*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected a backup of the v1 database, found %v", backups)
+	}
+
+	// accounts already sharing an address are reported rather than merged
+	err = store.MigrateDown(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"joe@djeebus.net", "Joe@Djeebus.net", "ann@djeebus.net"} {
+		_, err = store.db.Exec(`INSERT INTO users (email_address, password_hash) VALUES (?, '')`, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Migrate(ctx)
+	if err == nil || !strings.Contains(err.Error(), "joe@djeebus.net (users 1, 2)") {
+		t.Fatalf("expected the duplicate accounts to be reported, got %v", err)
+	}
+
+	_, err = store.db.Exec(`UPDATE users SET email_address = 'joe2@djeebus.net' WHERE id = 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a database from a newer binary is refused
+	_, err = store.db.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from the future', CURRENT_TIMESTAMP)`, store.LatestSchemaVersion()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Migrate(ctx)
+	if _, ok := err.(*SchemaTooNewError); !ok {
+		t.Fatalf("expected SchemaTooNewError, got %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListOptions asks for one page of a list. Lists are ordered by a sort key
+// and then by id, so that the order is total and a Cursor can say exactly
+// where a page stopped even when rows are added or removed in between.
+type ListOptions struct {
+	// Sort is one of the list's sort keys; "" is its default order.
+	Sort string
+	Desc bool
+	// After is where the previous page stopped; nil starts at the top.
+	After *Cursor
+	// Limit is the most items to return; 0 returns all of them.
+	Limit int
+}
+
+// Cursor is the place in a list just after an item: the item's value for
+// the sort key and its id. It remembers the order it was taken in, since it
+// means nothing in any other.
+type Cursor struct {
+	Sort  string      `json:"s,omitempty"`
+	Desc  bool        `json:"d,omitempty"`
+	Value interface{} `json:"v"`
+	ID    RowID       `json:"i,omitempty"`
+}
+
+// Encode returns the cursor as an opaque string for a client to hand back.
+func (c *Cursor) Encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// ParseCursor reads a cursor returned by Encode.
+func ParseCursor(encoded string) (*Cursor, error) {
+	invalid := NewError(ErrInvalid, "'%s' is not a valid cursor", encoded)
+
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var cursor Cursor
+	decoder := json.NewDecoder(bytes.NewReader(decoded))
+	decoder.UseNumber()
+	err = decoder.Decode(&cursor)
+	if err != nil {
+		return nil, invalid
+	}
+
+	switch value := cursor.Value.(type) {
+	case json.Number:
+		cursor.Value, err = value.Int64()
+		if err != nil {
+			return nil, invalid
+		}
+	case string, nil:
+	default:
+		return nil, invalid
+	}
+
+	return &cursor, nil
+}
+
+// cursorTimeFormat writes times in cursors at a fixed width, so that they
+// sort as strings the way they do as times.
+const cursorTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// CursorTime is a time as a sort key value.
+func CursorTime(t time.Time) string {
+	return t.UTC().Format(cursorTimeFormat)
+}
+
+// SortKey is one of the orders a list can be read in, and the column SQL
+// stores sort on for it. Column "" sorts by id alone.
+type SortKey struct {
+	Name   string
+	Column string
+}
+
+// sortKey looks up the key options ask for among a list's keys, the first
+// of which is the default.
+func sortKey(keys []SortKey, options ListOptions) (SortKey, error) {
+	key := keys[0]
+	if options.Sort != "" {
+		found := false
+		for _, k := range keys {
+			if k.Name == options.Sort {
+				key, found = k, true
+			}
+		}
+		if !found {
+			return SortKey{}, NewError(ErrInvalid, "can't sort by %s", options.Sort)
+		}
+	}
+
+	if options.After != nil && (options.After.Sort != key.Name || options.After.Desc != options.Desc) {
+		return SortKey{}, NewError(ErrInvalid, "the cursor is for a different order")
+	}
+
+	return key, nil
+}
+
+// pageQuery adds the conditions, order and limit for a page to query, which
+// must already have a WHERE clause. One row more than the limit is asked
+// for, to tell whether there's another page; see endPage.
+func pageQuery(query string, args []interface{}, key SortKey, options ListOptions) (string, []interface{}) {
+	var sql strings.Builder
+	sql.WriteString(query)
+
+	compare := ">"
+	direction := "ASC"
+	if options.Desc {
+		compare = "<"
+		direction = "DESC"
+	}
+
+	if options.After != nil {
+		if key.Column == "" {
+			fmt.Fprintf(&sql, " AND id %s ?", compare)
+			args = append(args, options.After.ID)
+		} else {
+			fmt.Fprintf(&sql, " AND (%s %s ? OR (%s = ? AND id %s ?))", key.Column, compare, key.Column, compare)
+			args = append(args, options.After.Value, options.After.Value, options.After.ID)
+		}
+	}
+
+	sql.WriteString(" ORDER BY ")
+	if key.Column != "" {
+		fmt.Fprintf(&sql, "%s %s, ", key.Column, direction)
+	}
+	fmt.Fprintf(&sql, "id %s", direction)
+
+	if options.Limit > 0 {
+		fmt.Fprintf(&sql, " LIMIT %d", options.Limit+1)
+	}
+
+	return sql.String(), args
+}
+
+// endPage works out how many of count rows, read with pageQuery, belong on
+// the page, and whether there are more after them.
+func endPage(count int, options ListOptions) (int, bool) {
+	if options.Limit > 0 && count > options.Limit {
+		return options.Limit, true
+	}
+	return count, false
+}
+
+// nextCursor is the cursor after an item read in the order options asks for.
+func nextCursor(options ListOptions, key SortKey, value interface{}, id RowID) *Cursor {
+	cursor := &Cursor{Sort: key.Name, Desc: options.Desc, ID: id}
+	if key.Column != "" {
+		cursor.Value = value
+	}
+	return cursor
+}
+
+// Page cuts a page out of a list held in memory, for lists that aren't
+// read a page at a time from the database. item returns the value for the
+// named sort key and the id of each of count items; the indexes of the items
+// on the page are returned in order, with the cursor for the next page, if
+// there is one.
+func Page(count int, keys []SortKey, options ListOptions, item func(idx int, key string) (interface{}, RowID)) ([]int, *Cursor, error) {
+	key, err := sortKey(keys, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make([]interface{}, count)
+	ids := make([]RowID, count)
+	for idx := 0; idx < count; idx++ {
+		values[idx], ids[idx] = item(idx, key.Name)
+		if key.Column == "" {
+			values[idx] = nil
+		}
+	}
+
+	// compare orders two positions, after which every comparison is
+	// reversed for descending lists
+	compare := func(valueA interface{}, idA RowID, valueB interface{}, idB RowID) int {
+		result := compareValues(valueA, valueB)
+		if result == 0 {
+			result = compareValues(int64(idA), int64(idB))
+		}
+		if options.Desc {
+			result = -result
+		}
+		return result
+	}
+
+	indexes := make([]int, 0, count)
+	for idx := 0; idx < count; idx++ {
+		if options.After == nil || compare(values[idx], ids[idx], options.After.Value, options.After.ID) > 0 {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := indexes[i], indexes[j]
+		return compare(values[a], ids[a], values[b], ids[b]) < 0
+	})
+
+	keep, more := endPage(len(indexes), options)
+	indexes = indexes[:keep]
+	if !more {
+		return indexes, nil, nil
+	}
+
+	last := indexes[len(indexes)-1]
+	return indexes, nextCursor(options, key, values[last], ids[last]), nil
+}
+
+// compareValues orders two sort key values of the same type; a cursor's
+// value is compared with items' values, so numbers may be any int type.
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	case nil:
+		return 0
+	default:
+		x, y := toInt64(a), toInt64(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+}
+
+func toInt64(value interface{}) int64 {
+	switch value := value.(type) {
+	case int64:
+		return value
+	case int:
+		return int64(value)
+	case Year:
+		return int64(value)
+	case RowID:
+		return int64(value)
+	}
+	return 0
+}
@@ -0,0 +1,321 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// ConnectPostgres opens a postgres database without touching its schema.
+// The dsn is anything lib/pq accepts, e.g.
+// postgres://vehicledb@localhost/vehicledb?sslmode=disable
+func ConnectPostgres(dsn string, options Options) (*SQLStore, error) {
+	sqlDb, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres: %w", err)
+	}
+
+	err = sqlDb.Ping()
+	if err != nil {
+		sqlDb.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	log.Printf("Database: postgres")
+
+	return &SQLStore{db: sqlDb, conn: sqlDb, reader: sqlDb, dialect: postgresDialect, options: options}, nil
+}
+
+// OpenPostgres opens a postgres database and migrates it to the latest schema.
+func OpenPostgres(dsn string, options Options) (*SQLStore, error) {
+	store, err := ConnectPostgres(dsn, options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Migrate(context.Background())
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to migrate postgres: %w", err)
+	}
+
+	return store, nil
+}
+
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create users table",
+		Up: `
+CREATE TABLE users (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	email_address TEXT,
+	password_hash BYTEA
+)`,
+		Down: `DROP TABLE users`,
+	},
+	{
+		Version: 2,
+		Name:    "create vehicles table",
+		Up: `
+CREATE TABLE vehicles (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	year INTEGER NOT NULL,
+	make TEXT NOT NULL,
+	model TEXT NOT NULL,
+	userId BIGINT NOT NULL REFERENCES users (id)
+)`,
+		Down: `DROP TABLE vehicles`,
+	},
+	{
+		Version: 3,
+		Name:    "create security_events table",
+		Up: `
+CREATE TABLE security_events (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	event_type TEXT NOT NULL,
+	user_id BIGINT,
+	actor_id BIGINT,
+	ip_address TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	details TEXT NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX security_events_user_id ON security_events (user_id);
+
+CREATE FUNCTION security_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'security_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER security_events_append_only BEFORE UPDATE OR DELETE ON security_events
+	FOR EACH ROW EXECUTE PROCEDURE security_events_append_only()`,
+		Down: `
+DROP TABLE security_events;
+DROP FUNCTION security_events_append_only()`,
+	},
+	{
+		Version: 4,
+		Name:    "create admins table",
+		Up: `
+CREATE TABLE admins (
+	user_id BIGINT NOT NULL PRIMARY KEY REFERENCES users (id)
+)`,
+		Down: `DROP TABLE admins`,
+	},
+	{
+		Version: 5,
+		Name:    "add deleted_at columns",
+		Up: `
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE vehicles ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE`,
+		Down: `
+ALTER TABLE vehicles DROP COLUMN deleted_at;
+ALTER TABLE users DROP COLUMN deleted_at`,
+	},
+	{
+		Version: 6,
+		Name:    "create search_index table",
+		Up: `
+CREATE TABLE search_index (
+	kind TEXT NOT NULL,
+	ref BIGINT NOT NULL,
+	user_id BIGINT NOT NULL,
+	title TEXT NOT NULL,
+	body TEXT NOT NULL,
+	document TSVECTOR NOT NULL,
+	PRIMARY KEY (kind, ref)
+);
+
+CREATE INDEX search_index_document ON search_index USING GIN (document);
+
+CREATE FUNCTION search_index_vehicles() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP <> 'INSERT' THEN
+		DELETE FROM search_index WHERE kind = 'vehicle' AND ref = OLD.id;
+	END IF;
+	IF TG_OP <> 'DELETE' AND NEW.deleted_at IS NULL THEN
+		INSERT INTO search_index (kind, ref, user_id, title, body, document)
+		VALUES ('vehicle', NEW.id, NEW.userId, NEW.year || ' ' || NEW.make || ' ' || NEW.model, '',
+			setweight(to_tsvector('english', NEW.year || ' ' || NEW.make || ' ' || NEW.model), 'A'));
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER search_index_vehicles AFTER INSERT OR UPDATE OR DELETE ON vehicles
+	FOR EACH ROW EXECUTE PROCEDURE search_index_vehicles();
+
+INSERT INTO search_index (kind, ref, user_id, title, body, document)
+SELECT 'vehicle', id, userId, year || ' ' || make || ' ' || model, '',
+	setweight(to_tsvector('english', year || ' ' || make || ' ' || model), 'A')
+FROM vehicles WHERE deleted_at IS NULL`,
+		Down: `
+DROP TRIGGER search_index_vehicles ON vehicles;
+DROP FUNCTION search_index_vehicles();
+DROP TABLE search_index`,
+	},
+	{
+		Version: 7,
+		Name:    "create vehicle_revisions table",
+		Up: `
+CREATE TABLE vehicle_revisions (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	vehicle_id BIGINT NOT NULL REFERENCES vehicles (id),
+	actor_id BIGINT,
+	action TEXT NOT NULL,
+	changes TEXT NOT NULL,
+	reverts BIGINT REFERENCES vehicle_revisions (id),
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX vehicle_revisions_vehicle_id ON vehicle_revisions (vehicle_id)`,
+		Down: `DROP TABLE vehicle_revisions`,
+	},
+	{
+		Version: 8,
+		Name:    "add users.email_key",
+		Up:      `ALTER TABLE users ADD COLUMN email_key TEXT`,
+		UpFunc:  addEmailKeys,
+		Down: `
+DROP INDEX users_email_key;
+ALTER TABLE users DROP COLUMN email_key`,
+	},
+	{
+		Version: 9,
+		Name:    "add version columns",
+		Up: `
+ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE vehicles ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+		Down: `
+ALTER TABLE vehicles DROP COLUMN version;
+ALTER TABLE users DROP COLUMN version`,
+	},
+	{
+		Version: 10,
+		Name:    "create idempotency_keys table",
+		Up: `
+CREATE TABLE idempotency_keys (
+	user_id BIGINT NOT NULL,
+	key TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	headers TEXT NOT NULL,
+	body BYTEA NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+
+	PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX idempotency_keys_created_at ON idempotency_keys (created_at)`,
+		Down: `DROP TABLE idempotency_keys`,
+	},
+	{
+		Version: 11,
+		Name:    "create webhook tables",
+		Up: `
+CREATE TABLE webhooks (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users (id),
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX webhooks_user_id ON webhooks (user_id);
+
+CREATE TABLE change_events (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	user_id BIGINT NOT NULL,
+	type TEXT NOT NULL,
+	resource TEXT NOT NULL,
+	resource_id BIGINT NOT NULL,
+	data TEXT NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX change_events_user_id ON change_events (user_id, id);
+CREATE INDEX change_events_resource ON change_events (resource, resource_id);
+
+CREATE TABLE webhook_deliveries (
+	id BIGSERIAL NOT NULL PRIMARY KEY,
+	webhook_id BIGINT NOT NULL REFERENCES webhooks (id),
+	event_id BIGINT NOT NULL REFERENCES change_events (id),
+	state TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	response_status INTEGER,
+	error TEXT NOT NULL,
+	next_attempt_at TIMESTAMP WITH TIME ZONE,
+	last_attempt_at TIMESTAMP WITH TIME ZONE,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (state, next_attempt_at)`,
+		Down: `
+DROP TABLE webhook_deliveries;
+DROP TABLE change_events;
+DROP TABLE webhooks`,
+	},
+	{
+		Version: 12,
+		Name:    "let purges scrub security event details",
+		Up: `
+CREATE OR REPLACE FUNCTION security_events_append_only() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' AND
+		(NEW.id, NEW.event_type, NEW.user_id, NEW.actor_id, NEW.ip_address, NEW.user_agent, NEW.created_at) IS NOT DISTINCT FROM
+		(OLD.id, OLD.event_type, OLD.user_id, OLD.actor_id, OLD.ip_address, OLD.user_agent, OLD.created_at) THEN
+		RETURN NEW;
+	END IF;
+	RAISE EXCEPTION 'security_events is append-only';
+END;
+$$ LANGUAGE plpgsql`,
+		Down: `
+CREATE OR REPLACE FUNCTION security_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'security_events is append-only';
+END;
+$$ LANGUAGE plpgsql`,
+	},
+}
+
+// searchPostgres is Search against the tsvector index. Every term is a
+// prefix match and any of them can match, as with the SQLite index.
+func (s *SQLStore) searchPostgres(ctx context.Context, userID RowID, terms []string, limit int) ([]*SearchResult, error) {
+	for idx, term := range terms {
+		terms[idx] = term + ":*"
+	}
+
+	headlineOptions := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=12, MinWords=4", snippetStart, snippetEnd)
+	query := `SELECT kind, ref, title, ts_headline('english', title || ' ' || body, query, ?), ts_rank(document, query) AS rank
+FROM search_index, to_tsquery('english', ?) query
+WHERE user_id = ? AND document @@ query
+ORDER BY rank DESC
+LIMIT ?`
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), headlineOptions, strings.Join(terms, " | "), userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute search query: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]*SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		err = rows.Scan(&result.Kind, &result.ID, &result.Title, &result.Snippet, &result.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		result.Snippet = highlightSnippet(result.Snippet)
+		results = append(results, &result)
+	}
+
+	return results, rows.Err()
+}
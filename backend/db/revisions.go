@@ -0,0 +1,320 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	RevisionCreated  = "created"
+	RevisionUpdated  = "updated"
+	RevisionDeleted  = "deleted"
+	RevisionRestored = "restored"
+	RevisionReverted = "reverted"
+)
+
+// VehicleRevision is one write to a vehicle. Changes maps each field the
+// write changed to its value before and after; deletes and restores don't
+// change any fields. Reverts is the revision a revert undid.
+type VehicleRevision struct {
+	RevisionID RowID                  `json:"revision_id"`
+	VehicleID  RowID                  `json:"vehicle_id"`
+	ActorID    *RowID                 `json:"actor_id"`
+	Action     string                 `json:"action"`
+	Changes    map[string]FieldChange `json:"changes"`
+	Reverts    *RowID                 `json:"reverts,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// FieldChange is a field's JSON value before and after a revision.
+type FieldChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+type VehicleHistoryStore interface {
+	// ListVehicleRevisions returns a vehicle's history, newest first.
+	ListVehicleRevisions(ctx context.Context, vehicleID RowID) ([]*VehicleRevision, error)
+
+	// GetVehicleRevision returns a *RevisionNotFoundError when there is no
+	// such revision.
+	GetVehicleRevision(ctx context.Context, revisionID RowID) (*VehicleRevision, error)
+
+	// RevertVehicleRevision puts the fields a revision changed back the way
+	// they were, recording the revert as a revision of its own. A version
+	// other than 0 has to be the vehicle's current one, as for UpdateVehicle.
+	RevertVehicleRevision(ctx context.Context, revisionID RowID, version int64) (*Vehicle, error)
+}
+
+// ErrRevisionNotRevertible is returned when reverting a revision that didn't
+// change any fields, or that created the vehicle.
+var ErrRevisionNotRevertible error = NewError(ErrConflict, "only updates can be reverted")
+
+// RevertConflictError is returned when a field a revision changed has been
+// changed again since, so reverting it would throw the later change away.
+type RevertConflictError struct {
+	Fields []string
+}
+
+func (err *RevertConflictError) Error() string {
+	return fmt.Sprintf("%s changed again after this revision", strings.Join(err.Fields, ", "))
+}
+
+func (err *RevertConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+func (err *RevertConflictError) Details() map[string]interface{} {
+	return map[string]interface{}{"fields": err.Fields}
+}
+
+type actorContextKey struct{}
+
+// WithActor returns a copy of ctx naming the user responsible for the writes
+// made with it. Revisions record them as the actor.
+func WithActor(ctx context.Context, userID RowID) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, userID)
+}
+
+func actorFromContext(ctx context.Context) *RowID {
+	userID, ok := ctx.Value(actorContextKey{}).(RowID)
+	if !ok {
+		return nil
+	}
+	return &userID
+}
+
+// vehicleFields are the fields of a vehicle that revisions track, as they
+// are named in its JSON.
+func vehicleFields(vehicle *Vehicle) map[string]interface{} {
+	if vehicle == nil {
+		return map[string]interface{}{"year": nil, "make": nil, "model": nil}
+	}
+	return map[string]interface{}{"year": vehicle.Year, "make": vehicle.Make, "model": vehicle.Model}
+}
+
+// diffVehicles lists the fields that differ between two versions of a
+// vehicle; before is nil for a new vehicle.
+func diffVehicles(before *Vehicle, after *Vehicle) (map[string]FieldChange, error) {
+	changes := make(map[string]FieldChange)
+
+	beforeFields, afterFields := vehicleFields(before), vehicleFields(after)
+	for field, value := range afterFields {
+		from, err := json.Marshal(beforeFields[field])
+		if err != nil {
+			return nil, err
+		}
+		to, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(from, to) {
+			changes[field] = FieldChange{From: from, To: to}
+		}
+	}
+
+	return changes, nil
+}
+
+// applyVehicleChanges returns a copy of vehicle with the given updates made.
+// A field that's nil or not Valid is left alone.
+func applyVehicleChanges(vehicle Vehicle, year *NullYear, vehicleMake, model *NullString) *Vehicle {
+	if year != nil && year.Valid {
+		vehicle.Year = year.Year
+	}
+	if vehicleMake != nil && vehicleMake.Valid {
+		vehicle.Make = vehicleMake.String
+	}
+	if model != nil && model.Valid {
+		vehicle.Model = model.String
+	}
+	return &vehicle
+}
+
+// revertValues works out the update that undoes a revision, as long as
+// nothing it changed has changed again since.
+func revertValues(vehicle *Vehicle, revision *VehicleRevision) (*NullYear, *NullString, *NullString, error) {
+	if (revision.Action != RevisionUpdated && revision.Action != RevisionReverted) || len(revision.Changes) == 0 {
+		return nil, nil, nil, ErrRevisionNotRevertible
+	}
+
+	current, err := diffVehicles(nil, vehicle)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conflicts := make([]string, 0)
+	for field, change := range revision.Changes {
+		if !bytes.Equal(current[field].To, change.To) {
+			conflicts = append(conflicts, field)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, nil, nil, &RevertConflictError{Fields: conflicts}
+	}
+
+	year, vehicleMake, model := &NullYear{}, &NullString{}, &NullString{}
+	decode := func(field string, into interface{}) error {
+		change, ok := revision.Changes[field]
+		if !ok {
+			return nil
+		}
+		return json.Unmarshal(change.From, into)
+	}
+
+	err = decode("year", &year.Year)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = decode("make", &vehicleMake.String)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = decode("model", &model.String)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, year.Valid = revision.Changes["year"]
+	_, vehicleMake.Valid = revision.Changes["make"]
+	_, model.Valid = revision.Changes["model"]
+
+	return year, vehicleMake, model, nil
+}
+
+// recordVehicleRevision appends a revision made by the context's actor, and
+// the event it makes for the owner's webhooks.
+func (s *SQLStore) recordVehicleRevision(ctx context.Context, vehicleID RowID, action string, changes map[string]FieldChange, reverts *RowID) error {
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode revision: %w", err)
+	}
+
+	query := `INSERT INTO vehicle_revisions (vehicle_id, actor_id, action, changes, reverts, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	revisionID, err := s.insert(ctx, query, vehicleID, actorFromContext(ctx), action, string(encoded), reverts, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record vehicle revision: %w", err)
+	}
+
+	// deleted vehicles too, for vehicle.deleted
+	query = `SELECT id, userId, year, make, model, version, deleted_at FROM vehicles WHERE id = ?`
+	vehicles, err := s.queryDeletedVehicles(ctx, query, vehicleID)
+	if err != nil {
+		return err
+	}
+	if len(vehicles) == 0 {
+		return &VehicleNotFoundError{VehicleID: vehicleID}
+	}
+
+	event, err := vehicleChangeEvent(vehicles[0], revisionID, action, changes)
+	if err != nil {
+		return err
+	}
+	return s.recordChangeEvent(ctx, event)
+}
+
+func (s *SQLStore) ListVehicleRevisions(ctx context.Context, vehicleID RowID) ([]*VehicleRevision, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, vehicle_id, actor_id, action, changes, reverts, created_at FROM vehicle_revisions WHERE vehicle_id = ? ORDER BY id DESC`
+	return s.queryVehicleRevisions(ctx, query, vehicleID)
+}
+
+func (s *SQLStore) GetVehicleRevision(ctx context.Context, revisionID RowID) (*VehicleRevision, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, vehicle_id, actor_id, action, changes, reverts, created_at FROM vehicle_revisions WHERE id = ?`
+	revisions, err := s.queryVehicleRevisions(ctx, query, revisionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, &RevisionNotFoundError{RevisionID: revisionID}
+	}
+
+	return revisions[0], nil
+}
+
+func (s *SQLStore) queryVehicleRevisions(ctx context.Context, query string, args ...interface{}) ([]*VehicleRevision, error) {
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute list vehicle revisions query: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := make([]*VehicleRevision, 0)
+
+	for rows.Next() {
+		var (
+			revision VehicleRevision
+			changes  string
+		)
+		err = rows.Scan(&revision.RevisionID, &revision.VehicleID, &revision.ActorID, &revision.Action, &changes, &revision.Reverts, &revision.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		err = json.Unmarshal([]byte(changes), &revision.Changes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode revision %d: %w", revision.RevisionID, err)
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (s *SQLStore) RevertVehicleRevision(ctx context.Context, revisionID RowID, version int64) (*Vehicle, error) {
+	var vehicle *Vehicle
+
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		revision, err := sqlTx.GetVehicleRevision(ctx, revisionID)
+		if err != nil {
+			return err
+		}
+
+		vehicle, err = sqlTx.GetVehicle(ctx, revision.VehicleID)
+		if errors.Is(err, ErrNotFound) {
+			return &RevisionNotFoundError{RevisionID: revisionID}
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkVersion(version, vehicle.Version)
+		if err != nil {
+			return err
+		}
+
+		year, vehicleMake, model, err := revertValues(vehicle, revision)
+		if err != nil {
+			return err
+		}
+
+		err = sqlTx.updateVehicle(ctx, vehicle.VehicleID, vehicle.Version, year, vehicleMake, model, RevisionReverted, &revisionID)
+		if err != nil {
+			return err
+		}
+
+		vehicle, err = sqlTx.GetVehicle(ctx, vehicle.VehicleID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return vehicle, nil
+}
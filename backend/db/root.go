@@ -1,17 +1,20 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var sqlDb *sql.DB
 type RowID int64
 
 func (r RowID) String() string {
@@ -21,88 +24,331 @@ func (r RowID) String() string {
 func ParseRowID(rowID string) (RowID, error) {
 	rowId, err := strconv.ParseInt(rowID, 10, 64)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse row id: %v", err)
+		// nothing can have an id that isn't a number
+		return 0, NewError(ErrNotFound, "'%s' is not a valid id", rowID)
 	}
 
 	return RowID(rowId), nil
 }
 
+// ensureDatabaseExists creates an empty database file if there isn't one,
+// and otherwise leaves the file alone; it never truncates it.
 func ensureDatabaseExists(dbPath string) (string, error) {
 	fullPath, err := filepath.Abs(dbPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to find abs path for %s: %v", dbPath, err)
 	}
 
-	// todo: this seem unnecessarily complex. really??
 	info, err := os.Stat(fullPath)
-	if err != nil && !os.IsNotExist(err) {
-		return "", fmt.Errorf("failed to find info on the db file: %v", err)
-	} else if info != nil && info.IsDir() {
-		return "", fmt.Errorf("database path '%s' is a directory", fullPath)
+	if err == nil {
+		if info.IsDir() {
+			return "", fmt.Errorf("database path '%s' is a directory", fullPath)
+		}
+		return fullPath, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to find info on the db file: %w", err)
 	}
 
-	file, err := os.Create(fullPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create '%s': %v", fullPath, err)
+	if _, err := os.Stat(filepath.Dir(fullPath)); err != nil {
+		return "", fmt.Errorf("can't create '%s': %w", fullPath, err)
 	}
 
-	defer file.Close()
+	// O_EXCL, so a file that appeared since the Stat is left alone too
+	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create '%s': %v", fullPath, err)
+	}
+	if file != nil {
+		file.Close()
+	}
 
 	return fullPath, nil
 }
 
-var tableSchemas = map[string]string{
-	"users": usersTable,
-	"vehicles": vehiclesTable,
+// Options tunes how a Store talks to its database.
+type Options struct {
+	// QueryTimeout bounds every store call; zero means a call only ends
+	// when the caller's context does.
+	QueryTimeout time.Duration
+
+	// SQLite configures SQLite connections; postgres ignores it.
+	SQLite SQLiteOptions
+}
+
+// SQLiteOptions are applied to every SQLite connection. The zero value
+// leaves SQLite's own defaults alone and uses a single connection pool.
+type SQLiteOptions struct {
+	// ForeignKeys enforces the REFERENCES clauses in the schema.
+	ForeignKeys bool
+
+	// JournalMode and Synchronous set the pragmas of the same names, e.g.
+	// "wal" and "normal"; empty leaves them alone.
+	JournalMode string
+	Synchronous string
+
+	// BusyTimeout is how long a connection waits on another's lock before
+	// failing with "database is locked".
+	BusyTimeout time.Duration
+
+	// Readers is the size of a separate pool of read-only connections.
+	// When it's set, writes go through a single connection so they queue
+	// in the server instead of fighting over SQLite's lock; with WAL
+	// journaling, reads carry on while a write is in progress.
+	Readers int
+}
+
+// DefaultSQLiteOptions suit a server shared by a handful of people.
+var DefaultSQLiteOptions = SQLiteOptions{
+	ForeignKeys: true,
+	JournalMode: "wal",
+	Synchronous: "normal",
+	BusyTimeout: 5 * time.Second,
+	Readers:     4,
+}
+
+// dsn builds the go-sqlite3 connection string for the file at path, either
+// for the writer or for the read-only pool. Parameters given with the
+// database's DSN take precedence over the options.
+func (o SQLiteOptions) dsn(path string, dsnParams url.Values, readOnly bool) string {
+	params := url.Values{}
+	if o.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10))
+	}
+
+	if readOnly {
+		params.Set("_query_only", "1")
+	} else {
+		if o.ForeignKeys {
+			params.Set("_foreign_keys", "1")
+		}
+		if o.JournalMode != "" {
+			params.Set("_journal_mode", o.JournalMode)
+		}
+		if o.Synchronous != "" {
+			params.Set("_synchronous", o.Synchronous)
+		}
+		if o.Readers > 0 {
+			// take the write lock up front, so a transaction that reads
+			// before it writes can't deadlock against another process
+			params.Set("_txlock", "immediate")
+		}
+	}
+
+	for key, values := range dsnParams {
+		if readOnly && key == "_query_only" {
+			continue
+		}
+		params[key] = values
+	}
+
+	if len(params) == 0 {
+		return path
+	}
+
+	fileURL := url.URL{Scheme: "file", Path: path, RawQuery: params.Encode()}
+	return fileURL.String()
+}
+
+// SQLStore is the Store backed by a database/sql connection, either SQLite
+// or postgres depending on its dialect.
+type SQLStore struct {
+	db      *sql.DB
+	dialect *dialect
+	options Options
+
+	// readDB is the read-only SQLite pool, when there is one
+	readDB *sql.DB
+
+	// conn is db itself, or the transaction when the store was handed to
+	// an InTx callback. reader is the same but prefers readDB; queries that
+	// never write should use it.
+	conn   queryer
+	reader queryer
+	tx     *sql.Tx
+
+	// path is the database file, for SQLite only
+	path string
+}
+
+// queryer is what *sql.DB and *sql.Tx have in common.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Connect opens the database named by dsn without touching its schema.
+// postgres:// and postgresql:// URLs select postgres; anything else is a
+// SQLite database, as for ConnectSQLite.
+func Connect(dsn string, options Options) (*SQLStore, error) {
+	if IsMemoryDSN(dsn) {
+		return nil, fmt.Errorf("an in-memory database only exists inside the server that created it")
+	}
+	if isPostgresDSN(dsn) {
+		return ConnectPostgres(dsn, options)
+	}
+	return ConnectSQLite(dsn, options)
+}
+
+// Open opens the database named by dsn, as for Connect, and migrates it to
+// the latest schema. A dsn of "memory" opens an empty MemoryStore instead,
+// which lasts as long as the process.
+func Open(dsn string, options Options) (Store, error) {
+	if IsMemoryDSN(dsn) {
+		log.Printf("Database: in memory; nothing will be saved")
+		return NewMemoryStore(), nil
+	}
+	if isPostgresDSN(dsn) {
+		return OpenPostgres(dsn, options)
+	}
+	return OpenSQLite(dsn, options)
+}
+
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// IsMemoryDSN reports whether dsn asks for an in-memory database.
+func IsMemoryDSN(dsn string) bool {
+	return dsn == "memory" || dsn == "memory://" || dsn == ":memory:"
 }
 
-func OpenDatabase(dbPath string) {
-	var err error
+// parseSQLiteDSN splits a SQLite DSN into the database file and the
+// connection parameters given with it. The DSN is a plain path, a sqlite://
+// URL or a file: URI, e.g. file:/var/lib/vehicledb.sqlite?_busy_timeout=10000.
+func parseSQLiteDSN(dsn string) (string, url.Values, error) {
+	path := dsn
+	switch {
+	case strings.HasPrefix(path, "sqlite://"):
+		path = strings.TrimPrefix(path, "sqlite://")
+	case strings.HasPrefix(path, "file:"):
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "file:"), "//")
+	default:
+		return path, url.Values{}, nil
+	}
+
+	query := ""
+	if pos := strings.IndexRune(path, '?'); pos >= 0 {
+		path, query = path[:pos], path[pos+1:]
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid parameters in '%s': %v", dsn, err)
+	}
+	if path == "" {
+		return "", nil, fmt.Errorf("'%s' doesn't name a database file", dsn)
+	}
+
+	return path, params, nil
+}
+
+// withTimeout applies the configured query timeout on top of whatever
+// deadline the caller's context already has.
+func (s *SQLStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.options.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.options.QueryTimeout)
+}
+
+func (s *SQLStore) rebind(query string) string {
+	return s.dialect.rebind(query)
+}
+
+// insert runs an INSERT and returns the id of the new row.
+func (s *SQLStore) insert(ctx context.Context, query string, args ...interface{}) (RowID, error) {
+	if s.dialect.returningID {
+		var id RowID
+		err := s.conn.QueryRowContext(ctx, s.rebind(query+" RETURNING id"), args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := s.conn.ExecContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	lastInserted, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve last inserted id: %w", err)
+	}
+
+	return RowID(lastInserted), nil
+}
+
+// ConnectSQLite opens a SQLite database without touching its schema. The
+// file is created if it doesn't exist yet. dsn is a path or a URL, as for
+// parseSQLiteDSN.
+func ConnectSQLite(dsn string, options Options) (*SQLStore, error) {
+	dbPath, params, err := parseSQLiteDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
 
 	dbPath, err = ensureDatabaseExists(dbPath)
+	if err != nil {
+		return nil, err
+	}
 	log.Printf("Database path: %s", dbPath)
 
-	sqlDb, err = sql.Open("sqlite3", dbPath)
+	sqlDb, err := sql.Open("sqlite3", options.SQLite.dsn(dbPath, params, false))
 	if err != nil {
-		log.Fatalf("Failed to open '%s': %v", dbPath, err)
+		return nil, fmt.Errorf("failed to open '%s': %v", dbPath, err)
 	}
 
-	tables, err := getTableList()
+	store := &SQLStore{db: sqlDb, conn: sqlDb, reader: sqlDb, dialect: sqliteDialect, options: options, path: dbPath}
+	if options.SQLite.Readers <= 0 {
+		return store, nil
+	}
+
+	sqlDb.SetMaxOpenConns(1)
+
+	// the writer has to set up the journal before anything reads through
+	// a query-only connection
+	err = sqlDb.Ping()
 	if err != nil {
-		log.Fatalf("Failed to get table list: %v", err)
+		sqlDb.Close()
+		return nil, fmt.Errorf("failed to open '%s': %v", dbPath, err)
 	}
 
-	for tableName, tableSchema := range tableSchemas {
-		if _, ok := tables[tableName]; !ok {
-			err = createTable(tableSchema)
-			if err != nil {
-				log.Fatalf("Failed to create %s table: %v", tableName, err)
-			}
-		}
+	readDb, err := sql.Open("sqlite3", options.SQLite.dsn(dbPath, params, true))
+	if err != nil {
+		sqlDb.Close()
+		return nil, fmt.Errorf("failed to open '%s' for reading: %v", dbPath, err)
 	}
+	readDb.SetMaxOpenConns(options.SQLite.Readers)
+	readDb.SetMaxIdleConns(options.SQLite.Readers)
+
+	store.readDB = readDb
+	store.reader = readDb
+	return store, nil
 }
 
-func createTable(query string) error {
-	stmt, err := sqlDb.Prepare(query)
+// OpenSQLite opens a SQLite database and migrates it to the latest schema.
+func OpenSQLite(dsn string, options Options) (*SQLStore, error) {
+	store, err := ConnectSQLite(dsn, options)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = stmt.Exec()
+	err = store.Migrate(context.Background())
 	if err != nil {
-		return err
+		store.Close()
+		return nil, fmt.Errorf("failed to migrate '%s': %v", store.path, err)
 	}
 
-	return nil
+	return store, nil
 }
 
-func getTableList() (map[string]bool, error) {
-	query := `SELECT name FROM sqlite_master WHERE type='table'`
-	stmt, err := sqlDb.Prepare(query)
+func (s *SQLStore) getTableList(ctx context.Context) (map[string]bool, error) {
+	stmt, err := s.db.PrepareContext(ctx, s.dialect.listTablesQuery)
 	if err != nil {
 		return nil, err
 	}
-	row, err := stmt.Query()
+	row, err := stmt.QueryContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -123,12 +369,51 @@ func getTableList() (map[string]bool, error) {
 	return tables, nil
 }
 
-func CloseDatabase() error {
+// InTx runs fn in a transaction, committing when it returns nil and rolling
+// back otherwise. Calling InTx on the store passed to fn joins the existing
+// transaction rather than starting another.
+func (s *SQLStore) InTx(ctx context.Context, fn func(tx Tx) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	txStore := *s
+	txStore.conn = tx
+	txStore.reader = tx
+	txStore.tx = tx
+
+	err = fn(&txStore)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SQLStore) Close() error {
 	fmt.Println("closing database")
-	err := sqlDb.Close()
+	if s.readDB != nil {
+		err := s.readDB.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.db.Close()
 	if err != nil {
 		return err
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unsafe"
+)
+
+// SearchKindVehicle is the kind of search result that refers to a vehicle.
+const SearchKindVehicle = "vehicle"
+
+// maxSearchTerms keeps a pasted paragraph from turning into a huge query.
+const maxSearchTerms = 16
+
+// SearchResult is one match of a search. Snippet is HTML: the text around
+// the match, escaped, with the matching words wrapped in <mark>.
+type SearchResult struct {
+	Kind    string  `json:"kind"`
+	ID      RowID   `json:"id"`
+	Title   string  `json:"title"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+}
+
+type SearchStore interface {
+	// Search returns the user's records that match any word of query,
+	// best match first. Words match as prefixes, so "chev" finds "Chevy".
+	Search(ctx context.Context, userID RowID, query string, limit int) ([]*SearchResult, error)
+}
+
+// searchTerms splits a query into lower case words, dropping punctuation
+// so that nothing the user types is taken as query syntax.
+func searchTerms(query string) []string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]bool)
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+
+		terms = append(terms, word)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+
+	return terms
+}
+
+// snippet markers are control characters, which can't appear in the indexed
+// text, so they survive escaping and are then swapped for the real tags.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.Replace(snippet, snippetStart, "<mark>", -1)
+	return strings.Replace(snippet, snippetEnd, "</mark>", -1)
+}
+
+func (s *SQLStore) Search(ctx context.Context, userID RowID, query string, limit int) ([]*SearchResult, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return make([]*SearchResult, 0), nil
+	}
+
+	if s.dialect == postgresDialect {
+		return s.searchPostgres(ctx, userID, terms, limit)
+	}
+
+	for idx, term := range terms {
+		terms[idx] = term + "*"
+	}
+
+	stmt := `SELECT kind, ref, title, snippet(search_index, ?, ?, '…', -1, 12), matchinfo(search_index, 'pcnalx')
+FROM search_index WHERE search_index MATCH ? AND user_id = ?`
+	rows, err := s.reader.QueryContext(ctx, s.rebind(stmt), snippetStart, snippetEnd, strings.Join(terms, " OR "), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute search query: %w", err)
+	}
+	defer rows.Close()
+
+	results := make([]*SearchResult, 0)
+	for rows.Next() {
+		var (
+			result    SearchResult
+			matchinfo []byte
+		)
+		err = rows.Scan(&result.Kind, &result.ID, &result.Title, &result.Snippet, &matchinfo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		result.Snippet = highlightSnippet(result.Snippet)
+		result.Rank = bm25(matchinfo)
+		results = append(results, &result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rankResults(results, limit), nil
+}
+
+// searchColumnWeights weights matches in each column of search_index:
+// kind, ref and user_id aren't indexed, and a match in the title counts for
+// more than one in the body.
+var searchColumnWeights = []float64{0, 0, 0, 2, 1}
+
+// nativeEndian is the byte order of the host, which SQLite writes matchinfo
+// in.
+var nativeEndian = func() binary.ByteOrder {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// bm25 scores a row from the matchinfo 'pcnalx' blob FTS4 returns for it,
+// the way FTS5's built-in ranking would. matchinfo is a list of 32 bit
+// integers in the host's byte order.
+func bm25(matchinfo []byte) float64 {
+	const (
+		k1 = 1.2
+		b  = 0.75
+	)
+
+	info := make([]float64, len(matchinfo)/4)
+	for idx := range info {
+		info[idx] = float64(nativeEndian.Uint32(matchinfo[idx*4:]))
+	}
+	if len(info) < 3 {
+		return 0
+	}
+
+	phrases, columns, rows := int(info[0]), int(info[1]), info[2]
+	averageLengths := info[3 : 3+columns]
+	lengths := info[3+columns : 3+2*columns]
+	hits := info[3+2*columns:]
+
+	score := 0.0
+	for phrase := 0; phrase < phrases; phrase++ {
+		for column := 0; column < columns && column < len(searchColumnWeights); column++ {
+			weight := searchColumnWeights[column]
+			base := 3 * (phrase*columns + column)
+			frequency, rowsWithHits := hits[base], hits[base+2]
+			if weight == 0 || frequency == 0 {
+				continue
+			}
+
+			idf := math.Max(math.Log((rows-rowsWithHits+0.5)/(rowsWithHits+0.5)), 1e-6)
+			lengthRatio := 1.0
+			if averageLengths[column] > 0 {
+				lengthRatio = lengths[column] / averageLengths[column]
+			}
+
+			score += weight * idf * frequency * (k1 + 1) / (frequency + k1*(1-b+b*lengthRatio))
+		}
+	}
+
+	return score
+}
+
+// rankResults sorts results best first and keeps the first limit of them.
+func rankResults(results []*SearchResult, limit int) []*SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Rank > results[j].Rank
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	EventUserCreated  = "user.created"
+	EventLogin        = "login.succeeded"
+	EventLoginFailed  = "login.failed"
+	EventLogout       = "logout"
+	EventEmailChanged = "user.email_changed"
+	EventAdminAction  = "admin.action"
+	EventUserDeleted  = "user.deleted"
+	EventUserRestored = "user.restored"
+	EventUserPurged   = "user.purged"
+)
+
+// SecurityEvent is a row in the append-only security log. UserID is the
+// account the event concerns and ActorID is whoever caused it; they differ
+// for admin actions and are both nil for failed logins against unknown
+// addresses. The only change ever made to an event is scrubbing the
+// IdentifyingDetails from it when its account is purged.
+type SecurityEvent struct {
+	EventID   RowID             `json:"event_id"`
+	EventType string            `json:"event_type"`
+	UserID    *RowID            `json:"user_id"`
+	ActorID   *RowID            `json:"actor_id"`
+	IPAddress string            `json:"ip_address"`
+	UserAgent string            `json:"user_agent"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// IdentifyingDetails are the details of security events that say who an
+// account belonged to. Purging an account removes them from the events
+// concerning it; the rest of those events, ids, IP addresses and user
+// agents included, is kept.
+var IdentifyingDetails = []string{"email_address", "previous_email_address"}
+
+// scrubDetails returns details without the IdentifyingDetails, and whether
+// it had any.
+func scrubDetails(details map[string]string) (map[string]string, bool) {
+	scrubbed := make(map[string]string, len(details))
+	for name, value := range details {
+		scrubbed[name] = value
+	}
+	for _, name := range IdentifyingDetails {
+		delete(scrubbed, name)
+	}
+	return scrubbed, len(scrubbed) != len(details)
+}
+
+// scrubSecurityEvents scrubs the events concerning the users that match
+// condition, a WHERE clause on the users table.
+func (s *SQLStore) scrubSecurityEvents(ctx context.Context, condition string, args ...interface{}) error {
+	query := `SELECT id, details FROM security_events WHERE user_id IN (SELECT id FROM users WHERE ` + condition + `)`
+	rows, err := s.conn.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("failed to scrub security events: %w", err)
+	}
+	defer rows.Close()
+
+	scrubbed := make(map[RowID]string)
+	for rows.Next() {
+		var eventID RowID
+		var data string
+		err = rows.Scan(&eventID, &data)
+		if err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		var details map[string]string
+		err = json.Unmarshal([]byte(data), &details)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal security event details: %w", err)
+		}
+		details, changed := scrubDetails(details)
+		if !changed {
+			continue
+		}
+		encoded, err := json.Marshal(details)
+		if err != nil {
+			return fmt.Errorf("failed to marshal security event details: %w", err)
+		}
+		scrubbed[eventID] = string(encoded)
+	}
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("failed to scrub security events: %w", err)
+	}
+	rows.Close()
+
+	for eventID, details := range scrubbed {
+		_, err = s.conn.ExecContext(ctx, s.rebind(`UPDATE security_events SET details = ? WHERE id = ?`), details, eventID)
+		if err != nil {
+			return fmt.Errorf("failed to scrub security events: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStore) RecordSecurityEvent(ctx context.Context, event *SecurityEvent) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return fmt.Errorf("failed to marshal security event details: %w", err)
+	}
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+
+	query := `INSERT INTO security_events (event_type, user_id, actor_id, ip_address, user_agent, details, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	eventID, err := s.insert(ctx, query, event.EventType, event.UserID, event.ActorID, event.IPAddress, event.UserAgent, string(details), event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record security event: %w", err)
+	}
+
+	event.EventID = eventID
+	return nil
+}
+
+// SecurityEventSortKeys are the orders security events can be listed in.
+// Events are numbered as they're recorded, so they're in time order by id.
+var SecurityEventSortKeys = []SortKey{
+	{Name: "created_at"},
+}
+
+// ListSecurityEvents returns the events concerning a single account.
+func (s *SQLStore) ListSecurityEvents(ctx context.Context, userID RowID, options ListOptions) ([]*SecurityEvent, *Cursor, error) {
+	query := `SELECT id, event_type, user_id, actor_id, ip_address, user_agent, details, created_at FROM security_events WHERE user_id = ?`
+	return s.querySecurityEvents(ctx, options, query, userID)
+}
+
+// ListAllSecurityEvents returns every recorded event.
+func (s *SQLStore) ListAllSecurityEvents(ctx context.Context, options ListOptions) ([]*SecurityEvent, *Cursor, error) {
+	query := `SELECT id, event_type, user_id, actor_id, ip_address, user_agent, details, created_at FROM security_events WHERE 1 = 1`
+	return s.querySecurityEvents(ctx, options, query)
+}
+
+func (s *SQLStore) querySecurityEvents(ctx context.Context, options ListOptions, query string, args ...interface{}) ([]*SecurityEvent, *Cursor, error) {
+	key, err := sortKey(SecurityEventSortKeys, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query, args = pageQuery(query, args, key, options)
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to execute list security events query: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*SecurityEvent, 0)
+
+	for rows.Next() {
+		var event SecurityEvent
+		var details string
+
+		err = rows.Scan(&event.EventID, &event.EventType, &event.UserID, &event.ActorID, &event.IPAddress, &event.UserAgent, &details, &event.CreatedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		err = json.Unmarshal([]byte(details), &event.Details)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal security event details: %w", err)
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list security events: %w", err)
+	}
+
+	keep, more := endPage(len(events), options)
+	events = events[:keep]
+	if !more {
+		return events, nil, nil
+	}
+	return events, nextCursor(options, key, nil, events[keep-1].EventID), nil
+}
+
+func (s *SQLStore) IsAdmin(ctx context.Context, userID RowID) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT COUNT(*) FROM admins WHERE user_id = ?`
+	var count int
+	err := s.reader.QueryRowContext(ctx, s.rebind(query), userID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up admin: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+func (s *SQLStore) GrantAdmin(ctx context.Context, userID RowID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `INSERT INTO admins (user_id) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM admins WHERE user_id = ?)`
+	_, err := s.conn.ExecContext(ctx, s.rebind(query), userID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to grant admin: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package db
+
+import "context"
+
+// UserStore persists user accounts.
+type UserStore interface {
+	CreateUser(ctx context.Context, emailAddress string, password string) (*User, error)
+	FindUserByEmailAddress(ctx context.Context, emailAddress string) (*User, error)
+	GetUser(ctx context.Context, userId RowID) (*User, error)
+	// UpdateUser and DeleteUser fail with a *VersionMismatchError unless
+	// the user is at the given version; version 0 matches any.
+	UpdateUser(ctx context.Context, userId RowID, version int64, emailAddress string) (*User, error)
+	DeleteUser(ctx context.Context, userId RowID, version int64) error
+}
+
+// VehicleStore persists the vehicles owned by users.
+type VehicleStore interface {
+	CreateVehicle(ctx context.Context, userID RowID, year Year, make, model string) (*Vehicle, error)
+	// ListVehicles returns a page of the user's vehicles that match the
+	// filter, and the cursor for the next page if there is one.
+	ListVehicles(ctx context.Context, userID RowID, filter VehicleFilter, options ListOptions) ([]*Vehicle, *Cursor, error)
+	// GetVehicle returns a *VehicleNotFoundError for a missing or deleted
+	// vehicle, as do UpdateVehicle and DeleteVehicle.
+	GetVehicle(ctx context.Context, vehicleID RowID) (*Vehicle, error)
+
+	// UpdateVehicle and DeleteVehicle fail with a *VersionMismatchError
+	// unless the vehicle is at the given version; version 0 matches any.
+	// UpdateVehicle leaves fields that are nil or not Valid alone.
+	UpdateVehicle(ctx context.Context, vehicleID RowID, version int64, year *NullYear, vehicleMake, model *NullString) error
+	DeleteVehicle(ctx context.Context, vehicleID RowID, version int64) error
+}
+
+// SecurityEventStore persists the security log and who may read all of it.
+type SecurityEventStore interface {
+	RecordSecurityEvent(ctx context.Context, event *SecurityEvent) error
+	// ListSecurityEvents and ListAllSecurityEvents return a page of events
+	// in SecurityEventSortKeys order, and the cursor for the next page.
+	ListSecurityEvents(ctx context.Context, userID RowID, options ListOptions) ([]*SecurityEvent, *Cursor, error)
+	ListAllSecurityEvents(ctx context.Context, options ListOptions) ([]*SecurityEvent, *Cursor, error)
+	IsAdmin(ctx context.Context, userID RowID) (bool, error)
+	GrantAdmin(ctx context.Context, userID RowID) error
+}
+
+// Tx is the view of a Store inside a transaction. Everything done through
+// it is committed or rolled back together, and reads see the transaction's
+// own writes.
+type Tx interface {
+	UserStore
+	VehicleStore
+	SecurityEventStore
+	TrashStore
+	SearchStore
+	VehicleHistoryStore
+	IdempotencyStore
+	WebhookStore
+	ChangeEventStore
+
+	// InTx on a Tx joins the running transaction.
+	InTx(ctx context.Context, fn func(tx Tx) error) error
+}
+
+// Store is everything the api and graph packages need from storage.
+type Store interface {
+	Tx
+
+	Close() error
+}
+
+var _ Store = &SQLStore{}
+var _ Store = &MemoryStore{}
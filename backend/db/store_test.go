@@ -0,0 +1,1472 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeFactories builds a fresh instance of every Store implementation, so
+// the same behaviour is checked against each of them.
+var storeFactories = map[string]func(t *testing.T) (Store, func()){
+	"memory": func(t *testing.T) (Store, func()) {
+		return NewMemoryStore(), func() {}
+	},
+	"sqlite": func(t *testing.T) (Store, func()) {
+		dir, err := ioutil.TempDir("", "vehicledb")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store, err := OpenSQLite(filepath.Join(dir, "store.sqlite"), Options{SQLite: DefaultSQLiteOptions})
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+
+		return store, func() {
+			store.Close()
+			os.RemoveAll(dir)
+		}
+	},
+}
+
+// VEHICLEDB_TEST_POSTGRES_DSN points the store tests at a local postgres,
+// e.g. postgres://postgres@localhost/vehicledb_test?sslmode=disable. Each
+// test runs in its own schema, which is dropped afterwards.
+func init() {
+	dsn := os.Getenv("VEHICLEDB_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		return
+	}
+
+	storeFactories["postgres"] = func(t *testing.T) (Store, func()) {
+		admin, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema := fmt.Sprintf("vehicledb_test_%d", time.Now().UnixNano())
+		_, err = admin.Exec("CREATE SCHEMA " + schema)
+		if err != nil {
+			admin.Close()
+			t.Fatal(err)
+		}
+
+		cleanup := func() {
+			admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+			admin.Close()
+		}
+
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+
+		store, err := OpenPostgres(dsn+separator+"search_path="+schema, Options{})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+
+		return store, func() {
+			store.Close()
+			cleanup()
+		}
+	}
+}
+
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	for name, factory := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			store, cleanup := factory(t)
+			defer cleanup()
+
+			test(t, store)
+		})
+	}
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := store.FindUserByEmailAddress(ctx, "joe@djeebus.net")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.UserId != user.UserId {
+			t.Fatalf("found user %d, expected %d", found.UserId, user.UserId)
+		}
+		if !found.DoesPasswordMatch("Password1") {
+			t.Fatalf("password should match")
+		}
+		if found.DoesPasswordMatch("Password2") {
+			t.Fatalf("password should not match")
+		}
+
+		_, err = store.UpdateUser(ctx, user.UserId, 0, "joe@eventray.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated, err := store.GetUser(ctx, user.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.EmailAddress != "joe@eventray.com" {
+			t.Fatalf("email address not updated: %s", updated.EmailAddress)
+		}
+
+		err = store.DeleteUser(ctx, user.UserId, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetUser(ctx, user.UserId)
+		if _, ok := err.(*UserNotFoundError); !ok {
+			t.Fatalf("expected UserNotFoundError, got %v", err)
+		}
+	})
+}
+
+func TestStoreUniqueEmailAddresses(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		// "é" typed as a single character
+		user, err := store.CreateUser(ctx, " Ren\u00e9@Example.com ", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.EmailAddress != "Ren\u00e9@Example.com" {
+			t.Fatalf("expected the address to be trimmed, got %q", user.EmailAddress)
+		}
+
+		// the same address in another case, with "é" as "e" plus an accent
+		_, err = store.CreateUser(ctx, "RENE\u0301@example.COM", "Password1")
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected a conflict creating a duplicate address, got %v", err)
+		}
+
+		found, err := store.FindUserByEmailAddress(ctx, "rene\u0301@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.UserId != user.UserId || found.EmailAddress != user.EmailAddress {
+			t.Fatalf("expected to find %+v, got %+v", user, found)
+		}
+
+		other, err := store.CreateUser(ctx, "other@example.com", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.UpdateUser(ctx, other.UserId, 0, "REN\u00c9@example.com")
+		if _, ok := err.(*EmailAddressTakenError); !ok {
+			t.Fatalf("expected EmailAddressTakenError changing to a taken address, got %v", err)
+		}
+
+		// an account in the trash frees its address, and can't come back
+		// while someone else has it
+		err = store.DeleteUser(ctx, user.UserId, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.UpdateUser(ctx, other.UserId, 0, "rené@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.RestoreUser(ctx, user.UserId)
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected a conflict restoring an account whose address was taken, got %v", err)
+		}
+	})
+}
+
+func TestStoreVehicles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vehicle, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 0, &NullYear{Year: 2011, Valid: true}, &NullString{}, &NullString{String: "550i", Valid: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vehicles, _, err := store.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vehicles) != 1 {
+			t.Fatalf("expected 1 vehicle, got %d", len(vehicles))
+		}
+		if vehicles[0].Year != 2011 || vehicles[0].Make != "Chevy" || vehicles[0].Model != "550i" {
+			t.Fatalf("unexpected vehicle: %+v", vehicles[0])
+		}
+
+		err = store.DeleteVehicle(ctx, vehicle.VehicleID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetVehicle(ctx, vehicle.VehicleID)
+		if _, ok := err.(*VehicleNotFoundError); !ok {
+			t.Fatalf("expected vehicle to be deleted, got %v", err)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected a not found error, got %v", err)
+		}
+
+		err = store.DeleteVehicle(ctx, vehicle.VehicleID, 0)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected deleting a deleted vehicle to be not found, got %v", err)
+		}
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 0, &NullYear{Year: 2012, Valid: true}, &NullString{}, &NullString{})
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected updating a deleted vehicle to be not found, got %v", err)
+		}
+	})
+}
+
+func TestStoreVersions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Version != 1 {
+			t.Fatalf("expected a new user to be at version 1, got %d", user.Version)
+		}
+
+		vehicle, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vehicle.Version != 1 {
+			t.Fatalf("expected a new vehicle to be at version 1, got %d", vehicle.Version)
+		}
+
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 1, &NullYear{Year: 2018, Valid: true}, &NullString{}, &NullString{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vehicle, err = store.GetVehicle(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vehicle.Version != 2 {
+			t.Fatalf("expected the update to bump the version to 2, got %d", vehicle.Version)
+		}
+
+		// saving the same values isn't a change
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 2, &NullYear{Year: 2018, Valid: true}, &NullString{}, &NullString{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vehicle, err = store.GetVehicle(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vehicle.Version != 2 {
+			t.Fatalf("expected an empty update to leave the version at 2, got %d", vehicle.Version)
+		}
+
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 1, &NullYear{Year: 2019, Valid: true}, &NullString{}, &NullString{})
+		var mismatch *VersionMismatchError
+		if !errors.As(err, &mismatch) || !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("expected a version mismatch, got %v", err)
+		}
+		if mismatch.Expected != 1 || mismatch.Current != 2 {
+			t.Fatalf("unexpected mismatch: %+v", mismatch)
+		}
+
+		err = store.DeleteVehicle(ctx, vehicle.VehicleID, 1)
+		if !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("expected deleting a stale vehicle to fail, got %v", err)
+		}
+		err = store.DeleteVehicle(ctx, vehicle.VehicleID, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.UpdateUser(ctx, user.UserId, 2, "joe@eventray.com")
+		if !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatalf("expected updating a stale user to fail, got %v", err)
+		}
+		user, err = store.UpdateUser(ctx, user.UserId, 1, "joe@eventray.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Version != 2 {
+			t.Fatalf("expected the update to bump the user to version 2, got %d", user.Version)
+		}
+	})
+}
+
+func TestStoreUpdateVehicleOmittedFields(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		vehicle, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// nil fields are left alone, rather than crashing the update
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 0, nil, nil, &NullString{String: "Camaro", Valid: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vehicle, err = store.GetVehicle(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vehicle.Year != 2017 || vehicle.Make != "Chevy" || vehicle.Model != "Camaro" {
+			t.Fatalf("expected only the model to change, got %+v", vehicle)
+		}
+	})
+}
+
+func TestStoreListVehiclesPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, vehicle := range []struct {
+			year  Year
+			make  string
+			model string
+		}{
+			{2017, "Chevy", "SS"},
+			{2011, "BMW", "550i"},
+			{2017, "chevy", "Bolt"},
+			{2004, "Holden", "Monaro"},
+			{2014, "Chevy", "Volt"},
+		} {
+			_, err := store.CreateVehicle(ctx, user.UserId, vehicle.year, vehicle.make, vehicle.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// readAll follows the cursors to the end, two at a time
+		readAll := func(filter VehicleFilter, options ListOptions) []string {
+			t.Helper()
+
+			models := make([]string, 0)
+			options.Limit = 2
+			for page := 0; page < 10; page++ {
+				vehicles, next, err := store.ListVehicles(ctx, user.UserId, filter, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, vehicle := range vehicles {
+					models = append(models, vehicle.Model)
+				}
+				if next == nil {
+					return models
+				}
+
+				options.After, err = ParseCursor(next.Encode())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Fatalf("too many pages: %v", models)
+			return nil
+		}
+
+		expectModels := func(got []string, expected ...string) {
+			t.Helper()
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Fatalf("expected %v, got %v", expected, got)
+			}
+		}
+
+		expectModels(readAll(VehicleFilter{}, ListOptions{}), "SS", "550i", "Bolt", "Monaro", "Volt")
+		expectModels(readAll(VehicleFilter{}, ListOptions{Sort: "year", Desc: true}), "Bolt", "SS", "Volt", "550i", "Monaro")
+		expectModels(readAll(VehicleFilter{}, ListOptions{Sort: "model"}), "550i", "Bolt", "Monaro", "SS", "Volt")
+		expectModels(readAll(VehicleFilter{Make: "CHEVY", YearFrom: 2015}, ListOptions{}), "SS", "Bolt")
+		expectModels(readAll(VehicleFilter{YearTo: 2014}, ListOptions{Sort: "year"}), "Monaro", "550i", "Volt")
+
+		_, _, err = store.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{Sort: "color"})
+		if !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected sorting by an unknown key to be invalid, got %v", err)
+		}
+		_, _, err = store.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{Sort: "year", After: &Cursor{Sort: "model", Value: "SS"}})
+		if !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected a cursor from another order to be invalid, got %v", err)
+		}
+	})
+}
+
+func TestStoreTrash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kept, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trashed, err := store.CreateVehicle(ctx, user.UserId, 2011, "BMW", "550i")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.DeleteVehicle(ctx, trashed.VehicleID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vehicles, _, err := store.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vehicles) != 1 || vehicles[0].VehicleID != kept.VehicleID {
+			t.Fatalf("expected only the kept vehicle, got %+v", vehicles)
+		}
+
+		deleted, err := store.ListDeletedVehicles(ctx, user.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deleted) != 1 || deleted[0].VehicleID != trashed.VehicleID || deleted[0].DeletedAt == nil {
+			t.Fatalf("expected the trashed vehicle in the trash, got %+v", deleted)
+		}
+		_, err = store.GetDeletedVehicle(ctx, kept.VehicleID)
+		if _, ok := err.(*VehicleNotFoundError); !ok {
+			t.Fatalf("expected VehicleNotFoundError for a vehicle out of the trash, got %v", err)
+		}
+
+		err = store.RestoreVehicle(ctx, trashed.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := store.GetVehicle(ctx, trashed.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored == nil || restored.DeletedAt != nil {
+			t.Fatalf("expected vehicle to be restored, got %+v", restored)
+		}
+
+		// nothing is old enough to purge yet
+		err = store.DeleteVehicle(ctx, trashed.VehicleID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		purged, err := store.PurgeDeleted(ctx, time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != 0 {
+			t.Fatalf("expected nothing to be purged, purged %d", purged)
+		}
+
+		purged, err = store.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != 1 {
+			t.Fatalf("expected 1 row to be purged, purged %d", purged)
+		}
+		_, err = store.GetDeletedVehicle(ctx, trashed.VehicleID)
+		if _, ok := err.(*VehicleNotFoundError); !ok {
+			t.Fatalf("expected vehicle to be purged, got %v", err)
+		}
+
+		// deleting an account hides it until it is restored
+		err = store.DeleteUser(ctx, user.UserId, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.FindUserByEmailAddress(ctx, "joe@djeebus.net")
+		if _, ok := err.(*EmailAddressNotFoundError); !ok {
+			t.Fatalf("expected deleted user to be hidden, got %v", err)
+		}
+
+		users, err := store.ListDeletedUsers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 || users[0].UserId != user.UserId {
+			t.Fatalf("expected the deleted user in the trash, got %+v", users)
+		}
+
+		err = store.RestoreUser(ctx, user.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetUser(ctx, user.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.RestoreUser(ctx, user.UserId)
+		if _, ok := err.(*UserNotFoundError); !ok {
+			t.Fatalf("expected a user who isn't in the trash not to be restored, got %v", err)
+		}
+
+		err = store.PurgeUser(ctx, user.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetUser(ctx, user.UserId)
+		if _, ok := err.(*UserNotFoundError); !ok {
+			t.Fatalf("expected purged user to be gone, got %v", err)
+		}
+		err = store.PurgeUser(ctx, user.UserId)
+		if _, ok := err.(*UserNotFoundError); !ok {
+			t.Fatalf("expected purging a missing user to fail, got %v", err)
+		}
+		gone, err := store.GetVehicle(ctx, kept.VehicleID)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected purging the user to purge their vehicles, got %+v", gone)
+		}
+	})
+}
+
+func TestBM25(t *testing.T) {
+	// matchinfo 'pcnalx' for one phrase over the five columns of
+	// search_index, in 100 rows, with the phrase in the given column
+	matchinfo := func(column int) []byte {
+		info := []uint32{1, 5, 100, 1, 1, 1, 3, 10, 1, 1, 1, 3, 10}
+		for idx := 0; idx < 5; idx++ {
+			hits := uint32(0)
+			if idx == column {
+				hits = 1
+			}
+			info = append(info, hits, hits*10, hits*10)
+		}
+
+		blob := make([]byte, 4*len(info))
+		for idx, value := range info {
+			nativeEndian.PutUint32(blob[idx*4:], value)
+		}
+		return blob
+	}
+
+	title, body := bm25(matchinfo(3)), bm25(matchinfo(4))
+	if title <= 0 || body <= 0 {
+		t.Fatalf("expected matches to score, got %f and %f", title, body)
+	}
+	if title <= body {
+		t.Fatalf("expected a match in the title to outrank one in the body, got %f and %f", title, body)
+	}
+	if unindexed := bm25(matchinfo(0)); unindexed != 0 {
+		t.Fatalf("expected a match in an unindexed column not to score, got %f", unindexed)
+	}
+}
+
+func TestStoreSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := store.CreateUser(ctx, "jane@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chevy, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bmw, err := store.CreateVehicle(ctx, user.UserId, 2011, "BMW", "550i")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.CreateVehicle(ctx, other.UserId, 2017, "Chevy", "Bolt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// words match as prefixes, and only the user's own vehicles match
+		results, err := store.Search(ctx, user.UserId, "chev", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Kind != SearchKindVehicle || results[0].ID != chevy.VehicleID {
+			t.Fatalf("expected to find the chevy, got %+v", results)
+		}
+		if results[0].Snippet != "2017 <mark>Chevy</mark> SS" {
+			t.Fatalf("unexpected snippet: %s", results[0].Snippet)
+		}
+
+		// matching more of the words ranks higher
+		results, err = store.Search(ctx, user.UserId, "2017 bmw 550i", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].ID != bmw.VehicleID || results[1].ID != chevy.VehicleID {
+			t.Fatalf("expected the bmw to rank above the chevy, got %+v", results)
+		}
+
+		// the index follows updates and deletes
+		err = store.UpdateVehicle(ctx, chevy.VehicleID, 0, &NullYear{}, &NullString{String: "Holden", Valid: true}, &NullString{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.DeleteVehicle(ctx, bmw.VehicleID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, err = store.Search(ctx, user.UserId, "holden bmw", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].ID != chevy.VehicleID {
+			t.Fatalf("expected only the updated vehicle, got %+v", results)
+		}
+
+		// query syntax is taken literally
+		results, err = store.Search(ctx, user.UserId, `"NEAR(* OR -`, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 0 {
+			t.Fatalf("expected no results, got %+v", results)
+		}
+	})
+}
+
+func TestStoreVehicleHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx = WithActor(ctx, user.UserId)
+
+		vehicle, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 0, &NullYear{}, &NullString{String: "Holden", Valid: true}, &NullString{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 0, &NullYear{Year: 2016, Valid: true}, &NullString{}, &NullString{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// an update that changes nothing isn't recorded
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 0, &NullYear{Year: 2016, Valid: true}, &NullString{}, &NullString{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		revisions, err := store.ListVehicleRevisions(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != 3 {
+			t.Fatalf("expected 3 revisions, got %d", len(revisions))
+		}
+		yearChange, makeChange, created := revisions[0], revisions[1], revisions[2]
+		if created.Action != RevisionCreated || string(created.Changes["make"].To) != `"Chevy"` {
+			t.Fatalf("unexpected first revision: %+v", created)
+		}
+		if string(yearChange.Changes["year"].From) != "2017" || string(yearChange.Changes["year"].To) != "2016" {
+			t.Fatalf("unexpected year revision: %+v", yearChange)
+		}
+		if makeChange.Action != RevisionUpdated || len(makeChange.Changes) != 1 ||
+			string(makeChange.Changes["make"].From) != `"Chevy"` || string(makeChange.Changes["make"].To) != `"Holden"` {
+			t.Fatalf("unexpected make revision: %+v", makeChange)
+		}
+		if makeChange.ActorID == nil || *makeChange.ActorID != user.UserId {
+			t.Fatalf("expected the revision to record its actor, got %v", makeChange.ActorID)
+		}
+
+		// reverting a version that's been changed since is refused
+		current, err := store.GetVehicle(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.RevertVehicleRevision(ctx, makeChange.RevisionID, current.Version-1)
+		if mismatch, ok := err.(*VersionMismatchError); !ok || mismatch.Current != current.Version {
+			t.Fatalf("expected a version mismatch, got %v", err)
+		}
+
+		// reverting the make leaves the later year change alone
+		reverted, err := store.RevertVehicleRevision(ctx, makeChange.RevisionID, current.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reverted.Make != "Chevy" || reverted.Year != 2016 {
+			t.Fatalf("unexpected reverted vehicle: %+v", reverted)
+		}
+
+		revisions, err = store.ListVehicleRevisions(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revisions[0].Action != RevisionReverted || revisions[0].Reverts == nil || *revisions[0].Reverts != makeChange.RevisionID {
+			t.Fatalf("expected the revert to be recorded, got %+v", revisions[0])
+		}
+
+		// the make has changed again since, so reverting it twice conflicts
+		_, err = store.RevertVehicleRevision(ctx, makeChange.RevisionID, 0)
+		if conflict, ok := err.(*RevertConflictError); !ok || len(conflict.Fields) != 1 || conflict.Fields[0] != "make" {
+			t.Fatalf("expected a conflict on make, got %v", err)
+		}
+
+		_, err = store.RevertVehicleRevision(ctx, created.RevisionID, 0)
+		if err != ErrRevisionNotRevertible {
+			t.Fatalf("expected creating a vehicle not to be revertible, got %v", err)
+		}
+
+		err = store.DeleteVehicle(ctx, vehicle.VehicleID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.RestoreVehicle(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions, err = store.ListVehicleRevisions(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revisions[0].Action != RevisionRestored || revisions[1].Action != RevisionDeleted {
+			t.Fatalf("expected delete and restore to be recorded, got %s and %s", revisions[1].Action, revisions[0].Action)
+		}
+
+		// purging a vehicle takes its history with it
+		err = store.PurgeVehicle(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions, err = store.ListVehicleRevisions(ctx, vehicle.VehicleID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != 0 {
+			t.Fatalf("expected the history to be purged, got %d revisions", len(revisions))
+		}
+		_, err = store.GetVehicleRevision(ctx, makeChange.RevisionID)
+		if _, ok := err.(*RevisionNotFoundError); !ok {
+			t.Fatalf("expected RevisionNotFoundError for a purged revision, got %v", err)
+		}
+	})
+}
+
+func TestStoreSecurityEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, eventType := range []string{EventUserCreated, EventLogin} {
+			err = store.RecordSecurityEvent(ctx, &SecurityEvent{
+				EventType: eventType,
+				UserID:    &user.UserId,
+				ActorID:   &user.UserId,
+				IPAddress: "127.0.0.1",
+				UserAgent: "test",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = store.RecordSecurityEvent(ctx, &SecurityEvent{EventType: EventLoginFailed, IPAddress: "127.0.0.1", UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events, _, err := store.ListSecurityEvents(ctx, user.UserId, ListOptions{Desc: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].EventType != EventLogin {
+			t.Fatalf("unexpected user events: %+v", events)
+		}
+
+		all, _, err := store.ListAllSecurityEvents(ctx, ListOptions{Desc: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 3 {
+			t.Fatalf("expected 3 events, got %d", len(all))
+		}
+
+		isAdmin, err := store.IsAdmin(ctx, user.UserId)
+		if err != nil || isAdmin {
+			t.Fatalf("expected a regular user, got %v, %v", isAdmin, err)
+		}
+		err = store.GrantAdmin(ctx, user.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isAdmin, err = store.IsAdmin(ctx, user.UserId)
+		if err != nil || !isAdmin {
+			t.Fatalf("expected an admin, got %v, %v", isAdmin, err)
+		}
+	})
+}
+
+func TestStorePurgeScrubsSecurityEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		record := func(user *User) {
+			err := store.RecordSecurityEvent(ctx, &SecurityEvent{
+				EventType: EventEmailChanged,
+				UserID:    &user.UserId,
+				ActorID:   &user.UserId,
+				IPAddress: "127.0.0.1",
+				UserAgent: "test",
+				Details: map[string]string{
+					"previous_email_address": "old-" + user.EmailAddress,
+					"email_address":          user.EmailAddress,
+					"reason":                 "moved",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		purged, err := store.CreateUser(ctx, "purged@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired, err := store.CreateUser(ctx, "expired@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept, err := store.CreateUser(ctx, "kept@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range []*User{purged, expired, kept} {
+			record(user)
+		}
+
+		err = store.PurgeUser(ctx, purged.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.DeleteUser(ctx, expired.UserId, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.PurgeDeleted(ctx, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events, _, err := store.ListAllSecurityEvents(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 3 {
+			t.Fatalf("expected the events to be kept, got %d", len(events))
+		}
+		for _, event := range events {
+			if *event.UserID == kept.UserId {
+				if event.Details["email_address"] != kept.EmailAddress {
+					t.Fatalf("expected the kept account's event to be left alone, got %+v", event.Details)
+				}
+				continue
+			}
+			if len(event.Details) != 1 || event.Details["reason"] != "moved" || event.IPAddress != "127.0.0.1" {
+				t.Fatalf("expected only the addresses to be scrubbed, got %+v", event)
+			}
+		}
+
+		// nothing else about an event can change
+		if sqlStore, ok := store.(*SQLStore); ok {
+			for _, query := range []string{`UPDATE security_events SET ip_address = '10.0.0.1'`, `DELETE FROM security_events`} {
+				_, err = sqlStore.db.ExecContext(ctx, query)
+				if err == nil || !strings.Contains(err.Error(), "append-only") {
+					t.Fatalf("expected %q to be refused, got %v", query, err)
+				}
+			}
+		}
+	})
+}
+
+func TestStoreIdempotencyKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		since := time.Now().Add(-time.Hour)
+
+		existing, err := store.ReserveIdempotencyKey(ctx, 1, "key", "first", since, since)
+		if err != nil || existing != nil {
+			t.Fatalf("expected to reserve a new key, got %+v, %v", existing, err)
+		}
+
+		// a retry finds the first still running
+		existing, err = store.ReserveIdempotencyKey(ctx, 1, "key", "first", since, since)
+		if err != nil || existing == nil || existing.Status != 0 {
+			t.Fatalf("expected the reservation, got %+v, %v", existing, err)
+		}
+
+		// unless it has been running for so long it must have been abandoned
+		existing, err = store.ReserveIdempotencyKey(ctx, 3, "key", "first", since, since)
+		if err != nil || existing != nil {
+			t.Fatalf("expected to reserve a new key, got %+v, %v", existing, err)
+		}
+		existing, err = store.ReserveIdempotencyKey(ctx, 3, "key", "first", since, time.Now().Add(time.Minute))
+		if err != nil || existing != nil {
+			t.Fatalf("expected to reserve an abandoned key, got %+v, %v", existing, err)
+		}
+		err = store.ReleaseIdempotencyKey(ctx, 3, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.SaveIdempotentResponse(ctx, 1, "key", &IdempotentResponse{
+			Status: 201, Header: map[string]string{"ETag": `"1"`}, Body: []byte(`{}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a saved response is kept for the whole window, however old it is
+		existing, err = store.ReserveIdempotencyKey(ctx, 1, "key", "second", since, time.Now().Add(time.Minute))
+		if err != nil || existing == nil {
+			t.Fatalf("expected the saved response, got %+v, %v", existing, err)
+		}
+		if existing.Fingerprint != "first" || existing.Status != 201 || existing.Header["ETag"] != `"1"` || string(existing.Body) != `{}` {
+			t.Fatalf("expected the saved response, got %+v", existing)
+		}
+
+		// keys are per user
+		existing, err = store.ReserveIdempotencyKey(ctx, 2, "key", "first", since, since)
+		if err != nil || existing != nil {
+			t.Fatalf("expected another user's key to be separate, got %+v, %v", existing, err)
+		}
+
+		// a released key may be reserved again, and so may an expired one
+		err = store.ReleaseIdempotencyKey(ctx, 2, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing, err = store.ReserveIdempotencyKey(ctx, 2, "key", "second", since, since)
+		if err != nil || existing != nil {
+			t.Fatalf("expected to reserve a released key, got %+v, %v", existing, err)
+		}
+		existing, err = store.ReserveIdempotencyKey(ctx, 1, "key", "second", time.Now().Add(time.Minute), since)
+		if err != nil || existing != nil {
+			t.Fatalf("expected to reserve an expired key, got %+v, %v", existing, err)
+		}
+
+		purged, err := store.PurgeIdempotencyKeys(ctx, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != 2 {
+			t.Fatalf("expected to purge 2 keys, purged %d", purged)
+		}
+	})
+}
+
+func TestStoreWebhooks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		webhook, err := store.CreateWebhook(ctx, user.UserId, "http://127.0.0.1:9000/", []string{ChangeVehicleCreated, ChangeVehicleDeleted}, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := store.CreateWebhook(ctx, user.UserId, "http://127.0.0.1:9001/", []string{ChangeVehicleUpdated}, "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.GetWebhook(ctx, webhook.WebhookID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.URL != webhook.URL || len(got.Events) != 2 || got.Secret != "" {
+			t.Fatalf("expected the webhook without its secret, got %+v", got)
+		}
+
+		// events are recorded in the transaction that makes the change, so
+		// a change that's rolled back isn't delivered
+		rollback := errors.New("rollback")
+		err = store.InTx(ctx, func(tx Tx) error {
+			_, err := tx.CreateVehicle(ctx, user.UserId, 2011, "BMW", "550i")
+			if err != nil {
+				return err
+			}
+			return rollback
+		})
+		if err != rollback {
+			t.Fatalf("expected the callback's error, got %v", err)
+		}
+
+		vehicle, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.UpdateVehicle(ctx, vehicle.VehicleID, 0, nil, nil, &NullString{String: "Camaro", Valid: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now().Add(time.Second)
+		claimed, err := store.ClaimWebhookDeliveries(ctx, now, time.Minute, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claimed) != 2 {
+			t.Fatalf("expected a delivery to each subscribed webhook, got %d", len(claimed))
+		}
+		created := claimed[0]
+		if created.WebhookID != webhook.WebhookID || created.Secret != "secret" || created.Event.Type != ChangeVehicleCreated {
+			t.Fatalf("expected vehicle.created for the first webhook first, got %+v", created)
+		}
+		var data VehicleChange
+		err = json.Unmarshal(created.Event.Data, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Vehicle == nil || data.Vehicle.VehicleID != vehicle.VehicleID || data.Vehicle.Model != "SS" {
+			t.Fatalf("expected the vehicle as it was created, got %s", created.Event.Data)
+		}
+		if claimed[1].WebhookID != other.WebhookID || claimed[1].Event.Type != ChangeVehicleUpdated {
+			t.Fatalf("expected vehicle.updated for the other webhook, got %+v", claimed[1])
+		}
+
+		// claimed deliveries are left alone until the lease runs out
+		claimed, err = store.ClaimWebhookDeliveries(ctx, now, time.Minute, 10)
+		if err != nil || len(claimed) != 0 {
+			t.Fatalf("expected no deliveries while they're claimed, got %d, %v", len(claimed), err)
+		}
+
+		err = store.RecordWebhookAttempt(ctx, created.DeliveryID, &WebhookAttempt{
+			At: now, ResponseStatus: 500, Error: "boom", State: DeliveryPending, RetryAt: now.Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claimed, err = store.ClaimWebhookDeliveries(ctx, now.Add(2*time.Minute), time.Minute, 10)
+		if err != nil || len(claimed) != 1 || claimed[0].WebhookID != other.WebhookID {
+			t.Fatalf("expected only the unrecorded delivery once its lease ran out, got %d, %v", len(claimed), err)
+		}
+		claimed, err = store.ClaimWebhookDeliveries(ctx, now.Add(2*time.Hour), time.Minute, 10)
+		if err != nil || len(claimed) != 2 || claimed[1].DeliveryID != created.DeliveryID || claimed[1].Attempts != 1 {
+			t.Fatalf("expected the failed delivery to be retried after the one whose lease ran out first, got %d, %v", len(claimed), err)
+		}
+		err = store.RecordWebhookAttempt(ctx, created.DeliveryID, &WebhookAttempt{At: now, ResponseStatus: 204, State: DeliverySucceeded})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ping, err := store.PingWebhook(ctx, webhook.WebhookID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ping.EventType != ChangeWebhookPing || ping.State != DeliveryPending {
+			t.Fatalf("expected a pending ping, got %+v", ping)
+		}
+
+		deliveries, next, err := store.ListWebhookDeliveries(ctx, webhook.WebhookID, ListOptions{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 || next == nil {
+			t.Fatalf("expected a page of 1 delivery, got %d", len(deliveries))
+		}
+		first := deliveries[0]
+		if first.State != DeliverySucceeded || first.Attempts != 2 || first.ResponseStatus == nil || *first.ResponseStatus != 204 || first.NextAttemptAt != nil {
+			t.Fatalf("expected the delivery to have succeeded on its second attempt, got %+v", first)
+		}
+		deliveries, _, err = store.ListWebhookDeliveries(ctx, webhook.WebhookID, ListOptions{After: next, Limit: 1})
+		if err != nil || len(deliveries) != 1 || deliveries[0].DeliveryID != ping.DeliveryID {
+			t.Fatalf("expected the ping on the next page, got %v, %v", deliveries, err)
+		}
+
+		err = store.DeleteWebhook(ctx, webhook.WebhookID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetWebhook(ctx, webhook.WebhookID)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected the webhook to be gone, got %v", err)
+		}
+
+		purged, err := store.PurgeChangeEvents(ctx, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != 3 {
+			t.Fatalf("expected to purge 3 events, purged %d", purged)
+		}
+		deliveries, _, err = store.ListWebhookDeliveries(ctx, other.WebhookID, ListOptions{})
+		if err != nil || len(deliveries) != 0 {
+			t.Fatalf("expected the deliveries to be purged with their events, got %d, %v", len(deliveries), err)
+		}
+
+		err = store.PurgeUser(ctx, user.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		webhooks, err := store.ListWebhooks(ctx, user.UserId)
+		if err != nil || len(webhooks) != 0 {
+			t.Fatalf("expected the user's webhooks to be purged, got %d, %v", len(webhooks), err)
+		}
+	})
+}
+
+func TestStoreChangeEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		oldest, newest, err := store.ChangeEventRange(ctx)
+		if err != nil || oldest != 0 || newest != 0 {
+			t.Fatalf("expected no events, got %d to %d, %v", oldest, newest, err)
+		}
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := store.CreateUser(ctx, "jane@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		webhook, err := store.CreateWebhook(ctx, user.UserId, "http://127.0.0.1:9000/", []string{ChangeVehicleCreated}, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vehicle, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.CreateVehicle(ctx, other.UserId, 2011, "BMW", "550i")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.PingWebhook(ctx, webhook.WebhookID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.DeleteVehicle(ctx, vehicle.VehicleID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events, err := store.ListChangeEvents(ctx, user.UserId, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].Type != ChangeVehicleCreated || events[1].Type != ChangeVehicleDeleted {
+			t.Fatalf("expected the user's vehicle.created and vehicle.deleted events, without the ping, got %+v", events)
+		}
+		if events[0].ResourceID != vehicle.VehicleID || events[0].Resource != "vehicle" {
+			t.Fatalf("expected the event to name the vehicle, got %+v", events[0])
+		}
+
+		later, err := store.ListChangeEvents(ctx, user.UserId, events[0].EventID, 10)
+		if err != nil || len(later) != 1 || later[0].EventID != events[1].EventID {
+			t.Fatalf("expected only the event after the first, got %+v, %v", later, err)
+		}
+		first, err := store.ListChangeEvents(ctx, user.UserId, 0, 1)
+		if err != nil || len(first) != 1 || first[0].EventID != events[0].EventID {
+			t.Fatalf("expected only the first event, got %+v, %v", first, err)
+		}
+
+		oldest, newest, err = store.ChangeEventRange(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oldest != events[0].EventID || newest != events[1].EventID {
+			t.Fatalf("expected events %d to %d, got %d to %d", events[0].EventID, events[1].EventID, oldest, newest)
+		}
+
+		_, err = store.PurgeChangeEvents(ctx, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldest, newest, err = store.ChangeEventRange(ctx)
+		if err != nil || oldest != 0 || newest != 0 {
+			t.Fatalf("expected the events to be purged, got %d to %d, %v", oldest, newest, err)
+		}
+	})
+}
+
+func TestRebind(t *testing.T) {
+	query := `UPDATE vehicles SET year = ?, make = ? WHERE id = ?`
+
+	if sqliteDialect.rebind(query) != query {
+		t.Fatalf("sqlite queries should be left alone")
+	}
+
+	expected := `UPDATE vehicles SET year = $1, make = $2 WHERE id = $3`
+	if rebound := postgresDialect.rebind(query); rebound != expected {
+		t.Fatalf("expected %s, got %s", expected, rebound)
+	}
+}
+
+func TestSQLStoreQueryTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vehicledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenSQLite(filepath.Join(dir, "timeout.sqlite"), Options{QueryTimeout: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	_, _, err = store.ListVehicles(context.Background(), 1, VehicleFilter{}, ListOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the query to time out, got %v", err)
+	}
+}
+
+func TestSQLiteOptions(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "vehicledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenSQLite(filepath.Join(dir, "options.sqlite"), Options{SQLite: DefaultSQLiteOptions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var journalMode string
+	err = store.reader.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&journalMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journalMode != "wal" {
+		t.Fatalf("expected wal journaling, got %s", journalMode)
+	}
+
+	// foreign keys are enforced
+	_, err = store.CreateVehicle(ctx, 12345, 2017, "Chevy", "SS")
+	if err == nil {
+		t.Fatalf("expected a vehicle for a missing user to be refused")
+	}
+
+	// the read pool can't write
+	_, err = store.reader.ExecContext(ctx, `DELETE FROM vehicles`)
+	if err == nil {
+		t.Fatalf("expected the read pool to refuse writes")
+	}
+
+	// concurrent writers queue rather than failing with "database is locked"
+	user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 20
+	errs := make(chan error, writers)
+	for idx := 0; idx < writers; idx++ {
+		go func() {
+			errs <- store.InTx(ctx, func(tx Tx) error {
+				vehicle, err := tx.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+				if err != nil {
+					return err
+				}
+
+				_, err = tx.GetVehicle(ctx, vehicle.VehicleID)
+				return err
+			})
+		}()
+	}
+	for idx := 0; idx < writers; idx++ {
+		err = <-errs
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vehicles, _, err := store.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vehicles) != writers {
+		t.Fatalf("expected %d vehicles, got %d", writers, len(vehicles))
+	}
+}
+
+func TestOpenDSN(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "vehicledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "dsn.sqlite")
+	store, err := Open("file://"+dbPath+"?_busy_timeout=10000", Options{SQLite: DefaultSQLiteOptions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var busyTimeout int
+	err = store.(*SQLStore).reader.QueryRowContext(ctx, `PRAGMA busy_timeout`).Scan(&busyTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if busyTimeout != 10000 {
+		t.Fatalf("expected the DSN's busy timeout to win, got %d", busyTimeout)
+	}
+	store.Close()
+
+	// opening an existing database again must never truncate it
+	for _, dsn := range []string{dbPath, "sqlite://" + dbPath, "file:" + dbPath} {
+		store, err = Open(dsn, Options{SQLite: DefaultSQLiteOptions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetUser(ctx, user.UserId)
+		store.Close()
+		if err != nil {
+			t.Fatalf("expected %s to still hold the user: %v", dsn, err)
+		}
+	}
+
+	_, err = Open(filepath.Join(dir, "missing", "dsn.sqlite"), Options{})
+	if err == nil {
+		t.Fatalf("expected a database in a missing directory to be refused")
+	}
+	_, err = Open(dir, Options{})
+	if err == nil {
+		t.Fatalf("expected a directory to be refused as a database")
+	}
+
+	store, err = Open("memory", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, ok := store.(*MemoryStore); !ok {
+		t.Fatalf("expected memory to open a MemoryStore, got %T", store)
+	}
+	_, err = Connect("memory", Options{})
+	if err == nil {
+		t.Fatalf("expected connecting to an in-memory database to fail")
+	}
+}
+
+func TestStoreTransactions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a failed transaction leaves nothing behind
+		rollback := errors.New("rollback")
+		err = store.InTx(ctx, func(tx Tx) error {
+			_, err := tx.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+			if err != nil {
+				return err
+			}
+
+			vehicles, _, err := tx.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{})
+			if err != nil {
+				return err
+			}
+			if len(vehicles) != 1 {
+				t.Fatalf("expected the transaction to see its own write")
+			}
+
+			return rollback
+		})
+		if err != rollback {
+			t.Fatalf("expected the callback's error, got %v", err)
+		}
+
+		vehicles, _, err := store.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vehicles) != 0 {
+			t.Fatalf("expected the vehicle to be rolled back, found %d", len(vehicles))
+		}
+
+		// a successful one, including a nested InTx, is committed
+		err = store.InTx(ctx, func(tx Tx) error {
+			_, err := tx.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+			if err != nil {
+				return err
+			}
+
+			return tx.InTx(ctx, func(tx Tx) error {
+				_, err := tx.CreateVehicle(ctx, user.UserId, 2011, "BMW", "550i")
+				return err
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		vehicles, _, err = store.ListVehicles(ctx, user.UserId, VehicleFilter{}, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vehicles) != 2 {
+			t.Fatalf("expected 2 committed vehicles, found %d", len(vehicles))
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TrashStore manages soft-deleted rows. Deleted vehicles and accounts are
+// hidden from every other query until they are restored or purged.
+type TrashStore interface {
+	ListDeletedVehicles(ctx context.Context, userID RowID) ([]*Vehicle, error)
+	// GetDeletedVehicle returns a *VehicleNotFoundError unless the vehicle
+	// is in the trash.
+	GetDeletedVehicle(ctx context.Context, vehicleID RowID) (*Vehicle, error)
+	RestoreVehicle(ctx context.Context, vehicleID RowID) error
+	ListDeletedUsers(ctx context.Context) ([]*User, error)
+	// RestoreUser returns a *UserNotFoundError unless the user is in the
+	// trash.
+	RestoreUser(ctx context.Context, userID RowID) error
+
+	// PurgeVehicle and PurgeUser remove rows for good whether or not they
+	// are in the trash, for compliance requests. Purging a user purges
+	// their vehicles too, and scrubs the IdentifyingDetails from the
+	// security events concerning them; PurgeUser returns a
+	// *UserNotFoundError for a user that doesn't exist.
+	PurgeVehicle(ctx context.Context, vehicleID RowID) error
+	PurgeUser(ctx context.Context, userID RowID) error
+
+	// PurgeDeleted removes everything that went in the trash before the
+	// cutoff, as PurgeVehicle and PurgeUser do, and returns how many rows
+	// were removed.
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+}
+
+func (s *SQLStore) ListDeletedVehicles(ctx context.Context, userID RowID) ([]*Vehicle, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, userId, year, make, model, version, deleted_at FROM vehicles WHERE userId = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC`
+	return s.queryDeletedVehicles(ctx, query, userID)
+}
+
+func (s *SQLStore) GetDeletedVehicle(ctx context.Context, vehicleID RowID) (*Vehicle, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, userId, year, make, model, version, deleted_at FROM vehicles WHERE id = ? AND deleted_at IS NOT NULL`
+	vehicles, err := s.queryDeletedVehicles(ctx, query, vehicleID)
+	if err != nil {
+		return nil, err
+	}
+	if len(vehicles) == 0 {
+		return nil, &VehicleNotFoundError{VehicleID: vehicleID}
+	}
+
+	return vehicles[0], nil
+}
+
+func (s *SQLStore) queryDeletedVehicles(ctx context.Context, query string, args ...interface{}) ([]*Vehicle, error) {
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute list deleted vehicles query: %w", err)
+	}
+	defer rows.Close()
+
+	vehicles := make([]*Vehicle, 0)
+
+	for rows.Next() {
+		var vehicle Vehicle
+		err = rows.Scan(&vehicle.VehicleID, &vehicle.UserID, &vehicle.Year, &vehicle.Make, &vehicle.Model, &vehicle.Version, &vehicle.DeletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		vehicles = append(vehicles, &vehicle)
+	}
+
+	return vehicles, rows.Err()
+}
+
+func (s *SQLStore) RestoreVehicle(ctx context.Context, vehicleID RowID) error {
+	return s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		query := `UPDATE vehicles SET deleted_at = NULL, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL`
+		result, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(query), vehicleID)
+		if err != nil {
+			return fmt.Errorf("failed to restore vehicle: %w", err)
+		}
+
+		restored, err := result.RowsAffected()
+		if err != nil || restored == 0 {
+			return err
+		}
+
+		return sqlTx.recordVehicleRevision(ctx, vehicleID, RevisionRestored, map[string]FieldChange{}, nil)
+	})
+}
+
+func (s *SQLStore) ListDeletedUsers(ctx context.Context) ([]*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, email_address, deleted_at FROM users WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute list deleted users query: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0)
+
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.UserId, &user.EmailAddress, &user.DeletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+func (s *SQLStore) RestoreUser(ctx context.Context, userID RowID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `UPDATE users SET deleted_at = NULL, version = version + 1 WHERE id = ? AND deleted_at IS NOT NULL`
+	result, err := s.conn.ExecContext(ctx, s.rebind(query), userID)
+	if isUniqueViolation(err) {
+		return NewError(ErrConflict, "another account has taken user #%d's email address", userID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore user: %w", err)
+	}
+
+	restored, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to restore user: %w", err)
+	}
+	if restored == 0 {
+		return &UserNotFoundError{UserID: userID}
+	}
+
+	return nil
+}
+
+func (s *SQLStore) PurgeVehicle(ctx context.Context, vehicleID RowID) error {
+	return s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		queries := []string{
+			`DELETE FROM vehicle_revisions WHERE vehicle_id = ?`,
+			`DELETE FROM webhook_deliveries WHERE event_id IN (SELECT id FROM change_events WHERE resource = 'vehicle' AND resource_id = ?)`,
+			`DELETE FROM change_events WHERE resource = 'vehicle' AND resource_id = ?`,
+			`DELETE FROM vehicles WHERE id = ?`,
+		}
+		for _, query := range queries {
+			_, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(query), vehicleID)
+			if err != nil {
+				return fmt.Errorf("failed to purge vehicle: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLStore) PurgeUser(ctx context.Context, userID RowID) error {
+	return s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		err := sqlTx.scrubSecurityEvents(ctx, `id = ?`, userID)
+		if err != nil {
+			return err
+		}
+
+		queries := []string{
+			`DELETE FROM vehicle_revisions WHERE vehicle_id IN (SELECT id FROM vehicles WHERE userId = ?)`,
+			`DELETE FROM vehicles WHERE userId = ?`,
+			`DELETE FROM admins WHERE user_id = ?`,
+			`DELETE FROM idempotency_keys WHERE user_id = ?`,
+			`DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id = ?)`,
+			`DELETE FROM webhooks WHERE user_id = ?`,
+			`DELETE FROM change_events WHERE user_id = ?`,
+		}
+		for _, query := range queries {
+			_, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(query), userID)
+			if err != nil {
+				return fmt.Errorf("failed to purge user: %w", err)
+			}
+		}
+
+		result, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(`DELETE FROM users WHERE id = ?`), userID)
+		if err != nil {
+			return fmt.Errorf("failed to purge user: %w", err)
+		}
+		purged, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to purge user: %w", err)
+		}
+		if purged == 0 {
+			return &UserNotFoundError{UserID: userID}
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLStore) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	var purged int64
+
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		// only the vehicles and users themselves count towards purged
+		exec := func(counted bool, query string, args ...interface{}) error {
+			result, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(query), args...)
+			if err != nil {
+				return fmt.Errorf("failed to purge trash: %w", err)
+			}
+			if !counted {
+				return nil
+			}
+
+			affected, err := result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("failed to count purged rows: %w", err)
+			}
+			purged += affected
+			return nil
+		}
+
+		// children first, so foreign keys hold at every step
+		cutoff := before.UTC()
+		err := exec(false, `DELETE FROM vehicle_revisions WHERE vehicle_id IN (SELECT id FROM vehicles WHERE deleted_at < ? OR userId IN (SELECT id FROM users WHERE deleted_at < ?))`, cutoff, cutoff)
+		if err != nil {
+			return err
+		}
+
+		err = exec(false, `DELETE FROM webhook_deliveries WHERE event_id IN (SELECT id FROM change_events WHERE resource = 'vehicle' AND resource_id IN (SELECT id FROM vehicles WHERE deleted_at < ?))`, cutoff)
+		if err != nil {
+			return err
+		}
+
+		err = exec(false, `DELETE FROM change_events WHERE resource = 'vehicle' AND resource_id IN (SELECT id FROM vehicles WHERE deleted_at < ?)`, cutoff)
+		if err != nil {
+			return err
+		}
+
+		err = exec(true, `DELETE FROM vehicles WHERE deleted_at < ? OR userId IN (SELECT id FROM users WHERE deleted_at < ?)`, cutoff, cutoff)
+		if err != nil {
+			return err
+		}
+
+		err = sqlTx.scrubSecurityEvents(ctx, `deleted_at < ?`, cutoff)
+		if err != nil {
+			return err
+		}
+
+		userQueries := []string{
+			`DELETE FROM admins WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)`,
+			`DELETE FROM idempotency_keys WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)`,
+			`DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?))`,
+			`DELETE FROM webhooks WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)`,
+			`DELETE FROM change_events WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)`,
+		}
+		for _, query := range userQueries {
+			err = exec(false, query, cutoff)
+			if err != nil {
+				return err
+			}
+		}
+
+		return exec(true, `DELETE FROM users WHERE deleted_at < ?`, cutoff)
+	})
+
+	return purged, err
+}
@@ -1,36 +1,29 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 	"log"
+	"strings"
+	"time"
 )
 
-var usersTable = `
-CREATE TABLE users (
-	"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
-	"email_address" TEXT,
-	"password_hash" TEXT
-)`
-
 type User struct {
-	EmailAddress string `json:"email_address"`
-	PasswordHash []byte `json:"-"`
-	UserId       RowID  `json:"user_id"`
+	EmailAddress string     `json:"email_address"`
+	PasswordHash []byte     `json:"-"`
+	UserId       RowID      `json:"user_id"`
+	Version      int64      `json:"version"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
 }
 
 func (u *User) DoesPasswordMatch(password string) bool {
-	passwordHash := hashPassword(password)
-	if len(passwordHash) != len(u.PasswordHash) {
-		return false
-	}
-
-	for idx, a := range passwordHash {
-		if a != u.PasswordHash[idx] {
-			return false
-		}
-	}
-	return true
+	// bcrypt salts every hash, so the stored hash has to be compared rather
+	// than re-hashing the candidate password
+	err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password))
+	return err == nil
 }
 
 func hashPassword(password string) []byte {
@@ -43,137 +36,198 @@ func hashPassword(password string) []byte {
 	return hash
 }
 
-func CreateUser(emailAddress string, password string) (*User, error) {
-	query := `INSERT INTO users (email_address, password_hash) VALUES (?, ?)`
-	stmt, err := sqlDb.Prepare(query)
-	if err != nil {
-		return nil, err
-	}
+// normalizeEmailAddress is the form of an address that's stored and shown:
+// trimmed, with accented characters composed the same way however they
+// were typed.
+func normalizeEmailAddress(emailAddress string) string {
+	return norm.NFC.String(strings.TrimSpace(emailAddress))
+}
 
-	result, err := stmt.Exec(emailAddress, hashPassword(password))
-	if err != nil {
-		return nil, err
-	}
+// emailAddressKey is the form of an address that accounts are looked up and
+// kept unique by. Addresses that differ only in case, or in how a character
+// is encoded, share a key.
+func emailAddressKey(emailAddress string) string {
+	folded := cases.Fold().String(norm.NFKC.String(strings.TrimSpace(emailAddress)))
+	return norm.NFKC.String(folded)
+}
+
+func (s *SQLStore) CreateUser(ctx context.Context, emailAddress string, password string) (*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 
-	lastInserted, err := result.LastInsertId()
+	emailAddress = normalizeEmailAddress(emailAddress)
+
+	query := `INSERT INTO users (email_address, email_key, password_hash) VALUES (?, ?, ?)`
+	userId, err := s.insert(ctx, query, emailAddress, emailAddressKey(emailAddress), hashPassword(password))
+	if isUniqueViolation(err) {
+		return nil, &EmailAddressTakenError{EmailAddress: emailAddress}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	user := User{
 		EmailAddress: emailAddress,
-		UserId:       RowID(lastInserted),
+		UserId:       userId,
+		Version:      1,
 	}
 	return &user, nil
 }
 
-func FindUserByEmailAddress(emailAddress string) (*User, error) {
-	query := `SELECT id, password_hash FROM users WHERE email_address = ?`
-	stmt, err := sqlDb.Prepare(query)
+func (s *SQLStore) FindUserByEmailAddress(ctx context.Context, emailAddress string) (*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, email_address, password_hash, version FROM users WHERE email_key = ? AND deleted_at IS NULL`
+	stmt, err := s.reader.PrepareContext(ctx, s.rebind(query))
 	if err != nil {
 		return nil, err
 	}
 
-	row, err := stmt.Query(emailAddress)
+	row, err := stmt.QueryContext(ctx, emailAddressKey(emailAddress))
 	if err != nil {
 		return nil, err
 	}
 
 	defer row.Close()
 
-	var (
-		userId       RowID
-		passwordHash []byte
-	)
-
 	for row.Next() {
-		err = row.Scan(&userId)
+		var user User
+		err = row.Scan(&user.UserId, &user.EmailAddress, &user.PasswordHash, &user.Version)
 		if err != nil {
 			return nil, err
 		}
-
-		user := User{
-			UserId:       userId,
-			EmailAddress: emailAddress,
-			PasswordHash: passwordHash,
-		}
 		return &user, nil
 	}
 
 	return nil, &EmailAddressNotFoundError{EmailAddress: emailAddress}
 }
 
-func GetUser(userId RowID) (*User, error) {
-	query := `SELECT email_address, password_hash FROM users WHERE id = ?`
-	stmt, err := sqlDb.Prepare(query)
+func (s *SQLStore) GetUser(ctx context.Context, userId RowID) (*User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT email_address, password_hash, version FROM users WHERE id = ? AND deleted_at IS NULL`
+	stmt, err := s.reader.PrepareContext(ctx, s.rebind(query))
 	if err != nil {
 		return nil, err
 	}
 
-	row, err := stmt.Query(userId)
+	row, err := stmt.QueryContext(ctx, userId)
 	if err != nil {
 		return nil, err
 	}
 	defer row.Close()
 
 	for row.Next() {
-		var (
-			passwordHash []byte
-			emailAddress string
-		)
-
-		err = row.Scan(&emailAddress, &passwordHash)
+		user := User{UserId: userId}
+		err = row.Scan(&user.EmailAddress, &user.PasswordHash, &user.Version)
 		if err != nil {
 			return nil, err
 		}
-
-		user := User{
-			UserId:       userId,
-			EmailAddress: emailAddress,
-			PasswordHash: passwordHash,
-		}
 		return &user, nil
 	}
 
 	return nil, &UserNotFoundError{UserID: userId}
 }
 
-func UpdateUser(userId RowID, emailAddress string) (*User, error) {
-	// nothing to update
-	if emailAddress == "" {
-		return GetUser(userId)
-	}
+func (s *SQLStore) UpdateUser(ctx context.Context, userId RowID, version int64, emailAddress string) (*User, error) {
+	var user *User
+
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		var err error
+		user, err = sqlTx.GetUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		err = checkVersion(version, user.Version)
+		if err != nil {
+			return err
+		}
+
+		// nothing to update
+		emailAddress = normalizeEmailAddress(emailAddress)
+		if emailAddress == "" || emailAddress == user.EmailAddress {
+			return nil
+		}
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		query := `UPDATE users SET email_address = ?, email_key = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND version = ?`
+		stmt, err := sqlTx.conn.PrepareContext(ctx, sqlTx.rebind(query))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		result, err := stmt.ExecContext(ctx, emailAddress, emailAddressKey(emailAddress), userId, user.Version)
+		if isUniqueViolation(err) {
+			return &EmailAddressTakenError{EmailAddress: emailAddress}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return &VersionMismatchError{Expected: user.Version}
+		}
 
-	query := `UPDATE users SET email_address=? WHERE id = ?`
-	stmt, err := sqlDb.Prepare(query)
+		user.EmailAddress = emailAddress
+		user.Version++
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = stmt.Exec(emailAddress, userId)
-	if err != nil {
-		return nil, fmt.Errorf("failed to update user: %s", err)
-	}
+	return &User{UserId: user.UserId, EmailAddress: user.EmailAddress, Version: user.Version}, nil
+}
 
-	user := User{
-		UserId:       userId,
-		EmailAddress: emailAddress,
-	}
+// DeleteUser moves an account to the trash. Its vehicles stay where they are
+// and come back with it if the account is restored.
+func (s *SQLStore) DeleteUser(ctx context.Context, userId RowID, version int64) error {
+	return s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
 
-	return &user, nil
-}
+		user, err := sqlTx.GetUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		err = checkVersion(version, user.Version)
+		if err != nil {
+			return err
+		}
 
-func DeleteUser(userId RowID) error {
-	query := `DELETE FROM users WHERE id = ?`
-	stmt, err := sqlDb.Prepare(query)
-	if err != nil {
-		return fmt.Errorf("failed to prepare delete statement: %v", err)
-	}
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
 
-	_, err = stmt.Exec(userId)
-	if err != nil {
-		return fmt.Errorf("failed to delete user: %v", err)
-	}
+		query := `UPDATE users SET deleted_at = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND version = ?`
+		stmt, err := sqlTx.conn.PrepareContext(ctx, sqlTx.rebind(query))
+		if err != nil {
+			return fmt.Errorf("failed to prepare delete statement: %w", err)
+		}
+		defer stmt.Close()
+
+		result, err := stmt.ExecContext(ctx, time.Now().UTC(), userId, user.Version)
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return &VersionMismatchError{Expected: user.Version}
+		}
 
-	return nil
+		return nil
+	})
 }
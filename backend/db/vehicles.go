@@ -1,21 +1,12 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 )
 
-var vehiclesTable = `
-CREATE TABLE vehicles (
-	"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-	"year" INTEGER NOT NULL,
-	"make" STRING NOT NULL,
-	"model" STRING NOT NULL,
-	"userId" INTEGER NOT NULL,
-	
-	FOREIGN KEY (userId) REFERENCES users (id)
-)`
-
 type Vehicle struct {
 	VehicleID RowID `json:"vehicle_id"`
 	UserID    RowID `json:"user_id"`
@@ -23,60 +14,123 @@ type Vehicle struct {
 	Year  Year   `json:"year"`
 	Make  string `json:"make"`
 	Model string `json:"model"`
+
+	// Version counts the writes to the vehicle, for optimistic locking.
+	Version int64 `json:"version"`
+
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-func CreateVehicle(userID RowID, year Year, make, model string) (*Vehicle, error) {
-	query := `INSERT INTO vehicles (userId, year, make, model) VALUES (?, ?, ?, ?)`
-	stmt, err := sqlDb.Prepare(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prep vehicle statement: %w", err)
-	}
+func (s *SQLStore) CreateVehicle(ctx context.Context, userID RowID, year Year, make, model string) (*Vehicle, error) {
+	var vehicle *Vehicle
 
-	result, err := stmt.Exec(userID, year, make, model)
-	if err != nil {
-		return nil, fmt.Errorf("failed to exec create vehicle statement: %w", err)
-	}
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
 
-	defer stmt.Close()
+		query := `INSERT INTO vehicles (userId, year, make, model) VALUES (?, ?, ?, ?)`
+		vehicleID, err := sqlTx.insert(ctx, query, userID, year, make, model)
+		if err != nil {
+			return fmt.Errorf("failed to exec create vehicle statement: %w", err)
+		}
 
-	lastInserted, err := result.LastInsertId()
+		vehicle = &Vehicle{
+			VehicleID: vehicleID,
+			UserID:    userID,
+			Year:      year,
+			Make:      make,
+			Model:     model,
+			Version:   1,
+		}
+
+		changes, err := diffVehicles(nil, vehicle)
+		if err != nil {
+			return err
+		}
+
+		return sqlTx.recordVehicleRevision(ctx, vehicleID, RevisionCreated, changes, nil)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve last inserted id: %w", err)
+		return nil, err
 	}
 
-	vehicle := Vehicle{
-		VehicleID: RowID(lastInserted),
-		UserID:    userID,
-		Year:      year,
-		Make:      make,
-		Model:     model,
+	return vehicle, nil
+}
+
+// VehicleFilter narrows down ListVehicles; its zero values don't.
+type VehicleFilter struct {
+	YearFrom Year
+	YearTo   Year
+	// Make matches ignoring case.
+	Make string
+}
+
+// VehicleSortKeys are the orders vehicles can be listed in; by id, the
+// order they were added, is the default.
+var VehicleSortKeys = []SortKey{
+	{Name: "id"},
+	{Name: "year", Column: "year"},
+	{Name: "make", Column: "make"},
+	{Name: "model", Column: "model"},
+}
+
+// vehicleSortValue is a vehicle's value for one of VehicleSortKeys.
+func vehicleSortValue(vehicle *Vehicle, key string) interface{} {
+	switch key {
+	case "year":
+		return int64(vehicle.Year)
+	case "make":
+		return vehicle.Make
+	case "model":
+		return vehicle.Model
 	}
-	return &vehicle, nil
+	return nil
 }
 
-func ListVehicles(userID RowID) ([]*Vehicle, error) {
-	query := `SELECT id, year, make, model FROM vehicles WHERE userId = ?`
-	stmt, err := sqlDb.Prepare(query)
+func (s *SQLStore) ListVehicles(ctx context.Context, userID RowID, filter VehicleFilter, options ListOptions) ([]*Vehicle, *Cursor, error) {
+	key, err := sortKey(VehicleSortKeys, options)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare list vehicles query: %v", err)
+		return nil, nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, year, make, model, version FROM vehicles WHERE userId = ? AND deleted_at IS NULL`
+	args := []interface{}{userID}
+	if filter.YearFrom != 0 {
+		query += ` AND year >= ?`
+		args = append(args, filter.YearFrom)
+	}
+	if filter.YearTo != 0 {
+		query += ` AND year <= ?`
+		args = append(args, filter.YearTo)
+	}
+	if filter.Make != "" {
+		query += ` AND LOWER(make) = LOWER(?)`
+		args = append(args, filter.Make)
 	}
+	query, args = pageQuery(query, args, key, options)
 
-	rows, err := stmt.Query(userID)
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute list vehicles query: %v", err)
+		return nil, nil, fmt.Errorf("failed to execute list vehicles query: %w", err)
 	}
 	defer rows.Close()
 
 	var vehicleID RowID
 	var year uint16
 	var vehicleMake, model string
+	var version int64
 
 	vehicles := make([]*Vehicle, 0)
 
 	for rows.Next() {
-		err = rows.Scan(&vehicleID, &year, &vehicleMake, &model)
+		err = rows.Scan(&vehicleID, &year, &vehicleMake, &model, &version)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %v", err)
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
 		vehicle := Vehicle{
@@ -85,35 +139,50 @@ func ListVehicles(userID RowID) ([]*Vehicle, error) {
 			Year:      Year(year),
 			Make:      vehicleMake,
 			Model:     model,
+			Version:   version,
 		}
 
 		vehicles = append(vehicles, &vehicle)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list vehicles: %w", err)
+	}
+
+	keep, more := endPage(len(vehicles), options)
+	vehicles = vehicles[:keep]
+	if !more {
+		return vehicles, nil, nil
+	}
 
-	return vehicles, nil
+	last := vehicles[keep-1]
+	return vehicles, nextCursor(options, key, vehicleSortValue(last, key.Name), last.VehicleID), nil
 }
 
-func GetVehicle(vehicleID RowID) (*Vehicle, error) {
-	query := `SELECT userId, year, make, model FROM vehicles WHERE id = ?`
-	stmt, err := sqlDb.Prepare(query)
+func (s *SQLStore) GetVehicle(ctx context.Context, vehicleID RowID) (*Vehicle, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT userId, year, make, model, version FROM vehicles WHERE id = ? AND deleted_at IS NULL`
+	stmt, err := s.reader.PrepareContext(ctx, s.rebind(query))
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare get vehicle query: %v", err)
+		return nil, fmt.Errorf("failed to prepare get vehicle query: %w", err)
 	}
 
-	rows, err := stmt.Query(vehicleID)
+	rows, err := stmt.QueryContext(ctx, vehicleID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute get vehicle query: %v", err)
+		return nil, fmt.Errorf("failed to execute get vehicle query: %w", err)
 	}
 	defer rows.Close()
 
 	var userId uint64
 	var year uint16
 	var vehicleMake, model string
+	var version int64
 
 	for rows.Next() {
-		err = rows.Scan(&userId, &year, &vehicleMake, &model)
+		err = rows.Scan(&userId, &year, &vehicleMake, &model, &version)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %v", err)
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
 		vehicle := Vehicle{
@@ -122,64 +191,123 @@ func GetVehicle(vehicleID RowID) (*Vehicle, error) {
 			Year:      Year(year),
 			Make:      vehicleMake,
 			Model:     model,
+			Version:   version,
 		}
 		return &vehicle, nil
 	}
 
-	return nil, nil
+	return nil, &VehicleNotFoundError{VehicleID: vehicleID}
 }
 
-func UpdateVehicle(vehicleID RowID, year *NullYear, vehicleMake, model *NullString) error {
+func (s *SQLStore) UpdateVehicle(ctx context.Context, vehicleID RowID, version int64, year *NullYear, vehicleMake, model *NullString) error {
+	return s.updateVehicle(ctx, vehicleID, version, year, vehicleMake, model, RevisionUpdated, nil)
+}
+
+// updateVehicle makes an update and records it as a revision with the given
+// action. An update that doesn't change anything isn't recorded and doesn't
+// count as a new version.
+func (s *SQLStore) updateVehicle(ctx context.Context, vehicleID RowID, version int64, year *NullYear, vehicleMake, model *NullString, action string, reverts *RowID) error {
 	var values = make([]interface{}, 0, 0)
 	sets := make([]string, 0, 0)
 
-	if year.Valid {
+	if year != nil && year.Valid {
 		values = append(values, year.Year)
 		sets = append(sets, "year = ?")
 	}
 
-	if vehicleMake.Valid {
+	if vehicleMake != nil && vehicleMake.Valid {
 		values = append(values, vehicleMake.String)
 		sets = append(sets, "make = ?")
 	}
 
-	if model.Valid {
+	if model != nil && model.Valid {
 		values = append(values, model.String)
 		sets = append(sets, "model = ?")
 	}
 
-	if len(values) == 0 {
-		return nil
-	}
+	return s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		before, err := sqlTx.GetVehicle(ctx, vehicleID)
+		if err != nil {
+			return err
+		}
+		err = checkVersion(version, before.Version)
+		if err != nil {
+			return err
+		}
 
-	values = append(values, vehicleID)
+		changes, err := diffVehicles(before, applyVehicleChanges(*before, year, vehicleMake, model))
+		if err != nil || len(changes) == 0 {
+			return err
+		}
 
-	query := fmt.Sprintf(`UPDATE vehicles SET %s WHERE id = ?`, strings.Join(sets, ", "))
-	stmt, err := sqlDb.Prepare(query)
-	if err != nil {
-		return fmt.Errorf("failed to prepare update vehicle query: %v", err)
-	}
-	defer stmt.Close()
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
 
-	_, err = stmt.Exec(values...)
-	if err != nil {
-		return fmt.Errorf("failed to execute update vehicle query: %v", err)
-	}
+		// the version check is repeated in the update, since postgres lets
+		// another transaction write the row after it was read
+		query := fmt.Sprintf(`UPDATE vehicles SET %s, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND version = ?`, strings.Join(sets, ", "))
+		stmt, err := sqlTx.conn.PrepareContext(ctx, sqlTx.rebind(query))
+		if err != nil {
+			return fmt.Errorf("failed to prepare update vehicle query: %w", err)
+		}
+		defer stmt.Close()
 
-	return nil
+		result, err := stmt.ExecContext(ctx, append(values, vehicleID, before.Version)...)
+		if err != nil {
+			return fmt.Errorf("failed to execute update vehicle query: %w", err)
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return &VersionMismatchError{Expected: before.Version}
+		}
+
+		return sqlTx.recordVehicleRevision(ctx, vehicleID, action, changes, reverts)
+	})
 }
 
-func DeleteVehicle(vehicleID RowID) error {
-	query := `DELETE FROM vehicles WHERE id = ?`
-	stmt, err := sqlDb.Prepare(query)
-	if err != nil {
-		return fmt.Errorf("failed to prepare delete vehicle query: %v", err)
-	}
+// DeleteVehicle moves a vehicle to the trash; PurgeVehicle removes it for good.
+func (s *SQLStore) DeleteVehicle(ctx context.Context, vehicleID RowID, version int64) error {
+	return s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
 
-	_, err = stmt.Exec(vehicleID)
-	if err != nil {
-		return fmt.Errorf("failed to execute update vehicle query: %v", err)
-	}
+		before, err := sqlTx.GetVehicle(ctx, vehicleID)
+		if err != nil {
+			return err
+		}
+		err = checkVersion(version, before.Version)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		query := `UPDATE vehicles SET deleted_at = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND version = ?`
+		stmt, err := sqlTx.conn.PrepareContext(ctx, sqlTx.rebind(query))
+		if err != nil {
+			return fmt.Errorf("failed to prepare delete vehicle query: %w", err)
+		}
+		defer stmt.Close()
+
+		result, err := stmt.ExecContext(ctx, time.Now().UTC(), vehicleID, before.Version)
+		if err != nil {
+			return fmt.Errorf("failed to execute delete vehicle query: %w", err)
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return &VersionMismatchError{Expected: before.Version}
+		}
+
+		return sqlTx.recordVehicleRevision(ctx, vehicleID, RevisionDeleted, map[string]FieldChange{}, nil)
+	})
 }
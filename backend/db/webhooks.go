@@ -0,0 +1,556 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	ChangeVehicleCreated  = "vehicle.created"
+	ChangeVehicleUpdated  = "vehicle.updated"
+	ChangeVehicleDeleted  = "vehicle.deleted"
+	ChangeVehicleRestored = "vehicle.restored"
+	// ChangeWebhookPing is sent to a webhook alone, on request, to test it.
+	ChangeWebhookPing = "webhook.ping"
+)
+
+// ChangeTypes are the changes webhooks can subscribe to.
+var ChangeTypes = []string{ChangeVehicleCreated, ChangeVehicleUpdated, ChangeVehicleDeleted, ChangeVehicleRestored}
+
+// revisionChanges are the changes each kind of vehicle revision makes.
+var revisionChanges = map[string]string{
+	RevisionCreated:  ChangeVehicleCreated,
+	RevisionUpdated:  ChangeVehicleUpdated,
+	RevisionReverted: ChangeVehicleUpdated,
+	RevisionDeleted:  ChangeVehicleDeleted,
+	RevisionRestored: ChangeVehicleRestored,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// ChangeEvent is a change to one of a user's records, as it's told to the
+// user's webhooks. Events are recorded in the transaction that made the
+// change, so that they're the outbox of the webhooks: an event is recorded
+// if and only if the change is, and waits there to be delivered.
+type ChangeEvent struct {
+	EventID RowID  `json:"event_id"`
+	UserID  RowID  `json:"user_id"`
+	Type    string `json:"type"`
+	// Resource and ResourceID name the record that changed, e.g. vehicle 7.
+	Resource   string          `json:"resource"`
+	ResourceID RowID           `json:"resource_id"`
+	Data       json.RawMessage `json:"data"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// VehicleChange is the data of a vehicle event: the vehicle as the change
+// left it, and the revision that changed it.
+type VehicleChange struct {
+	Vehicle    *Vehicle               `json:"vehicle"`
+	RevisionID RowID                  `json:"revision_id"`
+	Changes    map[string]FieldChange `json:"changes"`
+}
+
+// Webhook is a URL that a user's events of the given types are posted to.
+type Webhook struct {
+	WebhookID RowID    `json:"webhook_id"`
+	UserID    RowID    `json:"user_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	// Secret signs the deliveries. Only CreateWebhook returns it.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscribes reports whether events of the given type are sent to the
+// webhook.
+func (webhook *Webhook) Subscribes(eventType string) bool {
+	for _, subscribed := range webhook.Events {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is the sending of one event to one webhook, and the log
+// of how that went. Pending deliveries are tried again at NextAttemptAt.
+type WebhookDelivery struct {
+	DeliveryID RowID  `json:"delivery_id"`
+	WebhookID  RowID  `json:"webhook_id"`
+	EventID    RowID  `json:"event_id"`
+	EventType  string `json:"event_type"`
+	State      string `json:"state"`
+	Attempts   int    `json:"attempts"`
+	// ResponseStatus and Error are those of the last attempt.
+	ResponseStatus *int       `json:"response_status"`
+	Error          string     `json:"error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// PendingDelivery is a delivery that's due, with what it takes to make it.
+type PendingDelivery struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+	Event  ChangeEvent
+}
+
+// WebhookAttempt is how one attempt at a delivery went.
+type WebhookAttempt struct {
+	At time.Time
+	// ResponseStatus is 0 when there was no response at all.
+	ResponseStatus int
+	Error          string
+	// State is the delivery's state after the attempt; a pending delivery
+	// is tried again at RetryAt.
+	State   string
+	RetryAt time.Time
+}
+
+// WebhookDeliverySortKeys are the orders deliveries can be listed in.
+// Deliveries are numbered as they're queued, so they're in time order by id.
+var WebhookDeliverySortKeys = []SortKey{
+	{Name: "created_at"},
+}
+
+// WebhookStore persists webhooks, the events they're sent and the log of
+// their deliveries.
+type WebhookStore interface {
+	// CreateWebhook subscribes url to the user's events of the given types,
+	// signed with secret.
+	CreateWebhook(ctx context.Context, userID RowID, url string, events []string, secret string) (*Webhook, error)
+	ListWebhooks(ctx context.Context, userID RowID) ([]*Webhook, error)
+	// GetWebhook returns a *WebhookNotFoundError for a missing webhook, as
+	// do DeleteWebhook and PingWebhook.
+	GetWebhook(ctx context.Context, webhookID RowID) (*Webhook, error)
+	// DeleteWebhook removes a webhook along with its deliveries.
+	DeleteWebhook(ctx context.Context, webhookID RowID) error
+	// PingWebhook queues a webhook.ping event for the webhook alone.
+	PingWebhook(ctx context.Context, webhookID RowID) (*WebhookDelivery, error)
+	// ListWebhookDeliveries returns a page of a webhook's deliveries in
+	// WebhookDeliverySortKeys order, and the cursor for the next page.
+	ListWebhookDeliveries(ctx context.Context, webhookID RowID, options ListOptions) ([]*WebhookDelivery, *Cursor, error)
+
+	// ClaimWebhookDeliveries returns up to limit pending deliveries that
+	// are due by now, oldest first, and puts them off until now+lease, so
+	// that one cut short, by a restart say, is tried again then.
+	ClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*PendingDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, deliveryID RowID, attempt *WebhookAttempt) error
+	// PurgeChangeEvents forgets the events recorded before the given time,
+	// and their deliveries, returning how many events there were.
+	PurgeChangeEvents(ctx context.Context, before time.Time) (int64, error)
+}
+
+func (s *SQLStore) CreateWebhook(ctx context.Context, userID RowID, url string, events []string, secret string) (*Webhook, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	encoded, err := json.Marshal(events)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode webhook events: %w", err)
+	}
+
+	webhook := &Webhook{UserID: userID, URL: url, Events: events, Secret: secret, CreatedAt: time.Now().UTC()}
+	query := `INSERT INTO webhooks (user_id, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?)`
+	webhook.WebhookID, err = s.insert(ctx, query, userID, url, string(encoded), secret, webhook.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	return webhook, nil
+}
+
+func (s *SQLStore) ListWebhooks(ctx context.Context, userID RowID) ([]*Webhook, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, user_id, url, events, created_at FROM webhooks WHERE user_id = ? ORDER BY id`
+	return s.queryWebhooks(ctx, query, userID)
+}
+
+func (s *SQLStore) GetWebhook(ctx context.Context, webhookID RowID) (*Webhook, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT id, user_id, url, events, created_at FROM webhooks WHERE id = ?`
+	webhooks, err := s.queryWebhooks(ctx, query, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, &WebhookNotFoundError{WebhookID: webhookID}
+	}
+
+	return webhooks[0], nil
+}
+
+func (s *SQLStore) queryWebhooks(ctx context.Context, query string, args ...interface{}) ([]*Webhook, error) {
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute list webhooks query: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]*Webhook, 0)
+
+	for rows.Next() {
+		var (
+			webhook Webhook
+			events  string
+		)
+		err = rows.Scan(&webhook.WebhookID, &webhook.UserID, &webhook.URL, &events, &webhook.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		err = json.Unmarshal([]byte(events), &webhook.Events)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode webhook %d's events: %w", webhook.WebhookID, err)
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func (s *SQLStore) DeleteWebhook(ctx context.Context, webhookID RowID) error {
+	return s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		_, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`), webhookID)
+		if err != nil {
+			return fmt.Errorf("failed to delete webhook deliveries: %w", err)
+		}
+
+		result, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(`DELETE FROM webhooks WHERE id = ?`), webhookID)
+		if err != nil {
+			return fmt.Errorf("failed to delete webhook: %w", err)
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return &WebhookNotFoundError{WebhookID: webhookID}
+		}
+
+		return nil
+	})
+}
+
+func (s *SQLStore) PingWebhook(ctx context.Context, webhookID RowID) (*WebhookDelivery, error) {
+	var delivery *WebhookDelivery
+
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		webhook, err := sqlTx.GetWebhook(ctx, webhookID)
+		if err != nil {
+			return err
+		}
+
+		event, err := pingEvent(webhook)
+		if err != nil {
+			return err
+		}
+		err = sqlTx.insertChangeEvent(ctx, event)
+		if err != nil {
+			return err
+		}
+
+		deliveryID, err := sqlTx.queueDelivery(ctx, webhookID, event)
+		if err != nil {
+			return err
+		}
+
+		delivery, err = sqlTx.getWebhookDelivery(ctx, deliveryID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+func pingEvent(webhook *Webhook) (*ChangeEvent, error) {
+	data, err := json.Marshal(map[string]interface{}{"webhook_id": webhook.WebhookID})
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeEvent{
+		UserID:     webhook.UserID,
+		Type:       ChangeWebhookPing,
+		Resource:   "webhook",
+		ResourceID: webhook.WebhookID,
+		Data:       data,
+	}, nil
+}
+
+// vehicleChangeEvent is the event a revision of a vehicle makes.
+func vehicleChangeEvent(vehicle *Vehicle, revisionID RowID, action string, changes map[string]FieldChange) (*ChangeEvent, error) {
+	data, err := json.Marshal(&VehicleChange{Vehicle: vehicle, RevisionID: revisionID, Changes: changes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode vehicle change: %w", err)
+	}
+	return &ChangeEvent{
+		UserID:     vehicle.UserID,
+		Type:       revisionChanges[action],
+		Resource:   "vehicle",
+		ResourceID: vehicle.VehicleID,
+		Data:       data,
+	}, nil
+}
+
+// recordChangeEvent appends an event to the outbox, with a delivery for
+// each of the user's webhooks that subscribes to it. It's called within the
+// transaction that makes the change.
+func (s *SQLStore) recordChangeEvent(ctx context.Context, event *ChangeEvent) error {
+	err := s.insertChangeEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	webhooks, err := s.ListWebhooks(ctx, event.UserID)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if !webhook.Subscribes(event.Type) {
+			continue
+		}
+		_, err = s.queueDelivery(ctx, webhook.WebhookID, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertChangeEvent records an event. The user's events are numbered in the
+// order they're committed, by holding the user's row until the transaction
+// ends, so that a stream of them that's read up to one event has seen all
+// of those before it.
+func (s *SQLStore) insertChangeEvent(ctx context.Context, event *ChangeEvent) error {
+	if s.dialect.forUpdate != "" {
+		var userID RowID
+		err := s.conn.QueryRowContext(ctx, s.rebind(`SELECT id FROM users WHERE id = ?`+s.dialect.forUpdate), event.UserID).Scan(&userID)
+		if err != nil {
+			return fmt.Errorf("failed to lock user for change event: %w", err)
+		}
+	}
+
+	event.CreatedAt = time.Now().UTC()
+
+	query := `INSERT INTO change_events (user_id, type, resource, resource_id, data, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	eventID, err := s.insert(ctx, query, event.UserID, event.Type, event.Resource, event.ResourceID, string(event.Data), event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record change event: %w", err)
+	}
+
+	event.EventID = eventID
+	return nil
+}
+
+func (s *SQLStore) queueDelivery(ctx context.Context, webhookID RowID, event *ChangeEvent) (RowID, error) {
+	query := `INSERT INTO webhook_deliveries (webhook_id, event_id, state, attempts, error, next_attempt_at, created_at) VALUES (?, ?, ?, 0, '', ?, ?)`
+	deliveryID, err := s.insert(ctx, query, webhookID, event.EventID, DeliveryPending, event.CreatedAt, event.CreatedAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue webhook delivery: %w", err)
+	}
+	return deliveryID, nil
+}
+
+const webhookDeliveryColumns = `d.id, d.webhook_id, d.event_id, e.type, d.state, d.attempts, d.response_status, d.error, d.next_attempt_at, d.last_attempt_at, d.created_at`
+
+func (s *SQLStore) getWebhookDelivery(ctx context.Context, deliveryID RowID) (*WebhookDelivery, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries d JOIN change_events e ON e.id = d.event_id WHERE d.id = ?`
+	delivery := &WebhookDelivery{}
+	err := scanWebhookDelivery(s.reader.QueryRowContext(ctx, s.rebind(query), deliveryID), delivery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook delivery: %w", err)
+	}
+	return delivery, nil
+}
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }, delivery *WebhookDelivery, extra ...interface{}) error {
+	var responseStatus sql.NullInt64
+	dest := append([]interface{}{
+		&delivery.DeliveryID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, &delivery.State, &delivery.Attempts,
+		&responseStatus, &delivery.Error, &delivery.NextAttemptAt, &delivery.LastAttemptAt, &delivery.CreatedAt,
+	}, extra...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return err
+	}
+	if responseStatus.Valid {
+		status := int(responseStatus.Int64)
+		delivery.ResponseStatus = &status
+	}
+	return nil
+}
+
+func (s *SQLStore) ListWebhookDeliveries(ctx context.Context, webhookID RowID, options ListOptions) ([]*WebhookDelivery, *Cursor, error) {
+	key, err := sortKey(WebhookDeliverySortKeys, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// pageQuery pages by id, which has to be the delivery's
+	query := `SELECT * FROM (SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries d JOIN change_events e ON e.id = d.event_id WHERE d.webhook_id = ?) deliveries WHERE 1 = 1`
+	query, args := pageQuery(query, []interface{}{webhookID}, key, options)
+	rows, err := s.reader.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to execute list webhook deliveries query: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]*WebhookDelivery, 0)
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err = scanWebhookDelivery(rows, &delivery)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+
+	keep, more := endPage(len(deliveries), options)
+	deliveries = deliveries[:keep]
+	if !more {
+		return deliveries, nil, nil
+	}
+	return deliveries, nextCursor(options, key, nil, deliveries[keep-1].DeliveryID), nil
+}
+
+func (s *SQLStore) ClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*PendingDelivery, error) {
+	deliveries := make([]*PendingDelivery, 0)
+
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		query := `SELECT ` + webhookDeliveryColumns + `, w.url, w.secret, e.user_id, e.resource, e.resource_id, e.data, e.created_at
+FROM webhook_deliveries d
+JOIN webhooks w ON w.id = d.webhook_id
+JOIN change_events e ON e.id = d.event_id
+WHERE d.state = ? AND d.next_attempt_at <= ?
+ORDER BY d.next_attempt_at, d.id
+LIMIT ?`
+		rows, err := sqlTx.conn.QueryContext(ctx, sqlTx.rebind(query), DeliveryPending, now.UTC(), limit)
+		if err != nil {
+			return fmt.Errorf("failed to query due webhook deliveries: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				delivery PendingDelivery
+				data     string
+			)
+			err = scanWebhookDelivery(rows, &delivery.WebhookDelivery,
+				&delivery.URL, &delivery.Secret, &delivery.Event.UserID, &delivery.Event.Resource, &delivery.Event.ResourceID, &data, &delivery.Event.CreatedAt,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			delivery.Event.EventID, delivery.Event.Type, delivery.Event.Data = delivery.EventID, delivery.EventType, json.RawMessage(data)
+
+			deliveries = append(deliveries, &delivery)
+		}
+		err = rows.Err()
+		if err != nil {
+			return fmt.Errorf("failed to query due webhook deliveries: %w", err)
+		}
+		rows.Close()
+
+		leased := now.Add(lease).UTC()
+		for _, delivery := range deliveries {
+			_, err = sqlTx.conn.ExecContext(ctx, sqlTx.rebind(`UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ?`), leased, delivery.DeliveryID)
+			if err != nil {
+				return fmt.Errorf("failed to claim webhook delivery: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (s *SQLStore) RecordWebhookAttempt(ctx context.Context, deliveryID RowID, attempt *WebhookAttempt) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var responseStatus, nextAttemptAt interface{}
+	if attempt.ResponseStatus != 0 {
+		responseStatus = attempt.ResponseStatus
+	}
+	if attempt.State == DeliveryPending {
+		nextAttemptAt = attempt.RetryAt.UTC()
+	}
+
+	query := `UPDATE webhook_deliveries SET state = ?, attempts = attempts + 1, response_status = ?, error = ?, next_attempt_at = ?, last_attempt_at = ? WHERE id = ?`
+	_, err := s.conn.ExecContext(ctx, s.rebind(query), attempt.State, responseStatus, attempt.Error, nextAttemptAt, attempt.At.UTC(), deliveryID)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook attempt: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) PurgeChangeEvents(ctx context.Context, before time.Time) (int64, error) {
+	var purged int64
+
+	err := s.InTx(ctx, func(tx Tx) error {
+		sqlTx := tx.(*SQLStore)
+
+		ctx, cancel := sqlTx.withTimeout(ctx)
+		defer cancel()
+
+		cutoff := before.UTC()
+		_, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(`DELETE FROM webhook_deliveries WHERE event_id IN (SELECT id FROM change_events WHERE created_at < ?)`), cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to purge webhook deliveries: %w", err)
+		}
+
+		result, err := sqlTx.conn.ExecContext(ctx, sqlTx.rebind(`DELETE FROM change_events WHERE created_at < ?`), cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to purge change events: %w", err)
+		}
+		purged, err = result.RowsAffected()
+		return err
+	})
+
+	return purged, err
+}
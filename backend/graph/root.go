@@ -1,8 +1,138 @@
 package graph
 
-import "github.com/graphql-go/graphql"
+import (
+	"context"
+	"errors"
+
+	"github.com/graphql-go/graphql"
+
+	"vehicledb/auth"
+	"vehicledb/db"
+)
+
+var errUnauthenticated = db.NewError(db.ErrUnauthenticated, "must be logged in")
+
+// extendedError reports the code of a store error in the GraphQL error's
+// extensions, the way REST responses report it in their body.
+type extendedError struct {
+	error
+}
+
+func (err extendedError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"code": db.ErrorCode(err.error)}
+
+	var detailed db.DetailedError
+	if errors.As(err.error, &detailed) {
+		for k, v := range detailed.Details() {
+			extensions[k] = v
+		}
+	}
+
+	return extensions
+}
+
+// withErrorCodes wraps a resolver so that its errors carry their code.
+func withErrorCodes(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		result, err := resolve(p)
+		if err != nil {
+			return nil, extendedError{err}
+		}
+		return result, nil
+	}
+}
+
+func currentUser(p graphql.ResolveParams) (*auth.ClaimsUser, error) {
+	user := auth.FromContext(p.Context)
+	if user == nil {
+		return nil, errUnauthenticated
+	}
+	return user, nil
+}
+
+// userVehicle loads one of the user's vehicles; other users' vehicles are
+// not found.
+func userVehicle(ctx context.Context, tx db.Tx, user *auth.ClaimsUser, vehicleID db.RowID) (*db.Vehicle, error) {
+	vehicle, err := tx.GetVehicle(ctx, vehicleID)
+	if err != nil {
+		return nil, err
+	}
+	if vehicle.UserID != user.UserID {
+		return nil, &db.VehicleNotFoundError{VehicleID: vehicleID}
+	}
+	return vehicle, nil
+}
+
+// expectedVersion is a mutation's expected_version argument, or 0 for any
+// version when it's left out.
+func expectedVersion(p graphql.ResolveParams) int64 {
+	if version, ok := p.Args["expected_version"].(int); ok {
+		return int64(version)
+	}
+	return 0
+}
+
+// nullString is an optional string argument as the store takes it, which
+// is nil when it's left out so that the field is left alone.
+func nullString(arg interface{}) *db.NullString {
+	if value, ok := arg.(string); ok {
+		return &db.NullString{String: value, Valid: true}
+	}
+	return nil
+}
+
+func GenerateSchema(store db.Store) (*graphql.Schema, error) {
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"user_id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*db.User).UserId.String(), nil
+				},
+			},
+			"email_address": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"version": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return int(p.Source.(*db.User).Version), nil
+				},
+			},
+		},
+	})
+
+	vehicleType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Vehicle",
+		Fields: graphql.Fields{
+			"vehicle_id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*db.Vehicle).VehicleID.String(), nil
+				},
+			},
+			"user_id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*db.Vehicle).UserID.String(), nil
+				},
+			},
+			"year": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return int(p.Source.(*db.Vehicle).Year), nil
+				},
+			},
+			"make":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"model": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"version": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return int(p.Source.(*db.Vehicle).Version), nil
+				},
+			},
+		},
+	})
 
-func GenerateSchema() (*graphql.Schema, error) {
 	fields := graphql.Fields{
 		"hello": &graphql.Field{
 			Type: graphql.String,
@@ -10,14 +140,143 @@ func GenerateSchema() (*graphql.Schema, error) {
 				return "world", nil
 			},
 		},
+		"me": &graphql.Field{
+			Type: userType,
+			Resolve: withErrorCodes(func(p graphql.ResolveParams) (interface{}, error) {
+				user, err := currentUser(p)
+				if err != nil {
+					return nil, err
+				}
+				return store.GetUser(p.Context, user.UserID)
+			}),
+		},
+		"vehicles": &graphql.Field{
+			Type: graphql.NewList(vehicleType),
+			Resolve: withErrorCodes(func(p graphql.ResolveParams) (interface{}, error) {
+				user, err := currentUser(p)
+				if err != nil {
+					return nil, err
+				}
+				vehicles, _, err := store.ListVehicles(p.Context, user.UserID, db.VehicleFilter{}, db.ListOptions{})
+				return vehicles, err
+			}),
+		},
+		"vehicle": &graphql.Field{
+			Type: vehicleType,
+			Args: graphql.FieldConfigArgument{
+				"vehicle_id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: withErrorCodes(func(p graphql.ResolveParams) (interface{}, error) {
+				user, err := currentUser(p)
+				if err != nil {
+					return nil, err
+				}
+
+				vehicleID, err := db.ParseRowID(p.Args["vehicle_id"].(string))
+				if err != nil {
+					return nil, err
+				}
+
+				return userVehicle(p.Context, store, user, vehicleID)
+			}),
+		},
+	}
+
+	// Mutations take the version of the vehicle they were made against, as
+	// REST takes If-Match; a stale one fails with precondition_failed.
+	mutations := graphql.Fields{
+		"updateVehicle": &graphql.Field{
+			Type: vehicleType,
+			Args: graphql.FieldConfigArgument{
+				"vehicle_id":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"expected_version": &graphql.ArgumentConfig{Type: graphql.Int},
+				"year":             &graphql.ArgumentConfig{Type: graphql.Int},
+				"make":             &graphql.ArgumentConfig{Type: graphql.String},
+				"model":            &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: withErrorCodes(func(p graphql.ResolveParams) (interface{}, error) {
+				user, err := currentUser(p)
+				if err != nil {
+					return nil, err
+				}
+
+				vehicleID, err := db.ParseRowID(p.Args["vehicle_id"].(string))
+				if err != nil {
+					return nil, err
+				}
+
+				var year *db.NullYear
+				if value, ok := p.Args["year"].(int); ok {
+					year = &db.NullYear{Year: db.Year(value), Valid: true}
+				}
+				vehicleMake := nullString(p.Args["make"])
+				model := nullString(p.Args["model"])
+
+				var vehicle *db.Vehicle
+				err = store.InTx(p.Context, func(tx db.Tx) error {
+					_, err := userVehicle(p.Context, tx, user, vehicleID)
+					if err != nil {
+						return err
+					}
+
+					err = tx.UpdateVehicle(p.Context, vehicleID, expectedVersion(p), year, vehicleMake, model)
+					if err != nil {
+						return err
+					}
+
+					vehicle, err = tx.GetVehicle(p.Context, vehicleID)
+					return err
+				})
+				if err != nil {
+					return nil, err
+				}
+				return vehicle, nil
+			}),
+		},
+		"deleteVehicle": &graphql.Field{
+			Type: vehicleType,
+			Args: graphql.FieldConfigArgument{
+				"vehicle_id":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"expected_version": &graphql.ArgumentConfig{Type: graphql.Int},
+			},
+			Resolve: withErrorCodes(func(p graphql.ResolveParams) (interface{}, error) {
+				user, err := currentUser(p)
+				if err != nil {
+					return nil, err
+				}
+
+				vehicleID, err := db.ParseRowID(p.Args["vehicle_id"].(string))
+				if err != nil {
+					return nil, err
+				}
+
+				var vehicle *db.Vehicle
+				err = store.InTx(p.Context, func(tx db.Tx) error {
+					vehicle, err = userVehicle(p.Context, tx, user, vehicleID)
+					if err != nil {
+						return err
+					}
+
+					return tx.DeleteVehicle(p.Context, vehicleID, expectedVersion(p))
+				})
+				if err != nil {
+					return nil, err
+				}
+				return vehicle, nil
+			}),
+		},
 	}
 
 	rootQuery := graphql.ObjectConfig{Name: "RootQuery", Fields: fields}
-	schemaConfig := graphql.SchemaConfig{Query: graphql.NewObject(rootQuery)}
+	rootMutation := graphql.ObjectConfig{Name: "RootMutation", Fields: mutations}
+	schemaConfig := graphql.SchemaConfig{
+		Query:    graphql.NewObject(rootQuery),
+		Mutation: graphql.NewObject(rootMutation),
+	}
 	schema, err := graphql.NewSchema(schemaConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	return &schema, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,191 @@
+// Package webhooks delivers the events recorded in the store's outbox to the
+// webhooks that subscribe to them.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"vehicledb/db"
+)
+
+// Options tune how deliveries are made and retried.
+type Options struct {
+	// AllowedNetworks are the private networks, such as loopback, that
+	// webhooks may reach anyway, for receivers on the server's own network.
+	// Everything else private is refused.
+	AllowedNetworks []*net.IPNet
+	// PollInterval is how often the outbox is checked for due deliveries.
+	PollInterval time.Duration
+	// MaxAttempts is how many times a delivery is tried before it's given
+	// up on.
+	MaxAttempts int
+	// Backoff is the wait after the first failed attempt, doubled after
+	// each one after that up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// BatchSize is how many deliveries are made at once.
+	BatchSize int
+}
+
+// DefaultTimeout bounds each attempt.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultOptions retry a delivery for about three hours.
+var DefaultOptions = Options{
+	PollInterval: 5 * time.Second,
+	MaxAttempts:  10,
+	Backoff:      30 * time.Second,
+	MaxBackoff:   time.Hour,
+	BatchSize:    20,
+}
+
+// deliveryLease is how long a claimed delivery is left alone for. It has to
+// outlast an attempt, or a slow receiver would get the delivery twice.
+const deliveryLease = time.Minute
+
+// maxResponseBytes is as much of a receiver's response as is read; the
+// status is all that counts.
+const maxResponseBytes = 64 << 10
+
+// Dispatcher makes the deliveries in the store's outbox, retrying failed
+// ones with exponential backoff. Since the outbox is in the store, nothing
+// is lost when the server restarts: a delivery that was cut short is tried
+// again once its claim runs out.
+type Dispatcher struct {
+	store   db.Store
+	options Options
+	client  *http.Client
+	now     func() time.Time
+}
+
+func NewDispatcher(store db.Store, options Options) *Dispatcher {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultOptions.BatchSize
+	}
+	return &Dispatcher{store: store, options: options, client: newClient(options.AllowedNetworks), now: time.Now}
+}
+
+// Run makes deliveries as they come due until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.options.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := d.DeliverDue(ctx)
+		if err != nil {
+			log.Printf("failed to deliver webhooks: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue makes every delivery that's due, and returns how many it made.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	delivered := 0
+	for {
+		deliveries, err := d.store.ClaimWebhookDeliveries(ctx, d.now(), deliveryLease, d.options.BatchSize)
+		if err != nil {
+			return delivered, err
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(deliveries))
+		for idx, delivery := range deliveries {
+			wg.Add(1)
+			go func(idx int, delivery *db.PendingDelivery) {
+				defer wg.Done()
+				errs[idx] = d.deliver(ctx, delivery)
+			}(idx, delivery)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				return delivered, err
+			}
+		}
+		delivered += len(deliveries)
+
+		if len(deliveries) < d.options.BatchSize {
+			return delivered, nil
+		}
+	}
+}
+
+// deliver makes one attempt at a delivery and records how it went. Only an
+// error recording it is returned; the receiver's failures are the log's.
+func (d *Dispatcher) deliver(ctx context.Context, delivery *db.PendingDelivery) error {
+	attempt := &db.WebhookAttempt{At: d.now()}
+
+	status, err := d.post(ctx, delivery, attempt.At)
+	attempt.ResponseStatus = status
+	switch {
+	case err == nil:
+		attempt.State = db.DeliverySucceeded
+	case delivery.Attempts+1 >= d.options.MaxAttempts:
+		attempt.State, attempt.Error = db.DeliveryFailed, err.Error()
+	default:
+		attempt.State, attempt.Error = db.DeliveryPending, err.Error()
+		attempt.RetryAt = attempt.At.Add(d.backoff(delivery.Attempts + 1))
+	}
+
+	return d.store.RecordWebhookAttempt(ctx, delivery.DeliveryID, attempt)
+}
+
+// post sends a delivery, signed as of at. The body is the event, as JSON.
+func (d *Dispatcher) post(ctx context.Context, delivery *db.PendingDelivery, at time.Time) (int, error) {
+	body, err := json.Marshal(&delivery.Event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	request, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "vehicledb-webhooks")
+	request.Header.Set(EventHeader, delivery.Event.Type)
+	request.Header.Set(DeliveryHeader, delivery.DeliveryID.String())
+	request.Header.Set(SignatureHeader, Sign(delivery.Secret, at, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(response.Body, maxResponseBytes))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("the receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// backoff is the wait after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.options.Backoff
+	for i := 1; i < attempts && wait < d.options.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.options.MaxBackoff {
+		wait = d.options.MaxBackoff
+	}
+	return wait
+}
@@ -0,0 +1,294 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vehicledb/db"
+)
+
+// receiver is a local webhook receiver that answers with the statuses it's
+// given, in turn, and keeps the events it was sent.
+type receiver struct {
+	t        *testing.T
+	secret   string
+	mutex    sync.Mutex
+	statuses []int
+	events   []db.ChangeEvent
+}
+
+func (r *receiver) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		r.t.Error(err)
+		return
+	}
+	err = Verify(r.secret, request.Header.Get(SignatureHeader), body, time.Now(), 24*time.Hour)
+	if err != nil {
+		r.t.Errorf("expected a valid signature, got %v", err)
+	}
+
+	var event db.ChangeEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		r.t.Error(err)
+	}
+	if request.Header.Get(EventHeader) != event.Type {
+		r.t.Errorf("expected the %s header to be %s, got %s", EventHeader, event.Type, request.Header.Get(EventHeader))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+	status := 204
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	writer.WriteHeader(status)
+}
+
+// loopback lets deliveries reach the test receivers.
+var loopback = mustParseNetworks("127.0.0.0/8", "::1/128")
+
+func TestDispatcher(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	defer store.Close()
+
+	receiver := &receiver{t: t, secret: "secret", statuses: []int{500, 204}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook, err := store.CreateWebhook(ctx, user.UserId, server.URL, []string{db.ChangeVehicleCreated}, receiver.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vehicle, err := store.CreateVehicle(ctx, user.UserId, 2017, "Chevy", "SS")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Add(time.Second)
+	dispatcher := NewDispatcher(store, Options{MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour, AllowedNetworks: loopback})
+	dispatcher.now = func() time.Time { return now }
+
+	delivered, err := dispatcher.DeliverDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 1 {
+		t.Fatalf("expected 1 delivery, made %d", delivered)
+	}
+
+	deliveries, _, err := store.ListWebhookDeliveries(ctx, webhook.WebhookID, db.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := deliveries[0]
+	if failed.State != db.DeliveryPending || failed.Attempts != 1 || *failed.ResponseStatus != 500 {
+		t.Fatalf("expected the failed delivery to be retried, got %+v", failed)
+	}
+	if !failed.NextAttemptAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected a retry in a minute, at %s, got %s", now.Add(time.Minute), failed.NextAttemptAt)
+	}
+
+	delivered, err = dispatcher.DeliverDue(ctx)
+	if err != nil || delivered != 0 {
+		t.Fatalf("expected no deliveries before the retry is due, made %d, %v", delivered, err)
+	}
+
+	now = now.Add(time.Minute)
+	delivered, err = dispatcher.DeliverDue(ctx)
+	if err != nil || delivered != 1 {
+		t.Fatalf("expected the retry to be made, made %d, %v", delivered, err)
+	}
+
+	deliveries, _, err = store.ListWebhookDeliveries(ctx, webhook.WebhookID, db.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	succeeded := deliveries[0]
+	if succeeded.State != db.DeliverySucceeded || succeeded.Attempts != 2 || *succeeded.ResponseStatus != 204 {
+		t.Fatalf("expected the retry to succeed, got %+v", succeeded)
+	}
+
+	if len(receiver.events) != 2 {
+		t.Fatalf("expected the event to be sent twice, got %d", len(receiver.events))
+	}
+	event := receiver.events[1]
+	if event.EventID != receiver.events[0].EventID || event.Type != db.ChangeVehicleCreated || event.ResourceID != vehicle.VehicleID {
+		t.Fatalf("expected the same vehicle.created event both times, got %+v", event)
+	}
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	defer store.Close()
+
+	receiver := &receiver{t: t, secret: "secret", statuses: []int{500, 502, 503}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook, err := store.CreateWebhook(ctx, user.UserId, server.URL, []string{db.ChangeVehicleCreated}, receiver.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.PingWebhook(ctx, webhook.WebhookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Add(time.Second)
+	dispatcher := NewDispatcher(store, Options{MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour, AllowedNetworks: loopback})
+	dispatcher.now = func() time.Time { return now }
+
+	for attempt := 0; attempt < 4; attempt++ {
+		_, err = dispatcher.DeliverDue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Hour)
+	}
+
+	deliveries, _, err := store.ListWebhookDeliveries(ctx, webhook.WebhookID, db.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := deliveries[0]
+	if delivery.State != db.DeliveryFailed || delivery.Attempts != 3 || delivery.NextAttemptAt != nil {
+		t.Fatalf("expected the delivery to be given up on after 3 attempts, got %+v", delivery)
+	}
+	if delivery.Error == "" {
+		t.Fatal("expected the last error to be logged")
+	}
+	if len(receiver.events) != 3 || receiver.events[0].Type != db.ChangeWebhookPing {
+		t.Fatalf("expected the ping to be sent 3 times, got %d", len(receiver.events))
+	}
+}
+
+func TestDispatcherRefusesPrivateAddresses(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryStore()
+	defer store.Close()
+
+	receiver := &receiver{t: t, secret: "secret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusFound))
+	defer redirect.Close()
+
+	user, err := store.CreateUser(ctx, "joe@djeebus.net", "Password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// by name, so that it's the resolved address that's refused
+	private, err := store.CreateWebhook(ctx, user.UserId, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), []string{db.ChangeVehicleCreated}, receiver.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.PingWebhook(ctx, private.WebhookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Add(time.Second)
+	dispatcher := NewDispatcher(store, Options{MaxAttempts: 1, Backoff: time.Minute, MaxBackoff: time.Hour})
+	dispatcher.now = func() time.Time { return now }
+	_, err = dispatcher.DeliverDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, _, err := store.ListWebhookDeliveries(ctx, private.WebhookID, db.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := deliveries[0]
+	if delivery.State != db.DeliveryFailed || delivery.ResponseStatus != nil || !strings.Contains(delivery.Error, ErrAddressNotAllowed.Error()) {
+		t.Fatalf("expected the delivery to a loopback address to be refused, got %+v", delivery)
+	}
+
+	redirected, err := store.CreateWebhook(ctx, user.UserId, redirect.URL, []string{db.ChangeVehicleCreated}, receiver.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.PingWebhook(ctx, redirected.WebhookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dispatcher = NewDispatcher(store, Options{MaxAttempts: 1, Backoff: time.Minute, MaxBackoff: time.Hour, AllowedNetworks: loopback})
+	dispatcher.now = func() time.Time { return now }
+	_, err = dispatcher.DeliverDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries, _, err = store.ListWebhookDeliveries(ctx, redirected.WebhookID, db.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery = deliveries[0]
+	if delivery.State != db.DeliveryFailed || delivery.ResponseStatus == nil || *delivery.ResponseStatus != http.StatusFound {
+		t.Fatalf("expected the redirect to fail the delivery, got %+v", delivery)
+	}
+	if len(receiver.events) != 0 {
+		t.Fatalf("expected nothing to reach the receiver, got %d events", len(receiver.events))
+	}
+}
+
+func TestDispatcherBackoff(t *testing.T) {
+	dispatcher := NewDispatcher(nil, DefaultOptions)
+	cases := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		8:  time.Hour,
+		20: time.Hour,
+	}
+	for attempts, expected := range cases {
+		if wait := dispatcher.backoff(attempts); wait != expected {
+			t.Errorf("after %d attempts, expected to wait %s, got %s", attempts, expected, wait)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"type": "webhook.ping"}`)
+	header := Sign("secret", now, body)
+
+	err := Verify("secret", header, body, now.Add(time.Minute), 5*time.Minute)
+	if err != nil {
+		t.Fatalf("expected the signature to be valid, got %v", err)
+	}
+
+	cases := map[string]error{
+		"wrong secret": Verify("other", header, body, now, 5*time.Minute),
+		"changed body": Verify("secret", header, []byte(`{"type": "vehicle.deleted"}`), now, 5*time.Minute),
+		"too old":      Verify("secret", header, body, now.Add(10*time.Minute), 5*time.Minute),
+		"no signature": Verify("secret", "", body, now, 5*time.Minute),
+	}
+	for name, err := range cases {
+		if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected an invalid signature, got %v", name, err)
+		}
+	}
+}
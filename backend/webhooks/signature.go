@@ -0,0 +1,66 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries a delivery's signature, as made by Sign.
+	SignatureHeader = "X-VehicleDB-Signature"
+	EventHeader     = "X-VehicleDB-Event"
+	DeliveryHeader  = "X-VehicleDB-Delivery"
+)
+
+// ErrInvalidSignature is returned by Verify for a delivery that wasn't
+// signed with the secret, or was signed too long ago.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign signs the body of a delivery sent at t, as
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">". The time is
+// signed too, so that a receiver can refuse old deliveries played again.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, signature(secret, timestamp, body))
+}
+
+func signature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature made by Sign, and that it was made within
+// tolerance of now, for receivers of deliveries.
+func Verify(secret string, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var timestamp, signed string
+	for _, part := range strings.Split(header, ",") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			timestamp = strings.TrimPrefix(part, "t=")
+		case strings.HasPrefix(part, "v1="):
+			signed = strings.TrimPrefix(part, "v1=")
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signed), []byte(signature(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: signed %s ago", ErrInvalidSignature, age)
+	}
+	return nil
+}
@@ -1,5 +1,9 @@
 const URL = 'http://localhost:8000'
 
+// the backend hands out a csrf token with every session response; it has to
+// be echoed back on anything that changes state
+let csrfToken = null
+
 
 export async function isAuthenticated() {
     const response = await fetch(
@@ -34,8 +38,17 @@ async function request(method, path, body) {
         options['body'] = JSON.stringify(body)
     }
 
+    if (csrfToken && !['GET', 'HEAD', 'OPTIONS'].includes(method)) {
+        headers['x-csrf-token'] = csrfToken
+    }
+
     const response = await fetch(URL + path, options)
 
+    const responseCsrfToken = response.headers.get('x-csrf-token')
+    if (responseCsrfToken) {
+        csrfToken = responseCsrfToken
+    }
+
     if (response.status === 204) {
         return null
     }
@@ -74,10 +87,25 @@ export async function  deleteSession() {
     await request(
         'DELETE', '/v1/session',
     )
+    csrfToken = null
 }
 
-export async function getVehicles() {
-    return await request('GET', '/v1/vehicles/')
+// lists come a page at a time, as {items, next_cursor}; pass next_cursor
+// back as cursor for the page after
+export async function getVehicles({cursor, sort, limit} = {}) {
+    const params = new URLSearchParams()
+    if (cursor) {
+        params.set('cursor', cursor)
+    }
+    if (sort) {
+        params.set('sort', sort)
+    }
+    if (limit) {
+        params.set('limit', limit)
+    }
+
+    const query = params.toString()
+    return await request('GET', '/v1/vehicles/' + (query ? '?' + query : ''))
 }
 
 export async function createVehicle(year, make, model) {
@@ -4,15 +4,23 @@ import CreateVehicle from "./CreateVehicle";
 
 export default function({history}) {
     const [vehicles, setVehicles] = useState([])
+    const [nextCursor, setNextCursor] = useState(null)
 
     useEffect(() => {
         async function loadVehicles() {
-            const cars = await getVehicles()
-            setVehicles(cars)
+            const page = await getVehicles()
+            setVehicles(page.items)
+            setNextCursor(page.next_cursor)
         }
         loadVehicles()
     }, [])
 
+    const onLoadMore = async () => {
+        const page = await getVehicles({cursor: nextCursor})
+        setVehicles(vehicles.concat(page.items))
+        setNextCursor(page.next_cursor)
+    }
+
     const onDelete = vehicle => {
         deleteVehicle(vehicle.vehicle_id)
     }
@@ -34,6 +42,7 @@ export default function({history}) {
             <ul>
                 { vehicles.map(renderVehicle) }
             </ul>
+            { nextCursor && <button onClick={onLoadMore}>Load more</button> }
             <CreateVehicle history={history} />
         </div>
     )